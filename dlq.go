@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"platform-service-bus/internal/pkg/config"
+	"platform-service-bus/internal/pkg/queue"
+	"platform-service-bus/internal/pkg/secret"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+// deadLetter - недоставленное сообщение вместе с портом адаптера
+type deadLetter struct {
+	port    int
+	message *queue.Message
+}
+
+// dlq выполняет команды работы с недоставленными сообщениями
+// Возвращает код завершения процесса
+func dlq(configPath string, args []string) int {
+	if len(args) == 0 {
+		fmt.Println("Usage: dlq list | show <id> | replay <id>... | replay all | purge <id>... | purge all")
+		return 2
+	}
+	// Из конфигурации нужен только каталог очередей, секреты адаптеров на этом хосте могут быть недоступны
+	// Повторную отправку выполняет запущенный адаптер со своими секретами, dlq лишь переносит сообщение
+	root, err := config.LoadQueueDir(configPath)
+	if err != nil {
+		fmt.Printf("Не удалось загрузить конфигурацию %s: %v\n", configPath, err)
+		return 1
+	}
+	if root == "" {
+		root = queue.DefaultDir
+	}
+	letters, err := loadDeadLetters(root)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	command, ids := args[0], args[1:]
+	switch command {
+	case "list":
+		return dlqList(letters)
+	case "show":
+		if len(ids) != 1 {
+			fmt.Println("Usage: dlq show <id>")
+			return 2
+		}
+	case "replay", "purge":
+		if len(ids) == 0 {
+			fmt.Printf("Usage: dlq %s <id>... | all\n", command)
+			return 2
+		}
+	default:
+		fmt.Printf("Unknown dlq command %q\n", command)
+		return 2
+	}
+	selected, code := selectDeadLetters(letters, ids)
+	for _, letter := range selected {
+		var err error
+		switch command {
+		case "show":
+			err = dlqShow(letter)
+		case "replay":
+			err = dlqReplay(root, letter)
+		case "purge":
+			err = queue.Dead(root, letter.port).Delete(letter.message.ID)
+			if err == nil {
+				fmt.Printf("%s: удалено\n", letter.message.ID)
+			}
+		}
+		if err != nil {
+			fmt.Printf("%s: %v\n", letter.message.ID, err)
+			code = 1
+		}
+	}
+	return code
+}
+
+// loadDeadLetters читает недоставленные сообщения всех адаптеров
+func loadDeadLetters(root string) ([]deadLetter, error) {
+	ports, err := queue.Ports(root)
+	if err != nil {
+		return nil, err
+	}
+	letters := []deadLetter{}
+	for _, port := range ports {
+		messages, err := queue.Dead(root, port).List()
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range messages {
+			letters = append(letters, deadLetter{port, message})
+		}
+	}
+	return letters, nil
+}
+
+// selectDeadLetters выбирает сообщения по идентификаторам, "all" выбирает все
+// Для ненайденных идентификаторов выводится ошибка и возвращается код 1
+func selectDeadLetters(letters []deadLetter, ids []string) ([]deadLetter, int) {
+	if len(ids) == 1 && ids[0] == "all" {
+		return letters, 0
+	}
+	byID := make(map[string]deadLetter)
+	for _, letter := range letters {
+		byID[letter.message.ID] = letter
+	}
+	selected := []deadLetter{}
+	code := 0
+	for _, id := range ids {
+		letter, prs := byID[id]
+		if !prs {
+			fmt.Printf("%s: сообщение не найдено\n", id)
+			code = 1
+			continue
+		}
+		selected = append(selected, letter)
+	}
+	return selected, code
+}
+
+// dlqList выводит таблицу недоставленных сообщений
+func dlqList(letters []deadLetter) int {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tPORT\tFAILED\tATTEMPTS\tREQUEST\tERROR")
+	for _, letter := range letters {
+		message := letter.message
+		method := message.Method
+		if method == "" {
+			method = "GET"
+		}
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%d\t%s %s\t%s\n",
+			message.ID, letter.port, message.Failed.Format(time.RFC3339), message.Attempts,
+			method, secret.Redact(message.URL), strings.Replace(message.Error, "\n", " ", -1))
+	}
+	writer.Flush()
+	fmt.Printf("Недоставленных сообщений: %d\n", len(letters))
+	return 0
+}
+
+// dlqShow выводит сообщение целиком, тело в виде текста, если это возможно
+// Секреты конфигурации в адресе и хедерах скрываются
+func dlqShow(letter deadLetter) error {
+	message := *letter.message
+	message.URL = secret.Redact(message.URL)
+	message.Headers = make([]string, len(letter.message.Headers))
+	for k, header := range letter.message.Headers {
+		message.Headers[k] = secret.Redact(header)
+	}
+	view := struct {
+		*queue.Message
+		Port int
+		Body interface{}
+	}{&message, letter.port, letter.message.Body}
+	if utf8.Valid(letter.message.Body) {
+		view.Body = string(letter.message.Body)
+	}
+	data, err := json.MarshalIndent(view, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// dlqReplay возвращает сообщение в очередь доставки адаптера
+// Запущенный адаптер отправит его в течение секунды, остановленный - после запуска
+func dlqReplay(root string, letter deadLetter) error {
+	message := *letter.message
+	message.Attempts, message.Status, message.Error = 0, 0, ""
+	message.Failed, message.Next = time.Time{}, time.Now()
+	if err := queue.Pending(root, letter.port).Put(&message); err != nil {
+		return err
+	}
+	if err := queue.Dead(root, letter.port).Delete(message.ID); err != nil {
+		return err
+	}
+	fmt.Printf("%s: возвращено в очередь доставки адаптера :%d\n", message.ID, letter.port)
+	return nil
+}
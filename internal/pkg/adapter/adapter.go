@@ -1,136 +1,351 @@
 package adapter
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
+	"net"
 	"net/http"
+	"platform-service-bus/internal/pkg/auth"
+	"platform-service-bus/internal/pkg/queue"
+	"platform-service-bus/internal/pkg/router"
 	rulePkg "platform-service-bus/internal/pkg/rule"
+	"platform-service-bus/internal/pkg/secret"
+	"platform-service-bus/internal/pkg/tlsconfig"
+	"reflect"
 	"strings"
 )
 
 // Adapter описывает адаптер для соединения двух сервисов между собой
 type Adapter struct {
 	Name  string
-	Port  int16
+	Port  int
 	Rules []rulePkg.Rule
+	// Timeout - время ожидания исходящих запросов для правил без собственного таймаута
+	Timeout rulePkg.Duration
+	// Auth - проверка входящих запросов ко всем путям адаптера, кроме /health-check
+	Auth auth.Inbound
+	// TLS включает HTTPS и, при указании центров клиентов, mTLS
+	TLS tlsconfig.Server
+	// client - общий для всех правил адаптера HTTP-клиент с пулом соединений
+	client *http.Client
+	// clients - HTTP-клиенты для правил с собственными настройками TLS
+	clients *clientPool
+	// queueDir - корневой каталог очередей асинхронной доставки
+	queueDir string
+	// worker - фоновая доставка сообщений из очереди
+	worker *worker
+	// server - запущенный сервер адаптера
+	server *http.Server
 }
 
 // Endpoint описывает сгруппированый по пути набор правил
 type Endpoint struct {
 	path  string
 	Rules []rulePkg.Rule
+	// indexes - номера правил в адаптере
+	indexes []int
 }
 
 // endpointHandler обрабатывает запросы от клиентов
 func (endpoint *Endpoint) endpointHandler(adapter *Adapter) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		log.Infof("Запускаем endpointHandler для '%s':%d", adapter.Name, adapter.Port)
-		log.Infof("Request: %v", req)
-		log.Infof("Query: %v", req.URL.Query())
-		body, _ := ioutil.ReadAll(req.Body)
-		req.Body.Close()
-		req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		// Хедеры и GET-параметры не логируются: в них могут быть ключи и токены входящей аутентификации
+		log.Infof("Request: %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+		// Тело читается и разбирается один раз, запрос передаётся во все шаблоны правила
+		request := rulePkg.NewRequest(req)
+		body := request.Body()
 		log.Infof("Body: %s", body)
-		for i, rule := range endpoint.Rules {
-			if i == len(endpoint.Rules)-1 {
-				headers, body := rulePkg.HandleRule(rule, req)
-				// Если запрос никуда не уходит, то просто отдаём новый запрос в качестве ответа
-				if rule.To.URL == "" {
-					responseHeaders := w.Header()
-					for _, header := range headers {
-						parts := strings.SplitN(header, ":", 2)
-						responseHeaders.Set(parts[0], strings.TrimSpace(parts[1]))
-					}
-					w.Write(body)
-					log.Infof("Без перенаправления. Headers: %v, Body: %s", responseHeaders, body)
-				} else { // Если запрос перенаправляется на другой URL
-					request, err := http.NewRequest(rule.To.HTTPMethod, rule.To.URL, bytes.NewReader(body))
-					if err != nil {
-						w.Write([]byte(fmt.Sprintf(`{"error": "%v"}`, err)))
-						log.Errorf("Error http.NewRequest: %v", err)
-						return
-					}
-					requestQuery := request.URL.Query()
-					// Прокидываем GET-параметры
-					for name, values := range req.URL.Query() {
-						for _, value := range values {
-							requestQuery.Add(name, value)
-						}
-					}
-					request.URL.RawQuery = requestQuery.Encode()
-					// Устанавливаем хедеры
-					for _, header := range headers {
-						parts := strings.SplitN(header, ":", 2)
-						request.Header.Set(parts[0], strings.TrimSpace(parts[1]))
-					}
-					// Выполняем запрос
-					client := &http.Client{}
-					log.Infof("Проксирование на другой URL: %v", request)
-					response, err := client.Do(request)
-					if err != nil {
-						w.Write([]byte(fmt.Sprintf(`{"error": "%v"}`, err)))
-						log.Errorf("Error client.Do: %v , %v", err, request)
-						return
-					}
-					body, err := ioutil.ReadAll(response.Body)
-					defer response.Body.Close()
-					if err != nil {
-						w.Write([]byte(fmt.Sprintf(`{"error": "%v"}`, err)))
-						log.Errorf("Error ioutil.ReadAll: %v", err)
-						return
-					}
-					// Прокидываем хедеры из ответа
-					responseHeaders := w.Header()
-					for name, values := range response.Header {
-						for _, value := range values {
-							responseHeaders.Set(name, value)
-						}
-					}
-					w.Write(body)
-					log.Infof("Response headers: %v", responseHeaders)
-					log.Infof("Response body: %s", body)
+		if !authorize(w, adapter.Auth, req, body) {
+			return
+		}
+		candidates := endpoint.matchRules(req.Method)
+		if len(candidates) == 0 {
+			w.Header().Set("Allow", strings.Join(endpoint.allowedMethods(), ", "))
+			writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", req.Method))
+			log.Infof("Нет правил для метода %s на пути %s", req.Method, endpoint.path)
+			return
+		}
+		position, found := endpoint.selectRule(candidates, request)
+		if !found {
+			writeError(w, http.StatusNotFound, "no matching rule")
+			log.Infof("Запрос не подходит ни под одно правило пути %s", endpoint.path)
+			return
+		}
+		rule := endpoint.Rules[position]
+		if !authorize(w, rule.From.Auth, req, body) {
+			return
+		}
+		// Выполняем промежуточные шаги конвейера
+		for i, step := range rule.Steps {
+			log.Infof("Промежуточная трансформация, шаг %d", i+1)
+			next, err := adapter.runStep(rule, step, request)
+			if err != nil {
+				writeError(w, errorStatus(err), err.Error())
+				return
+			}
+			request = next
+		}
+		// При асинхронной доставке сохраняем запросы в очередь и сразу отвечаем клиенту
+		if rule.Async {
+			adapter.acceptAsync(w, endpoint.indexes[position], rule, request)
+			return
+		}
+		// Если адресатов несколько, запрос отправляется каждому согласно fan-out
+		if len(rule.Destinations) > 0 {
+			adapter.fanOut(w, endpoint.indexes[position], rule, request)
+			return
+		}
+		headers, body, err := rulePkg.HandleRule(rule, request)
+		if err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			log.Errorf("Ошибка формирования запроса: %v", err)
+			return
+		}
+		// Если запрос никуда не уходит, то просто отдаём новый запрос в качестве ответа
+		if rule.To.URL == "" {
+			responseHeaders := w.Header()
+			for name, values := range parseHeaders(headers) {
+				responseHeaders[name] = values
+			}
+			w.Write(body)
+			log.Infof("Без перенаправления. Headers: %v, Body: %s", responseHeaders, body)
+		} else { // Если запрос перенаправляется на другой URL
+			response, err := adapter.callUpstream(rule, rule.To, headers, body, request)
+			if err != nil {
+				writeError(w, errorStatus(err), err.Error())
+				// Запрос сохраняется, чтобы его можно было отправить повторно командой dlq replay
+				if upstreamErr, ok := err.(*UpstreamError); ok {
+					adapter.deadLetter(&queue.Message{
+						Rule:     endpoint.indexes[position],
+						Path:     rule.From.Path,
+						Method:   rule.To.HTTPMethod,
+						URL:      upstreamErr.URL,
+						Headers:  headers,
+						Body:     body,
+						Attempts: upstreamErr.Attempts,
+						Error:    secret.Redact(err.Error()),
+					})
 				}
-			} else {
-				log.Info("Промежуточная трансформация")
-				rulePkg.HandleRule(rule, req)
+				return
 			}
+			writeUpstream(w, rule, rule.To, response, request, map[string]*rulePkg.Upstream{rule.To.DestinationName(0): response})
 		}
 	}
 }
 
+// writeUpstream отдаёт клиенту ответ вышестоящего сервиса, преобразованный по шаблону ответа правила
+// upstreams - ответы всех адресатов по именам для подстановок %UPSTREAM[name]...%
+// Статус ответа заменяется согласно To.StatusMap
+func writeUpstream(w http.ResponseWriter, rule rulePkg.Rule, to rulePkg.To, response *rulePkg.Upstream, request *rulePkg.Request, upstreams map[string]*rulePkg.Upstream) {
+	// Прокидываем хедеры из ответа
+	responseHeaders := w.Header()
+	for name, values := range response.Header {
+		for _, value := range values {
+			responseHeaders.Set(name, value)
+		}
+	}
+	// Преобразуем ответ по шаблону
+	responseBody := response.Body
+	if rule.Response.IsSet() {
+		responseHeaderList, transformed, err := rulePkg.HandleResponse(rule, request, response, upstreams)
+		if err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			log.Errorf("Ошибка формирования ответа: %v", err)
+			return
+		}
+		responseBody = transformed
+		responseHeaders.Del("Content-Length")
+		for name, values := range parseHeaders(responseHeaderList) {
+			responseHeaders[name] = values
+		}
+	}
+	// Прокидываем статус ответа
+	status := to.MapStatus(response.StatusCode)
+	w.WriteHeader(status)
+	w.Write(responseBody)
+	log.Infof("Response status: %d (upstream %d)", status, response.StatusCode)
+	log.Infof("Response headers: %v", responseHeaders)
+	log.Infof("Response body: %s", responseBody)
+}
+
+// authorize проверяет входящий запрос и при отказе отдаёт клиенту 401 или 403
+func authorize(w http.ResponseWriter, inbound auth.Inbound, req *http.Request, body []byte) bool {
+	err := inbound.Verify(req, body)
+	if err == nil {
+		return true
+	}
+	status := http.StatusUnauthorized
+	if denied, ok := err.(*auth.Error); ok {
+		status = denied.Status
+		if denied.Challenge != "" {
+			w.Header().Set("WWW-Authenticate", denied.Challenge)
+		}
+	}
+	log.Warnf("Отказано в доступе к %s с адреса %s: %v", req.URL.Path, req.RemoteAddr, err)
+	writeError(w, status, err.Error())
+	return false
+}
+
+// selectRule выбирает из кандидатов первое правило, условия которого выполняются для запроса
+// Возвращает позицию правила в Rules
+func (endpoint *Endpoint) selectRule(candidates []int, request *rulePkg.Request) (int, bool) {
+	for _, position := range candidates {
+		if endpoint.Rules[position].From.Matches(request) {
+			return position, true
+		}
+	}
+	return 0, false
+}
+
+// matchRules отбирает правила, подходящие под HTTP-метод запроса
+// Возвращает позиции правил в Rules
+func (endpoint *Endpoint) matchRules(method string) []int {
+	positions := []int{}
+	for position, rule := range endpoint.Rules {
+		if rule.From.MatchMethod(method) {
+			positions = append(positions, position)
+		}
+	}
+	return positions
+}
+
+// allowedMethods возвращает уникальные HTTP-методы правил для заголовка Allow
+func (endpoint *Endpoint) allowedMethods() []string {
+	methods := []string{}
+	seen := make(map[string]bool)
+	for _, rule := range endpoint.Rules {
+		for _, method := range rule.From.Methods() {
+			if !seen[method] {
+				seen[method] = true
+				methods = append(methods, method)
+			}
+		}
+	}
+	return methods
+}
+
+// errorStatus возвращает код ответа для ошибки обработки запроса
+// Ошибки шаблонов - внутренние, остальные - ошибки вышестоящего сервиса
+func errorStatus(err error) int {
+	if _, ok := err.(*rulePkg.RenderError); ok {
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadGateway
+}
+
+// writeError отдаёт клиенту ошибку в формате JSON с указанным статусом
+// Секретные значения, например из адреса вышестоящего сервиса, в сообщении скрываются
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoded, _ := json.Marshal(secret.Redact(message))
+	w.Write([]byte(fmt.Sprintf(`{"error": %s}`, encoded)))
+}
+
 // getEndpoints возвращает хэш-таблицу уникальных входящих путей к правилам адаптера
 // {"/test" => Rule, ...}
 func (adapter *Adapter) getEndpoints() map[string]*Endpoint {
 	endpoints := make(map[string]*Endpoint)
-	for _, rule := range adapter.Rules {
+	for i, rule := range adapter.Rules {
 		if _, prs := endpoints[rule.From.Path]; !prs {
 			endpoints[rule.From.Path] = &Endpoint{
 				path: rule.From.Path,
 			}
 		}
-		endpoints[rule.From.Path].Rules = append(endpoints[rule.From.Path].Rules, rule)
+		endpoint := endpoints[rule.From.Path]
+		endpoint.Rules = append(endpoint.Rules, rule)
+		endpoint.indexes = append(endpoint.indexes, i)
 	}
 	return endpoints
 }
 
-// getHandler создаёт мультиплексор входящих запросов
-func (adapter *Adapter) getHandler() *http.ServeMux {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/health-check", HealthCheckHandler(adapter))
-	// Для каждого URI свой обработчик
+// getHandler создаёт маршрутизатор входящих запросов
+func (adapter *Adapter) getHandler() http.Handler {
+	if adapter.client == nil {
+		adapter.client = newClient(nil)
+	}
+	if adapter.clients == nil {
+		adapter.clients = &clientPool{clients: make(map[tlsconfig.Client]*http.Client)}
+	}
+	mux := router.New()
+	healthCheck, _ := router.Compile("/health-check", router.Exact)
+	mux.Handle(healthCheck, HealthCheckHandler(adapter))
+	// Для каждого шаблона пути свой обработчик
 	for path, endpoint := range adapter.getEndpoints() {
-		mux.HandleFunc(path, endpoint.endpointHandler(adapter))
+		pattern, err := endpoint.Rules[0].From.Pattern()
+		if err != nil {
+			log.Errorf("Пропускаем путь %s адаптера '%s': %v", path, adapter.Name, err)
+			continue
+		}
+		mux.Handle(pattern, endpoint.endpointHandler(adapter))
 	}
 	return mux
 }
 
-// StartServer запускает сервер
-func (adapter *Adapter) StartServer() {
-	mux := adapter.getHandler()
-	log.Infof("Запускаем сервер для адаптера: %v", adapter)
-	http.ListenAndServe(fmt.Sprintf(":%d", adapter.Port), mux)
+// Start занимает порт адаптера и запускает сервер в фоне
+// Ошибка занятия порта возвращается сразу
+func (adapter *Adapter) Start(ctx context.Context) error {
+	listenConfig := net.ListenConfig{}
+	listener, err := listenConfig.Listen(ctx, "tcp", fmt.Sprintf(":%d", adapter.Port))
+	if err != nil {
+		return fmt.Errorf("адаптер '%s': не удалось занять порт %d: %v", adapter.Name, adapter.Port, err)
+	}
+	if adapter.TLS.IsSet() {
+		tlsConfig, err := adapter.TLS.Config()
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("адаптер '%s': %v", adapter.Name, err)
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	adapter.server = &http.Server{
+		Handler: adapter.getHandler(),
+	}
+	log.Infof("Запускаем сервер для адаптера '%s':%d", adapter.Name, adapter.Port)
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Ошибка сервера адаптера '%s':%d: %v", adapter.Name, adapter.Port, err)
+		}
+	}(adapter.server)
+	adapter.startWorker()
+	return nil
+}
+
+// Shutdown останавливает сервер, дожидаясь завершения обрабатываемых запросов
+// Если ctx завершится раньше, оставшиеся соединения закрываются принудительно
+func (adapter *Adapter) Shutdown(ctx context.Context) error {
+	if adapter.server == nil {
+		return nil
+	}
+	log.Infof("Останавливаем сервер для адаптера '%s':%d", adapter.Name, adapter.Port)
+	err := adapter.server.Shutdown(ctx)
+	if err != nil {
+		adapter.server.Close()
+	}
+	if workerErr := adapter.stopWorker(ctx); err == nil {
+		err = workerErr
+	}
+	if adapter.client != nil {
+		adapter.client.CloseIdleConnections()
+	}
+	if adapter.clients != nil {
+		adapter.clients.closeIdleConnections()
+	}
+	adapter.server = nil
+	return err
+}
+
+// Equal сравнивает конфигурацию адаптеров без учёта состояния серверов
+func (adapter *Adapter) Equal(other *Adapter) bool {
+	left, right := *adapter, *other
+	left.client, left.server, left.clients, left.worker = nil, nil, nil, nil
+	right.client, right.server, right.clients, right.worker = nil, nil, nil, nil
+	return reflect.DeepEqual(left, right)
 }
 
 // HealthCheckHandler - обработчик запроса health check
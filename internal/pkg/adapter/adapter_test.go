@@ -1,12 +1,24 @@
 package adapter
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"platform-service-bus/internal/pkg/auth"
+	"platform-service-bus/internal/pkg/queue"
 	rulePkg "platform-service-bus/internal/pkg/rule"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestGetEndpoints(t *testing.T) {
@@ -45,6 +57,21 @@ func TestGetEndpoints(t *testing.T) {
 }
 
 func TestStartServer(t *testing.T) {
+	// Вышестоящий сервис отвечает как httpbin: GET-параметры и тело запроса
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		args := make(map[string]string)
+		for name := range req.URL.Query() {
+			args[name] = req.URL.Query().Get(name)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(map[string]interface{}{"args": args, "data": string(body)})
+	}))
+	defer upstream.Close()
+
 	table := []struct {
 		name              string
 		url               string
@@ -85,7 +112,7 @@ func TestStartServer(t *testing.T) {
 			expectedError: true,
 		},
 		{
-			name:          "Несколько обработчиков одного URI возвращают ответ последнего",
+			name:          "Несколько обработчиков одного URI возвращают ответ первого подходящего",
 			url:           "/test3?q1=1&q2=2",
 			method:        "GET",
 			expected:      `{"rule": "test1", "query": "21"}`,
@@ -102,11 +129,52 @@ func TestStartServer(t *testing.T) {
 			},
 			expectedError: false,
 		},
+		{
+			name:     "Неподходящий HTTP-метод",
+			url:      "/test1",
+			method:   "POST",
+			expected: `{"error": "method POST not allowed"}`,
+			expectedHeaders: []string{
+				"Allow: GET",
+			},
+			expectedError: true,
+		},
+		{
+			name:     "Выбор правила по HTTP-методу",
+			url:      "/test8",
+			method:   "POST",
+			expected: `{"rule": "test8", "method": "POST"}`,
+		},
+		{
+			name:     "Правило с любым HTTP-методом",
+			url:      "/test9",
+			method:   "POST",
+			expected: `{"rule": "test9"}`,
+		},
+		{
+			name:     "Выбор правила по GET-параметру",
+			url:      "/test10?type=dlr",
+			method:   "GET",
+			expected: `{"rule": "test10", "type": "dlr"}`,
+		},
+		{
+			name:     "Выбор правила по умолчанию при невыполненных условиях",
+			url:      "/test10?type=other",
+			method:   "GET",
+			expected: `{"rule": "test10", "type": "inbound"}`,
+		},
+		{
+			name:          "Ни одно правило не подходит по условиям",
+			url:           "/test11",
+			method:        "GET",
+			expected:      `{"error": "no matching rule"}`,
+			expectedError: true,
+		},
 		{
 			name:              "Перенаправление GET-запроса",
 			url:               "/test5?q1=1&q2=2",
 			method:            "GET",
-			expectedSubstring: "args\": {\n    \"p\": \"2\", \n    \"q1\": \"1\", \n    \"q2\": \"2\"\n  }",
+			expectedSubstring: "args\": {\n    \"p\": \"2\",\n    \"q1\": \"1\",\n    \"q2\": \"2\"\n  }",
 			expectedError:     false,
 		},
 		{
@@ -120,7 +188,7 @@ func TestStartServer(t *testing.T) {
 			name:              "Перенаправление GET-запроса на POST-запрос сохраняет GET-параметры",
 			url:               "/test7?q1=1&q2=2",
 			method:            "GET",
-			expectedSubstring: "args\": {\n    \"q1\": \"1\", \n    \"q2\": \"2\"\n  }",
+			expectedSubstring: "args\": {\n    \"q1\": \"1\",\n    \"q2\": \"2\"\n  }",
 			expectedError:     false,
 		},
 	}
@@ -149,6 +217,11 @@ func TestStartServer(t *testing.T) {
 				From: rulePkg.From{
 					Path:       "/test3",
 					HTTPMethod: "GET",
+					Match: rulePkg.Match{
+						Query: []rulePkg.Condition{
+							rulePkg.Condition{Name: "q1", Equals: "2"},
+						},
+					},
 				},
 				To: rulePkg.To{
 					Data: `{"rule": "test1", "query": "wrong"}`,
@@ -166,7 +239,7 @@ func TestStartServer(t *testing.T) {
 			rulePkg.Rule{
 				From: rulePkg.From{
 					Path:       "/test4",
-					HTTPMethod: "POST",
+					HTTPMethod: "GET",
 				},
 				To: rulePkg.To{
 					Headers: []string{
@@ -182,7 +255,7 @@ func TestStartServer(t *testing.T) {
 					HTTPMethod: "GET",
 				},
 				To: rulePkg.To{
-					URL: "https://httpbin.org/get?p=2",
+					URL: upstream.URL + "/get?p=2",
 				},
 			},
 			rulePkg.Rule{
@@ -191,7 +264,7 @@ func TestStartServer(t *testing.T) {
 					HTTPMethod: "POST",
 				},
 				To: rulePkg.To{
-					URL:        "https://httpbin.org/post",
+					URL:        upstream.URL + "/post",
 					HTTPMethod: "POST",
 					Data:       "<test>post</test>",
 				},
@@ -202,11 +275,75 @@ func TestStartServer(t *testing.T) {
 					HTTPMethod: "GET",
 				},
 				To: rulePkg.To{
-					URL:        "https://httpbin.org/post",
+					URL:        upstream.URL + "/post",
 					HTTPMethod: "POST",
 					Data:       "<test>post</test>",
 				},
 			},
+			rulePkg.Rule{
+				From: rulePkg.From{
+					Path:       "/test8",
+					HTTPMethod: "GET",
+				},
+				To: rulePkg.To{
+					Data: `{"rule": "test8", "method": "GET"}`,
+				},
+			},
+			rulePkg.Rule{
+				From: rulePkg.From{
+					Path:       "/test8",
+					HTTPMethod: "POST",
+				},
+				To: rulePkg.To{
+					Data: `{"rule": "test8", "method": "POST"}`,
+				},
+			},
+			rulePkg.Rule{
+				From: rulePkg.From{
+					Path:       "/test9",
+					HTTPMethod: "*",
+				},
+				To: rulePkg.To{
+					Data: `{"rule": "test9"}`,
+				},
+			},
+			rulePkg.Rule{
+				From: rulePkg.From{
+					Path:       "/test10",
+					HTTPMethod: "GET",
+					Match: rulePkg.Match{
+						Query: []rulePkg.Condition{
+							rulePkg.Condition{Name: "type", Equals: "dlr"},
+						},
+					},
+				},
+				To: rulePkg.To{
+					Data: `{"rule": "test10", "type": "dlr"}`,
+				},
+			},
+			rulePkg.Rule{
+				From: rulePkg.From{
+					Path:       "/test10",
+					HTTPMethod: "GET",
+				},
+				To: rulePkg.To{
+					Data: `{"rule": "test10", "type": "inbound"}`,
+				},
+			},
+			rulePkg.Rule{
+				From: rulePkg.From{
+					Path:       "/test11",
+					HTTPMethod: "GET",
+					Match: rulePkg.Match{
+						Headers: []rulePkg.Condition{
+							rulePkg.Condition{Name: "X-Required"},
+						},
+					},
+				},
+				To: rulePkg.To{
+					Data: `{"rule": "test11"}`,
+				},
+			},
 		},
 	}
 	mux := adapter.getHandler()
@@ -263,3 +400,885 @@ func TestStartServer(t *testing.T) {
 		})
 	}
 }
+
+func TestPipeline(t *testing.T) {
+	// Вышестоящий сервис обогащает запрос
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("X-Upstream", "enricher")
+		w.Write([]byte(`{"balance": 10, "request": ` + string(body) + `}`))
+	}))
+	defer upstream.Close()
+
+	adapter := &Adapter{
+		Rules: []rulePkg.Rule{
+			rulePkg.Rule{
+				From: rulePkg.From{
+					Path:       "/pipeline",
+					HTTPMethod: "POST",
+				},
+				Steps: []rulePkg.To{
+					rulePkg.To{
+						Data: `{"text": "%BODY%"}`,
+					},
+					rulePkg.To{
+						URL:        upstream.URL,
+						HTTPMethod: "POST",
+						Data:       "%BODY%",
+					},
+				},
+				To: rulePkg.To{
+					Headers: []string{
+						"Content-Type: application/json",
+					},
+					Data: `{"balance": %REGEX["balance": (\d+)][1]%, "enriched": %BODY%}`,
+				},
+			},
+		},
+	}
+	server := httptest.NewServer(adapter.getHandler())
+	defer server.Close()
+
+	response, err := server.Client().Post(server.URL+"/pipeline", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("Ошибка запроса. Expected nil, got %v", err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	expected := `{"balance": 10, "enriched": {"balance": 10, "request": {"text": "hello"}}}`
+	if string(body) != expected {
+		t.Errorf("Неверный ответ. Expected %v, got %q", expected, body)
+	}
+}
+
+func TestUpstreamStatus(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := map[string]int{
+			"/error":    http.StatusInternalServerError,
+			"/accepted": http.StatusAccepted,
+		}[req.URL.Path]
+		w.WriteHeader(status)
+		w.Write([]byte(req.URL.Path))
+	}))
+	defer upstream.Close()
+
+	table := []struct {
+		name     string
+		to       rulePkg.To
+		expected int
+	}{
+		{
+			name: "Статус ошибки передаётся клиенту",
+			to: rulePkg.To{
+				URL: upstream.URL + "/error",
+			},
+			expected: http.StatusInternalServerError,
+		},
+		{
+			name: "Статус без переопределения",
+			to: rulePkg.To{
+				URL: upstream.URL + "/accepted",
+			},
+			expected: http.StatusAccepted,
+		},
+		{
+			name: "Переопределение статуса",
+			to: rulePkg.To{
+				URL:       upstream.URL + "/accepted",
+				StatusMap: map[int]int{http.StatusAccepted: http.StatusOK},
+			},
+			expected: http.StatusOK,
+		},
+		{
+			name: "Недоступный сервис",
+			to: rulePkg.To{
+				URL: "http://127.0.0.1:1/unreachable",
+			},
+			expected: http.StatusBadGateway,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			adapter := &Adapter{
+				Rules: []rulePkg.Rule{
+					rulePkg.Rule{
+						From: rulePkg.From{Path: "/status"},
+						To:   item.to,
+					},
+				},
+			}
+			server := httptest.NewServer(adapter.getHandler())
+			defer server.Close()
+			response, err := server.Client().Get(server.URL + "/status")
+			if err != nil {
+				t.Fatalf("Ошибка запроса. Expected nil, got %v", err)
+			}
+			response.Body.Close()
+			if response.StatusCode != item.expected {
+				t.Errorf("Неверный статус. Expected %v, got %v", item.expected, response.StatusCode)
+			}
+		})
+	}
+}
+
+func TestResponseTemplate(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(`<soap:Envelope><soap:Body><smsid>1234</smsid></soap:Body></soap:Envelope>`))
+	}))
+	defer upstream.Close()
+
+	adapter := &Adapter{
+		Rules: []rulePkg.Rule{
+			rulePkg.Rule{
+				From: rulePkg.From{Path: "/send-sms"},
+				To: rulePkg.To{
+					URL:        upstream.URL,
+					HTTPMethod: "POST",
+				},
+				Response: rulePkg.Response{
+					Headers: []string{"Content-Type: application/json"},
+					Data:    `{"id": "%UPSTREAM_REGEX[smsid>([^<]+)][1]%"}`,
+				},
+			},
+		},
+	}
+	server := httptest.NewServer(adapter.getHandler())
+	defer server.Close()
+
+	response, err := server.Client().Post(server.URL+"/send-sms", "text/plain", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("Ошибка запроса. Expected nil, got %v", err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if expected := `{"id": "1234"}`; string(body) != expected {
+		t.Errorf("Неверный ответ. Expected %v, got %q", expected, body)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Неверный header. Expected application/json, got %v", contentType)
+	}
+}
+
+func TestTemplatedRequest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(fmt.Sprintf("%s %s %s", req.URL.Path, req.URL.RawQuery, req.Header.Get("X-Request-Id"))))
+	}))
+	defer upstream.Close()
+
+	adapter := &Adapter{
+		Rules: []rulePkg.Rule{
+			rulePkg.Rule{
+				From: rulePkg.From{Path: "/send-sms"},
+				To: rulePkg.To{
+					URL:        upstream.URL + "/users/%QUERY[user]%?method=%METHOD%",
+					Query:      rulePkg.Query{Deny: []string{"token"}},
+					HTTPMethod: "POST",
+					Headers:    []string{"X-Request-Id: req-%HEADER[X-Trace]%"},
+				},
+			},
+		},
+	}
+	server := httptest.NewServer(adapter.getHandler())
+	defer server.Close()
+
+	request, _ := http.NewRequest("PUT", server.URL+"/send-sms?user=a+b&token=secret", nil)
+	request.Header.Set("X-Trace", "42")
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatalf("Ошибка запроса. Expected nil, got %v", err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if expected := "/users/a b method=PUT&user=a+b req-42"; string(body) != expected {
+		t.Errorf("Неверный запрос к сервису. Expected %v, got %q", expected, body)
+	}
+}
+
+func TestEncodedURL(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		w.Write([]byte(query.Get("text") + " " + query.Get("name") + " " + query.Get("id")))
+	}))
+	defer upstream.Close()
+
+	adapter := &Adapter{
+		Rules: []rulePkg.Rule{
+			rulePkg.Rule{
+				From: rulePkg.From{Path: "/send-sms"},
+				To:   rulePkg.To{URL: upstream.URL + "/send?text=%D0%9F%D1%80&name=%C3%A9&id=%QUERY[id]%", Query: rulePkg.Query{Deny: []string{rulePkg.DenyAll}}},
+			},
+		},
+	}
+	server := httptest.NewServer(adapter.getHandler())
+	defer server.Close()
+
+	response, err := server.Client().Get(server.URL + "/send-sms?id=7")
+	if err != nil {
+		t.Fatalf("Ошибка запроса. Expected nil, got %v", err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || string(body) != "Пр é 7" {
+		t.Errorf("Неверный запрос к сервису. Expected 200 \"Пр é 7\", got %d %q", response.StatusCode, body)
+	}
+}
+
+func TestPathParams(t *testing.T) {
+	adapter := &Adapter{
+		Rules: []rulePkg.Rule{
+			rulePkg.Rule{
+				From: rulePkg.From{Path: "/users/{id}/sms/{kind}"},
+				To:   rulePkg.To{Data: `{"user": "%PATH[id]%", "kind": "%PATH[kind]%"}`},
+			},
+			rulePkg.Rule{
+				From: rulePkg.From{Path: "/users/{id}"},
+				To:   rulePkg.To{Data: `user %PATH[id]%`},
+			},
+		},
+	}
+	server := httptest.NewServer(adapter.getHandler())
+	defer server.Close()
+
+	table := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Параметры пути в шаблоне",
+			path:           "/users/42/sms/flash",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"user": "42", "kind": "flash"}`,
+		},
+		{
+			name:           "Более короткий шаблон",
+			path:           "/users/7",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `user 7`,
+		},
+		{
+			name:           "Путь без подходящего шаблона",
+			path:           "/users/7/other",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			response, err := server.Client().Get(server.URL + item.path)
+			if err != nil {
+				t.Fatalf("Ошибка запроса. Expected nil, got %v", err)
+			}
+			defer response.Body.Close()
+			body, _ := ioutil.ReadAll(response.Body)
+			if response.StatusCode != item.expectedStatus {
+				t.Errorf("Неверный статус. Expected %v, got %v", item.expectedStatus, response.StatusCode)
+			}
+			if item.expectedBody != "" && string(body) != item.expectedBody {
+				t.Errorf("Неверный ответ. Expected %v, got %q", item.expectedBody, body)
+			}
+		})
+	}
+}
+
+func TestInboundAuth(t *testing.T) {
+	adapter := &Adapter{
+		Auth: auth.Inbound{Allow: []string{"127.0.0.1"}},
+		Rules: []rulePkg.Rule{
+			rulePkg.Rule{
+				From: rulePkg.From{Path: "/dlr", Auth: auth.Inbound{Type: auth.APIKey, Keys: []string{"key"}}},
+				To:   rulePkg.To{Data: `ok`},
+			},
+			rulePkg.Rule{
+				From: rulePkg.From{Path: "/open"},
+				To:   rulePkg.To{Data: `ok`},
+			},
+		},
+	}
+	server := httptest.NewServer(adapter.getHandler())
+	defer server.Close()
+	denied := &Adapter{
+		Auth:  auth.Inbound{Allow: []string{"192.0.2.0/24"}},
+		Rules: adapter.Rules,
+	}
+	deniedServer := httptest.NewServer(denied.getHandler())
+	defer deniedServer.Close()
+
+	table := []struct {
+		name           string
+		url            string
+		key            string
+		expectedStatus int
+	}{
+		{
+			name:           "Правило без собственной проверки",
+			url:            server.URL + "/open",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Правило с ключом",
+			url:            server.URL + "/dlr",
+			key:            "key",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Правило без ключа",
+			url:            server.URL + "/dlr",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Адрес не из списка адаптера",
+			url:            deniedServer.URL + "/open",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Health check доступен с любого адреса",
+			url:            deniedServer.URL + "/health-check",
+			expectedStatus: http.StatusOK,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", item.url, nil)
+			if item.key != "" {
+				req.Header.Set("X-Api-Key", item.key)
+			}
+			response, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Ошибка запроса. Expected nil, got %v", err)
+			}
+			defer response.Body.Close()
+			if response.StatusCode != item.expectedStatus {
+				t.Errorf("Неверный статус. Expected %v, got %v", item.expectedStatus, response.StatusCode)
+			}
+		})
+	}
+}
+
+func TestAsyncDelivery(t *testing.T) {
+	workerInterval = 10 * time.Millisecond
+	defer func() { workerInterval = time.Second }()
+	table := []struct {
+		name             string
+		statuses         []int
+		queued           bool
+		expectedAttempts int
+		expectedBody     string
+		expectedDead     int
+	}{
+		{
+			name:             "Повтор после ошибки вышестоящего сервиса",
+			statuses:         []int{503, 200},
+			expectedAttempts: 2,
+			expectedBody:     `{"status": "DELIVRD"}`,
+		},
+		{
+			name:             "Ошибка без повтора сохраняется в очередь недоставленных",
+			statuses:         []int{400},
+			expectedAttempts: 1,
+			expectedDead:     1,
+		},
+		{
+			name:             "Сообщение из очереди до перезапуска",
+			statuses:         []int{200},
+			queued:           true,
+			expectedAttempts: 1,
+			expectedBody:     `queued`,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			attempts := 0
+			received := ""
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				mutex.Lock()
+				defer mutex.Unlock()
+				status := item.statuses[len(item.statuses)-1]
+				if attempts < len(item.statuses) {
+					status = item.statuses[attempts]
+				}
+				attempts++
+				received = string(body)
+				w.WriteHeader(status)
+			}))
+			defer upstream.Close()
+			dir, _ := ioutil.TempDir("", "queue")
+			defer os.RemoveAll(dir)
+			adapter := &Adapter{
+				Port: 8700,
+				Rules: []rulePkg.Rule{
+					rulePkg.Rule{
+						From:  rulePkg.From{Path: "/dlr"},
+						To:    rulePkg.To{URL: upstream.URL, HTTPMethod: "POST", Data: `{"status": "%QUERY[status]%"}`, Backoff: rulePkg.Backoff{Initial: rulePkg.Duration(time.Millisecond)}},
+						Async: true,
+						Ack:   rulePkg.Ack{Status: http.StatusAccepted, Data: `{"accepted": true}`},
+					},
+				},
+			}
+			adapter.SetQueueDir(dir)
+			if item.queued {
+				adapter.pendingQueue().Put(&queue.Message{Rule: 0, Path: "/dlr", Method: "POST", URL: upstream.URL, Body: []byte("queued")})
+			}
+			server := httptest.NewServer(adapter.getHandler())
+			defer server.Close()
+			adapter.startWorker()
+			defer adapter.stopWorker(context.Background())
+
+			if !item.queued {
+				response, err := server.Client().Get(server.URL + "/dlr?status=DELIVRD")
+				if err != nil {
+					t.Fatalf("Ошибка запроса. Expected nil, got %v", err)
+				}
+				body, _ := ioutil.ReadAll(response.Body)
+				response.Body.Close()
+				if response.StatusCode != http.StatusAccepted || string(body) != `{"accepted": true}` {
+					t.Errorf("Неверное подтверждение. Expected 202 {\"accepted\": true}, got %d %s", response.StatusCode, body)
+				}
+			}
+			deadline := time.Now().Add(2 * time.Second)
+			for time.Now().Before(deadline) {
+				ids, _ := adapter.pendingQueue().IDs()
+				mutex.Lock()
+				done := attempts >= item.expectedAttempts && len(ids) == 0
+				mutex.Unlock()
+				if done {
+					break
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if attempts != item.expectedAttempts {
+				t.Errorf("Неверное количество попыток. Expected %d, got %d", item.expectedAttempts, attempts)
+			}
+			if item.expectedBody != "" && received != item.expectedBody {
+				t.Errorf("Неверное тело. Expected %q, got %q", item.expectedBody, received)
+			}
+			if ids, _ := adapter.pendingQueue().IDs(); len(ids) != 0 {
+				t.Errorf("Очередь не пуста: %v", ids)
+			}
+			if dead, _ := adapter.deadQueue().List(); len(dead) != item.expectedDead {
+				t.Errorf("Неверное количество недоставленных. Expected %d, got %d", item.expectedDead, len(dead))
+			} else if item.expectedDead > 0 && (dead[0].Status != 400 || dead[0].Attempts != 1 || dead[0].Failed.IsZero()) {
+				t.Errorf("Неверное недоставленное сообщение: %+v", dead[0])
+			}
+		})
+	}
+}
+
+func TestWorkerHandover(t *testing.T) {
+	workerInterval = 10 * time.Millisecond
+	defer func() { workerInterval = time.Second }()
+	var mutex sync.Mutex
+	delivered := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		delivered++
+		mutex.Unlock()
+	}))
+	defer upstream.Close()
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+	adapter := &Adapter{Port: 8700, Rules: []rulePkg.Rule{rulePkg.Rule{From: rulePkg.From{Path: "/dlr"}, To: rulePkg.To{URL: upstream.URL}}}}
+	adapter.SetQueueDir(dir)
+	// Прежняя доставка той же очереди ещё не завершилась
+	previous := &worker{dir: adapter.pendingQueue().Dir(), done: make(chan struct{})}
+	workersMutex.Lock()
+	workers[previous.dir] = previous
+	workersMutex.Unlock()
+	adapter.pendingQueue().Put(&queue.Message{Rule: 0, Path: "/dlr", URL: upstream.URL})
+	adapter.startWorker()
+	defer adapter.stopWorker(context.Background())
+	count := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return delivered
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := count(); got != 0 {
+		t.Fatalf("Доставка началась до завершения прежней. Expected 0, got %d", got)
+	}
+	close(previous.done)
+	deadline := time.Now().Add(2 * time.Second)
+	for count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := count(); got != 1 {
+		t.Errorf("Неверное количество доставок. Expected 1, got %d", got)
+	}
+}
+
+func TestWorkerStopDuringRequests(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+	adapter := &Adapter{
+		Port:  8700,
+		Rules: []rulePkg.Rule{rulePkg.Rule{From: rulePkg.From{Path: "/dlr"}, To: rulePkg.To{URL: "http://127.0.0.1:1"}, Async: true}},
+	}
+	adapter.SetQueueDir(dir)
+	handler := adapter.getHandler()
+	adapter.startWorker()
+	// Обработчики, оставшиеся после принудительного закрытия сервера, работают одновременно с остановкой доставки
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/dlr", nil))
+			}
+		}()
+	}
+	adapter.stopWorker(context.Background())
+	wg.Wait()
+}
+
+func TestDeadLetters(t *testing.T) {
+	// Адрес закрытого сервера: соединение отклоняется
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedURL := closed.URL
+	closed.Close()
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+	adapter := &Adapter{
+		Port: 8700,
+		Rules: []rulePkg.Rule{
+			rulePkg.Rule{
+				From: rulePkg.From{Path: "/sms"},
+				To:   rulePkg.To{URL: closedURL + "/send", HTTPMethod: "POST", Headers: []string{"X-Id: %QUERY[id]%"}, Data: `{"id": "%QUERY[id]%"}`, Retries: 1, Backoff: rulePkg.Backoff{Initial: rulePkg.Duration(time.Millisecond)}},
+			},
+			rulePkg.Rule{
+				From: rulePkg.From{Path: "/template"},
+				To:   rulePkg.To{URL: closedURL, Data: `%QUERY[a]|unix_to_rfc3339%`},
+			},
+		},
+	}
+	adapter.SetQueueDir(dir)
+	server := httptest.NewServer(adapter.getHandler())
+	defer server.Close()
+
+	table := []struct {
+		name         string
+		path         string
+		expectedDead int
+	}{
+		{
+			name:         "Ошибка шаблона не сохраняется",
+			path:         "/template?a=x",
+			expectedDead: 0,
+		},
+		{
+			name:         "Сетевая ошибка после всех попыток сохраняется",
+			path:         "/sms?id=42",
+			expectedDead: 1,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			response, err := server.Client().Get(server.URL + item.path)
+			if err != nil {
+				t.Fatalf("Ошибка запроса. Expected nil, got %v", err)
+			}
+			response.Body.Close()
+			dead, err := adapter.deadQueue().List()
+			if err != nil || len(dead) != item.expectedDead {
+				t.Fatalf("Expected %d dead letters, got %v, %v", item.expectedDead, dead, err)
+			}
+			if item.expectedDead == 0 {
+				return
+			}
+			message := dead[0]
+			if message.URL != closedURL+"/send?id=42" || message.Method != "POST" || message.Attempts != 2 ||
+				string(message.Body) != `{"id": "42"}` || len(message.Headers) != 1 || message.Headers[0] != "X-Id: 42" || message.Error == "" {
+				t.Errorf("Неверное недоставленное сообщение: %+v", message)
+			}
+			if message.Rule != 0 || message.Path != "/sms" {
+				t.Errorf("Неверное правило сообщения: %d %s", message.Rule, message.Path)
+			}
+		})
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	table := []struct {
+		name           string
+		statuses       map[string]int
+		primary        string
+		fanOut         rulePkg.FanOut
+		response       rulePkg.Response
+		expected       int
+		expectedBody   string
+		expectedCalled []string
+	}{
+		{
+			name:           "Первый успешный ответ",
+			statuses:       map[string]int{"a": 500, "b": 200},
+			expected:       http.StatusOK,
+			expectedBody:   "b:42",
+			expectedCalled: []string{"a:42", "b:42"},
+		},
+		{
+			name:           "Ответ основного адресата",
+			statuses:       map[string]int{"a": 200, "b": 201},
+			primary:        "b",
+			fanOut:         rulePkg.FanOut{Response: rulePkg.FanOutPrimary},
+			expected:       http.StatusCreated,
+			expectedBody:   "b:42",
+			expectedCalled: []string{"a:42", "b:42"},
+		},
+		{
+			name:           "Сводный ответ",
+			statuses:       map[string]int{"a": 200, "b": 500},
+			fanOut:         rulePkg.FanOut{Response: rulePkg.FanOutAggregate, Mode: rulePkg.FanOutSequential},
+			expected:       http.StatusOK,
+			expectedBody:   `{"a":{"body":"a:42","status":200},"b":{"body":"b:42","status":500}}`,
+			expectedCalled: []string{"a:42", "b:42"},
+		},
+		{
+			name:           "Объединение ответов по шаблону",
+			statuses:       map[string]int{"a": 200, "b": 404},
+			fanOut:         rulePkg.FanOut{Response: rulePkg.FanOutAggregate},
+			response:       rulePkg.Response{Data: `{"a": "%UPSTREAM[a].BODY%", "b": %UPSTREAM[b].STATUS%}`},
+			expected:       http.StatusOK,
+			expectedBody:   `{"a": "a:42", "b": 404}`,
+			expectedCalled: []string{"a:42", "b:42"},
+		},
+		{
+			name:           "Ошибка адресата при all-or-nothing",
+			statuses:       map[string]int{"a": 200, "b": 500},
+			fanOut:         rulePkg.FanOut{Failure: rulePkg.FanOutAllOrNothing},
+			expected:       http.StatusBadGateway,
+			expectedBody:   `{"error": "destination \"b\" failed: upstream responded 500"}`,
+			expectedCalled: []string{"a:42", "b:42"},
+		},
+		{
+			name:           "Последовательная отправка останавливается на первой ошибке",
+			statuses:       map[string]int{"a": 503, "b": 200},
+			fanOut:         rulePkg.FanOut{Mode: rulePkg.FanOutSequential, Failure: rulePkg.FanOutAllOrNothing},
+			expected:       http.StatusBadGateway,
+			expectedBody:   `{"error": "destination \"a\" failed: upstream responded 503"}`,
+			expectedCalled: []string{"a:42"},
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			called := []string{}
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				mutex.Lock()
+				called = append(called, string(body))
+				mutex.Unlock()
+				w.WriteHeader(item.statuses[strings.TrimPrefix(req.URL.Path, "/")])
+				w.Write(body)
+			}))
+			defer upstream.Close()
+			destinations := []rulePkg.To{}
+			for _, name := range []string{"a", "b"} {
+				destinations = append(destinations, rulePkg.To{
+					Name:       name,
+					Primary:    name == item.primary,
+					URL:        upstream.URL + "/" + name,
+					HTTPMethod: "POST",
+					Data:       name + ":%QUERY[id]%",
+				})
+			}
+			adapter := &Adapter{
+				Rules: []rulePkg.Rule{
+					rulePkg.Rule{
+						From:         rulePkg.From{Path: "/fan-out"},
+						Destinations: destinations,
+						FanOut:       item.fanOut,
+						Response:     item.response,
+					},
+				},
+			}
+			server := httptest.NewServer(adapter.getHandler())
+			defer server.Close()
+			response, err := server.Client().Get(server.URL + "/fan-out?id=42")
+			if err != nil {
+				t.Fatalf("Ошибка запроса. Expected nil, got %v", err)
+			}
+			body, _ := ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			if response.StatusCode != item.expected {
+				t.Errorf("Неверный статус. Expected %v, got %v", item.expected, response.StatusCode)
+			}
+			if string(body) != item.expectedBody {
+				t.Errorf("Неверный ответ. Expected %s, got %s", item.expectedBody, body)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			sort.Strings(called)
+			if !reflect.DeepEqual(called, item.expectedCalled) {
+				t.Errorf("Неверные запросы к адресатам. Expected %v, got %v", item.expectedCalled, called)
+			}
+		})
+	}
+}
+
+func TestSendCancelled(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+	adapter := &Adapter{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// Задержка выбирается случайно до Max, поэтому граница тоже большая: прерваться должно ожидание повтора
+	to := rulePkg.To{URL: upstream.URL, Retries: 3, Backoff: rulePkg.Backoff{Initial: rulePkg.Duration(time.Hour), Max: rulePkg.Duration(time.Hour)}}
+	_, err := adapter.send(ctx, to, nil, nil)
+	upstreamErr, ok := err.(*UpstreamError)
+	if !ok {
+		t.Fatalf("Expected *UpstreamError, got %T %v", err, err)
+	}
+	if upstreamErr.URL != upstream.URL || upstreamErr.Attempts != 1 || upstreamErr.Err != context.DeadlineExceeded {
+		t.Errorf("Неверная ошибка: %+v", upstreamErr)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	// attempts меняется в обработчике вышестоящего сервиса, поэтому доступ к нему атомарный
+	var attempts int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&attempts, 1)
+		switch req.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/flaky":
+			if n < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	table := []struct {
+		name             string
+		to               rulePkg.To
+		expected         int
+		expectedAttempts int32
+	}{
+		{
+			name: "Повтор до успешного ответа",
+			to: rulePkg.To{
+				URL:     upstream.URL + "/flaky",
+				Retries: 3,
+				Backoff: rulePkg.Backoff{Initial: rulePkg.Duration(time.Millisecond)},
+			},
+			expected:         http.StatusOK,
+			expectedAttempts: 3,
+		},
+		{
+			name: "Исчерпание повторов",
+			to: rulePkg.To{
+				URL:     upstream.URL + "/flaky",
+				Retries: 1,
+				Backoff: rulePkg.Backoff{Initial: rulePkg.Duration(time.Millisecond)},
+			},
+			expected:         http.StatusServiceUnavailable,
+			expectedAttempts: 2,
+		},
+		{
+			name: "Таймаут запроса",
+			to: rulePkg.To{
+				URL:     upstream.URL + "/slow",
+				Timeout: rulePkg.Duration(20 * time.Millisecond),
+				RetryOn: []string{"5xx"},
+				Retries: 2,
+			},
+			expected:         http.StatusBadGateway,
+			expectedAttempts: 1,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			atomic.StoreInt32(&attempts, 0)
+			adapter := &Adapter{
+				Rules: []rulePkg.Rule{
+					rulePkg.Rule{
+						From: rulePkg.From{Path: "/retry"},
+						To:   item.to,
+					},
+				},
+			}
+			server := httptest.NewServer(adapter.getHandler())
+			defer server.Close()
+			response, err := server.Client().Get(server.URL + "/retry")
+			if err != nil {
+				t.Fatalf("Ошибка запроса. Expected nil, got %v", err)
+			}
+			response.Body.Close()
+			if response.StatusCode != item.expected {
+				t.Errorf("Неверный статус. Expected %v, got %v", item.expected, response.StatusCode)
+			}
+			if got := atomic.LoadInt32(&attempts); got != item.expectedAttempts {
+				t.Errorf("Неверное количество попыток. Expected %v, got %v", item.expectedAttempts, got)
+			}
+		})
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	defer upstream.Close()
+
+	// Подбираем свободный порт
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	adapter := &Adapter{
+		Name: "Lifecycle",
+		Port: port,
+		Rules: []rulePkg.Rule{
+			rulePkg.Rule{
+				From: rulePkg.From{Path: "/slow"},
+				To:   rulePkg.To{URL: upstream.URL},
+			},
+		},
+	}
+	if err := adapter.Start(context.Background()); err != nil {
+		t.Fatalf("Ошибка запуска. Expected nil, got %v", err)
+	}
+
+	// Второй адаптер на том же порту не запускается
+	conflict := &Adapter{Name: "Conflict", Port: port}
+	if err := conflict.Start(context.Background()); err == nil {
+		conflict.Shutdown(context.Background())
+		t.Errorf("Expected an error for busy port, got nil")
+	}
+
+	// Остановка дожидается завершения запроса
+	result := make(chan string)
+	go func() {
+		response, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/slow", port))
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		result <- string(body)
+	}()
+	time.Sleep(30 * time.Millisecond)
+	if err := adapter.Shutdown(context.Background()); err != nil {
+		t.Errorf("Ошибка остановки. Expected nil, got %v", err)
+	}
+	if body := <-result; body != "done" {
+		t.Errorf("Неверный ответ. Expected done, got %v", body)
+	}
+	if _, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/slow", port)); err == nil {
+		t.Errorf("Адаптер продолжает принимать запросы после остановки")
+	}
+}
@@ -0,0 +1,314 @@
+package adapter
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"platform-service-bus/internal/pkg/queue"
+	rulePkg "platform-service-bus/internal/pkg/rule"
+	"platform-service-bus/internal/pkg/secret"
+	"sync"
+	"time"
+)
+
+// Настройки фоновой доставки по умолчанию
+// Повторы идут дольше, чем при синхронной доставке: клиент ответа не ждёт
+const (
+	defaultAsyncRetries        = 10
+	defaultAsyncBackoffInitial = time.Second
+	defaultAsyncBackoffMax     = 10 * time.Minute
+)
+
+// workerInterval - как часто фоновая доставка проверяет очередь, подменяется в тестах
+var workerInterval = time.Second
+
+// worker - фоновая доставка сообщений из очереди адаптера
+type worker struct {
+	// dir - каталог очереди, которую обрабатывает доставка
+	dir string
+	// wake будит доставку после добавления сообщения
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// workers - последние запущенные доставки по каталогу очереди
+// Новая доставка ждёт завершения прежней, чтобы сообщение не отправлялось дважды,
+// если прежний адаптер не успел остановиться до перезапуска
+// workersMutex защищает и поле Adapter.worker: его читают обработчики запросов,
+// которые после принудительного закрытия сервера могут работать одновременно со stopWorker
+var (
+	workersMutex sync.Mutex
+	workers      = make(map[string]*worker)
+)
+
+// SetQueueDir задаёт корневой каталог очередей
+// Очереди адаптера находятся в подкаталоге с номером порта
+// Без каталога асинхронная доставка недоступна, а недоставленные запросы не сохраняются
+func (adapter *Adapter) SetQueueDir(dir string) {
+	adapter.queueDir = dir
+}
+
+// pendingQueue возвращает очередь сообщений, ожидающих доставки
+func (adapter *Adapter) pendingQueue() *queue.Queue {
+	return queue.Pending(adapter.queueDir, adapter.Port)
+}
+
+// deadQueue возвращает очередь недоставленных сообщений
+func (adapter *Adapter) deadQueue() *queue.Queue {
+	return queue.Dead(adapter.queueDir, adapter.Port)
+}
+
+// deadLetter переносит сообщение в очередь недоставленных, откуда его можно отправить повторно
+func (adapter *Adapter) deadLetter(message *queue.Message) {
+	if adapter.queueDir == "" {
+		return
+	}
+	message.Failed = time.Now()
+	if err := adapter.deadQueue().Put(message); err != nil {
+		log.Errorf("Не удалось сохранить недоставленное сообщение %s: %v", message.ID, err)
+		return
+	}
+	log.Warnf("Сообщение %s на %s сохранено в очередь недоставленных %s", message.ID, message.URL, adapter.deadQueue().Dir())
+}
+
+// acceptAsync формирует исходящие запросы, сохраняет их в очередь и отвечает клиенту
+// Каждому адресату из списка to ставится отдельное сообщение
+// Если сохранить запросы не удалось, клиент получает 503 и может повторить запрос
+func (adapter *Adapter) acceptAsync(w http.ResponseWriter, index int, rule rulePkg.Rule, request *rulePkg.Request) {
+	messages := []*queue.Message{}
+	for k, to := range rule.Targets() {
+		headers, body, err := rulePkg.HandleTo(rule, to, request)
+		if err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			log.Errorf("Ошибка формирования запроса: %v", err)
+			return
+		}
+		target, err := adapter.upstreamURL(rule, to, request)
+		if err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			log.Errorf("Ошибка формирования адреса: %v", err)
+			return
+		}
+		messages = append(messages, &queue.Message{
+			Rule:        index,
+			Path:        rule.From.Path,
+			Destination: k,
+			Method:      to.HTTPMethod,
+			URL:         target,
+			Headers:     headers,
+			Body:        body,
+			Next:        time.Now(),
+		})
+	}
+	ackHeaders, ackBody, err := rulePkg.HandleAck(rule, request)
+	if err != nil {
+		writeError(w, errorStatus(err), err.Error())
+		log.Errorf("Ошибка формирования ответа: %v", err)
+		return
+	}
+	if adapter.queueDir == "" {
+		writeError(w, http.StatusServiceUnavailable, "queue unavailable")
+		log.Errorf("Каталог очередей адаптера '%s' не задан", adapter.Name)
+		return
+	}
+	pending := adapter.pendingQueue()
+	for k, message := range messages {
+		if err := pending.Put(message); err != nil {
+			// Клиент повторит запрос целиком, поэтому уже сохранённые сообщения удаляются
+			for _, saved := range messages[:k] {
+				pending.Delete(saved.ID)
+			}
+			writeError(w, http.StatusServiceUnavailable, "queue unavailable")
+			log.Errorf("Не удалось сохранить запрос в очередь: %v", err)
+			return
+		}
+		log.Infof("Запрос %s принят в очередь доставки на %s", message.ID, message.URL)
+	}
+	if current := adapter.currentWorker(); current != nil {
+		select {
+		case current.wake <- struct{}{}:
+		default:
+		}
+	}
+	responseHeaders := w.Header()
+	for name, values := range parseHeaders(ackHeaders) {
+		responseHeaders[name] = values
+	}
+	w.WriteHeader(rule.Ack.StatusCode())
+	w.Write(ackBody)
+}
+
+// startWorker запускает фоновую доставку
+// Доставка работает всегда: в очереди могут остаться сообщения от прежней конфигурации
+func (adapter *Adapter) startWorker() {
+	if adapter.queueDir == "" {
+		return
+	}
+	current := &worker{
+		dir:  adapter.pendingQueue().Dir(),
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	workersMutex.Lock()
+	previous := workers[current.dir]
+	workers[current.dir] = current
+	adapter.worker = current
+	workersMutex.Unlock()
+	go adapter.runWorker(current, previous)
+}
+
+// currentWorker возвращает запущенную фоновую доставку адаптера или nil
+func (adapter *Adapter) currentWorker() *worker {
+	workersMutex.Lock()
+	defer workersMutex.Unlock()
+	return adapter.worker
+}
+
+// stopWorker останавливает фоновую доставку, прерывая текущую попытку
+// Прерванная попытка не засчитывается, сообщение остаётся в очереди
+// Если ctx истёк раньше, доставка завершится позже, а следующая доставка той же очереди её дождётся
+func (adapter *Adapter) stopWorker(ctx context.Context) error {
+	workersMutex.Lock()
+	current := adapter.worker
+	adapter.worker = nil
+	workersMutex.Unlock()
+	if current == nil {
+		return nil
+	}
+	close(current.stop)
+	select {
+	case <-current.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runWorker доставляет сообщения до остановки
+// previous - прежняя доставка той же очереди, её завершения нужно дождаться
+func (adapter *Adapter) runWorker(current *worker, previous *worker) {
+	defer close(current.done)
+	defer func() {
+		workersMutex.Lock()
+		if workers[current.dir] == current {
+			delete(workers, current.dir)
+		}
+		workersMutex.Unlock()
+	}()
+	if previous != nil {
+		select {
+		case <-previous.done:
+		case <-current.stop:
+			return
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-current.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	ticker := time.NewTicker(workerInterval)
+	defer ticker.Stop()
+	for {
+		adapter.deliverPending(ctx)
+		select {
+		case <-current.stop:
+			return
+		case <-ticker.C:
+		case <-current.wake:
+		}
+	}
+}
+
+// deliverPending доставляет сообщения, время попытки которых наступило
+func (adapter *Adapter) deliverPending(ctx context.Context) {
+	pending := adapter.pendingQueue()
+	messages, err := pending.List()
+	if err != nil {
+		log.Errorf("Не удалось прочитать очередь %s: %v", pending.Dir(), err)
+		return
+	}
+	for _, message := range messages {
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Now().Before(message.Next) {
+			continue
+		}
+		adapter.deliver(ctx, pending, message)
+	}
+}
+
+// messageTo возвращает настройки исходящего запроса для сообщения
+// Если правило удалено или перемещено, используются настройки по умолчанию
+func (adapter *Adapter) messageTo(message *queue.Message) rulePkg.To {
+	to := rulePkg.To{}
+	targets := []rulePkg.To{}
+	if message.Rule >= 0 && message.Rule < len(adapter.Rules) && adapter.Rules[message.Rule].From.Path == message.Path {
+		targets = adapter.Rules[message.Rule].Targets()
+	}
+	if message.Destination >= 0 && message.Destination < len(targets) {
+		to = targets[message.Destination]
+	} else {
+		log.Warnf("Правило сообщения %s не найдено, доставляем с настройками по умолчанию", message.ID)
+	}
+	to.URL, to.HTTPMethod = message.URL, message.Method
+	if to.Retries <= 0 {
+		to.Retries = defaultAsyncRetries
+	}
+	if to.Backoff.Initial <= 0 {
+		to.Backoff.Initial = rulePkg.Duration(defaultAsyncBackoffInitial)
+	}
+	if to.Backoff.Max <= 0 {
+		to.Backoff.Max = rulePkg.Duration(defaultAsyncBackoffMax)
+	}
+	return to
+}
+
+// deliver выполняет одну попытку доставки сообщения
+// Успешно доставленное сообщение удаляется, иначе попытка откладывается согласно повторам правила
+func (adapter *Adapter) deliver(ctx context.Context, pending *queue.Queue, message *queue.Message) {
+	to := adapter.messageTo(message)
+	response, err := adapter.doRequest(ctx, to, message.Headers, message.Body)
+	if ctx.Err() != nil {
+		return
+	}
+	message.Attempts++
+	message.Status, message.Error = 0, ""
+	if response != nil {
+		message.Status = response.StatusCode
+	}
+	if err != nil {
+		message.Error = secret.Redact(err.Error())
+	} else if message.Status >= 400 {
+		message.Error = fmt.Sprintf("upstream responded %d", message.Status)
+	}
+	if message.Error == "" {
+		log.Infof("Сообщение %s доставлено на %s, статус %d, попытка %d", message.ID, message.URL, message.Status, message.Attempts)
+		if err := pending.Delete(message.ID); err != nil {
+			log.Errorf("Не удалось удалить доставленное сообщение %s: %v", message.ID, err)
+		}
+		return
+	}
+	if message.Attempts <= to.Retries && to.ShouldRetry(message.Status, err) {
+		delay := to.Backoff.Delay(message.Attempts - 1)
+		message.Next = time.Now().Add(delay)
+		log.Warnf("Сообщение %s не доставлено (%s), повтор через %v (попытка %d из %d)", message.ID, message.Error, delay, message.Attempts+1, to.Retries+1)
+		if err := pending.Put(message); err != nil {
+			log.Errorf("Не удалось сохранить сообщение %s: %v", message.ID, err)
+		}
+		return
+	}
+	log.Errorf("Сообщение %s не доставлено на %s после %d попыток: %s", message.ID, message.URL, message.Attempts, message.Error)
+	adapter.deadLetter(message)
+	if err := pending.Delete(message.ID); err != nil {
+		log.Errorf("Не удалось удалить сообщение %s: %v", message.ID, err)
+	}
+}
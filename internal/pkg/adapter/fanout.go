@@ -0,0 +1,194 @@
+package adapter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"platform-service-bus/internal/pkg/queue"
+	rulePkg "platform-service-bus/internal/pkg/rule"
+	"platform-service-bus/internal/pkg/secret"
+	"sync"
+)
+
+// destination - подготовленный запрос к одному из адресатов списка to и его результат
+type destination struct {
+	name    string
+	to      rulePkg.To
+	headers []string
+	body    []byte
+	// response и err - результат запроса, если запрос не выполнялся, оба пусты
+	response *rulePkg.Upstream
+	err      error
+}
+
+// done сообщает, выполнялся ли запрос к адресату
+func (item *destination) done() bool {
+	return item.response != nil || item.err != nil
+}
+
+// failed сообщает, завершился ли запрос ошибкой или ответом с кодом 400 и выше
+func (item *destination) failed() bool {
+	return item.err != nil || item.response == nil || item.response.StatusCode >= 400
+}
+
+// failure возвращает описание неудачи запроса к адресату
+func (item *destination) failure() string {
+	switch {
+	case item.err != nil:
+		return item.err.Error()
+	case item.response == nil:
+		return "request was not sent"
+	}
+	return fmt.Sprintf("upstream responded %d", item.response.StatusCode)
+}
+
+// fanOut отправляет запрос каждому адресату из списка to и отвечает клиенту согласно политике fan-out
+// Запросы формируются заранее и последовательно: входящий запрос кэширует разобранное тело без блокировок
+func (adapter *Adapter) fanOut(w http.ResponseWriter, index int, rule rulePkg.Rule, request *rulePkg.Request) {
+	destinations := make([]*destination, len(rule.Destinations))
+	for k, to := range rule.Destinations {
+		headers, body, err := rulePkg.HandleTo(rule, to, request)
+		if err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			log.Errorf("Ошибка формирования запроса к адресату %s: %v", to.DestinationName(k), err)
+			return
+		}
+		target, err := adapter.upstreamURL(rule, to, request)
+		if err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			log.Errorf("Ошибка формирования адреса адресата %s: %v", to.DestinationName(k), err)
+			return
+		}
+		to.URL = target
+		destinations[k] = &destination{name: to.DestinationName(k), to: to, headers: headers, body: body}
+	}
+	allOrNothing := rule.FanOut.Failure == rulePkg.FanOutAllOrNothing
+	// completed - номера адресатов в порядке получения ответов
+	completed := adapter.sendAll(request.HTTP().Context(), destinations, rule.FanOut.Mode == rulePkg.FanOutSequential, allOrNothing)
+	for k, item := range destinations {
+		if !item.done() {
+			continue
+		}
+		if item.failed() {
+			log.Warnf("Адресат %s: %s", item.name, secret.Redact(item.failure()))
+		}
+		// Запрос сохраняется, чтобы его можно было отправить повторно командой dlq replay
+		if upstreamErr, ok := item.err.(*UpstreamError); ok {
+			adapter.deadLetter(&queue.Message{
+				Rule:        index,
+				Path:        rule.From.Path,
+				Destination: k,
+				Method:      item.to.HTTPMethod,
+				URL:         upstreamErr.URL,
+				Headers:     item.headers,
+				Body:        item.body,
+				Attempts:    upstreamErr.Attempts,
+				Error:       secret.Redact(item.err.Error()),
+			})
+		}
+	}
+	if allOrNothing {
+		for _, item := range destinations {
+			if item.failed() {
+				status := http.StatusBadGateway
+				if item.err != nil {
+					status = errorStatus(item.err)
+				}
+				writeError(w, status, fmt.Sprintf("destination %q failed: %s", item.name, item.failure()))
+				return
+			}
+		}
+	}
+	// Шаблон ответа может ссылаться на ответ любого адресата по имени
+	upstreams := make(map[string]*rulePkg.Upstream)
+	for _, item := range destinations {
+		upstreams[item.name] = item.response
+	}
+	switch rule.FanOut.Response {
+	case rulePkg.FanOutAggregate:
+		writeUpstream(w, rule, rulePkg.To{}, aggregate(destinations), request, upstreams)
+		return
+	case rulePkg.FanOutPrimary:
+		writeDestination(w, rule, destinations[rule.PrimaryIndex()], request, upstreams)
+		return
+	}
+	// По умолчанию клиент получает первый успешный ответ, а если успешных нет - ответ основного адресата
+	for _, k := range completed {
+		if !destinations[k].failed() {
+			writeDestination(w, rule, destinations[k], request, upstreams)
+			return
+		}
+	}
+	writeDestination(w, rule, destinations[rule.PrimaryIndex()], request, upstreams)
+}
+
+// sendAll выполняет запросы к адресатам параллельно или по порядку
+// При политике all-or-nothing последовательная отправка останавливается на первой неудаче,
+// а параллельная отправляет всем адресатам: отката выполненных запросов нет
+// Возвращает номера адресатов в порядке получения ответов
+func (adapter *Adapter) sendAll(ctx context.Context, destinations []*destination, sequential bool, allOrNothing bool) []int {
+	completed := []int{}
+	if sequential {
+		for k, item := range destinations {
+			item.response, item.err = adapter.send(ctx, item.to, item.headers, item.body)
+			completed = append(completed, k)
+			if allOrNothing && item.failed() {
+				break
+			}
+		}
+		return completed
+	}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for k, item := range destinations {
+		wg.Add(1)
+		go func(k int, item *destination) {
+			defer wg.Done()
+			item.response, item.err = adapter.send(ctx, item.to, item.headers, item.body)
+			mutex.Lock()
+			completed = append(completed, k)
+			mutex.Unlock()
+		}(k, item)
+	}
+	wg.Wait()
+	return completed
+}
+
+// writeDestination отдаёт клиенту ответ адресата или ошибку его запроса
+func writeDestination(w http.ResponseWriter, rule rulePkg.Rule, item *destination, request *rulePkg.Request, upstreams map[string]*rulePkg.Upstream) {
+	if item.response == nil {
+		writeError(w, errorStatus(item.err), fmt.Sprintf("destination %q failed: %s", item.name, item.failure()))
+		return
+	}
+	writeUpstream(w, rule, item.to, item.response, request, upstreams)
+}
+
+// aggregate объединяет ответы адресатов в JSON-объект по их именам
+// {"name": {"status": 200, "body": ...}, "other": {"error": "..."}}
+// Тело в формате JSON вкладывается как есть, остальные тела - строкой
+func aggregate(destinations []*destination) *rulePkg.Upstream {
+	result := make(map[string]interface{})
+	for _, item := range destinations {
+		entry := make(map[string]interface{})
+		if item.response != nil {
+			entry["status"] = item.response.StatusCode
+			if json.Valid(item.response.Body) {
+				entry["body"] = json.RawMessage(item.response.Body)
+			} else {
+				entry["body"] = string(item.response.Body)
+			}
+		}
+		if item.failed() && item.response == nil {
+			entry["error"] = secret.Redact(item.failure())
+		}
+		result[item.name] = entry
+	}
+	body, _ := json.Marshal(result)
+	return &rulePkg.Upstream{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       body,
+	}
+}
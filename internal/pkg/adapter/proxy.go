@@ -0,0 +1,269 @@
+package adapter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	rulePkg "platform-service-bus/internal/pkg/rule"
+	"platform-service-bus/internal/pkg/tlsconfig"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseHeaders превращает список строк вида "Name: value" в набор хедеров
+func parseHeaders(headers []string) http.Header {
+	result := http.Header{}
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			log.Errorf("Некорректный хедер: %s", header)
+			continue
+		}
+		result.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return result
+}
+
+// defaultTimeout ограничивает время попытки запроса, если таймаут не задан ни в правиле, ни в адаптере
+const defaultTimeout = 30 * time.Second
+
+// newClient создаёт HTTP-клиент с пулом соединений
+// tlsConfig - настройки TLS исходящих соединений, nil - настройки по умолчанию
+func newClient(tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   10 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   20,
+			IdleConnTimeout:       90 * time.Second,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+}
+
+// clientPool хранит HTTP-клиенты по настройкам TLS, чтобы правила с одинаковыми настройками делили пул соединений
+type clientPool struct {
+	mutex   sync.Mutex
+	clients map[tlsconfig.Client]*http.Client
+}
+
+// get возвращает клиент для настроек TLS, создавая его при первом обращении
+func (pool *clientPool) get(settings tlsconfig.Client) (*http.Client, error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if client, prs := pool.clients[settings]; prs {
+		return client, nil
+	}
+	tlsConfig, err := settings.Config()
+	if err != nil {
+		return nil, err
+	}
+	client := newClient(tlsConfig)
+	pool.clients[settings] = client
+	return client, nil
+}
+
+// closeIdleConnections закрывает простаивающие соединения всех клиентов
+func (pool *clientPool) closeIdleConnections() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, client := range pool.clients {
+		client.CloseIdleConnections()
+	}
+}
+
+// clientFor возвращает HTTP-клиент для исходящего запроса по описанию To
+func (adapter *Adapter) clientFor(to rulePkg.To) (*http.Client, error) {
+	if to.TLS.IsSet() && adapter.clients != nil {
+		return adapter.clients.get(to.TLS)
+	}
+	if to.TLS.IsSet() {
+		tlsConfig, err := to.TLS.Config()
+		if err != nil {
+			return nil, err
+		}
+		return newClient(tlsConfig), nil
+	}
+	if adapter.client == nil {
+		return newClient(nil), nil
+	}
+	return adapter.client, nil
+}
+
+// timeout возвращает время ожидания одной попытки запроса по правилу
+func (adapter *Adapter) timeout(to rulePkg.To) time.Duration {
+	if to.Timeout > 0 {
+		return time.Duration(to.Timeout)
+	}
+	if adapter.Timeout > 0 {
+		return time.Duration(adapter.Timeout)
+	}
+	return defaultTimeout
+}
+
+// callUpstream выполняет исходящий запрос на To.URL с подготовленными хедерами и телом
+// Подстановки в To.URL заменяются значениями из входящего запроса
+// При неудаче запрос повторяется согласно To.Retries и To.RetryOn
+func (adapter *Adapter) callUpstream(rule rulePkg.Rule, to rulePkg.To, headers []string, body []byte, request *rulePkg.Request) (*rulePkg.Upstream, error) {
+	target, err := adapter.upstreamURL(rule, to, request)
+	if err != nil {
+		return nil, err
+	}
+	to.URL = target
+	return adapter.send(request.HTTP().Context(), to, headers, body)
+}
+
+// send выполняет исходящий запрос на уже сформированный To.URL с повторами согласно To.Retries и To.RetryOn
+func (adapter *Adapter) send(ctx context.Context, to rulePkg.To, headers []string, body []byte) (*rulePkg.Upstream, error) {
+	for attempt := 0; ; attempt++ {
+		response, err := adapter.doRequest(ctx, to, headers, body)
+		status := 0
+		if response != nil {
+			status = response.StatusCode
+		}
+		if attempt >= to.Retries || !to.ShouldRetry(status, err) {
+			if err != nil {
+				err = &UpstreamError{URL: to.URL, Attempts: attempt + 1, Err: err}
+			}
+			return response, err
+		}
+		delay := to.Backoff.Delay(attempt)
+		log.Infof("Повтор запроса на %s через %v (попытка %d из %d)", to.URL, delay, attempt+2, to.Retries+1)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			// Прерванный запрос тоже сохраняется в очередь недоставленных
+			return response, &UpstreamError{URL: to.URL, Attempts: attempt + 1, Err: ctx.Err()}
+		}
+	}
+}
+
+// UpstreamError - ошибка исходящего запроса после всех попыток
+type UpstreamError struct {
+	// URL - адрес запроса с подставленными значениями и GET-параметрами
+	URL      string
+	Attempts int
+	Err      error
+}
+
+// Error возвращает описание исходной ошибки
+func (err *UpstreamError) Error() string {
+	return err.Err.Error()
+}
+
+// upstreamURL формирует адрес исходящего запроса с GET-параметрами согласно To.Query
+func (adapter *Adapter) upstreamURL(rule rulePkg.Rule, to rulePkg.To, request *rulePkg.Request) (string, error) {
+	target, err := rulePkg.HandleURL(rule, to, request)
+	if err != nil {
+		return "", err
+	}
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	query, err := rulePkg.HandleQuery(rule, to, request)
+	if err != nil {
+		return "", err
+	}
+	targetQuery := parsed.Query()
+	for name, values := range query {
+		for _, value := range values {
+			targetQuery.Add(name, value)
+		}
+	}
+	parsed.RawQuery = targetQuery.Encode()
+	return parsed.String(), nil
+}
+
+// doRequest выполняет одну попытку исходящего запроса
+func (adapter *Adapter) doRequest(parent context.Context, to rulePkg.To, headers []string, body []byte) (*rulePkg.Upstream, error) {
+	ctx, cancel := context.WithTimeout(parent, adapter.timeout(to))
+	defer cancel()
+	request, err := http.NewRequest(to.HTTPMethod, to.URL, bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("Error http.NewRequest: %v", err)
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	// Устанавливаем хедеры
+	for name, values := range parseHeaders(headers) {
+		request.Header[name] = values
+	}
+	client, err := adapter.clientFor(to)
+	if err != nil {
+		log.Errorf("Ошибка настроек TLS: %v", err)
+		return nil, err
+	}
+	// Аутентификация добавляется при каждой попытке: подписи зависят от времени, токены обновляются
+	if err := to.Auth.Apply(request, body, client); err != nil {
+		log.Errorf("Ошибка аутентификации исходящего запроса: %v", err)
+		return nil, err
+	}
+	// Выполняем запрос
+	// Хедеры не логируются: после аутентификации в них есть данные доступа
+	log.Infof("Проксирование на другой URL: %s %s", request.Method, request.URL)
+	response, err := client.Do(request)
+	if err != nil {
+		log.Errorf("Error client.Do: %v", err)
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusUnauthorized {
+		// Токен мог быть отозван раньше срока, следующая попытка получит новый
+		to.Auth.Invalidate()
+	}
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		log.Errorf("Error ioutil.ReadAll: %v", err)
+		return nil, err
+	}
+	return &rulePkg.Upstream{
+		StatusCode: response.StatusCode,
+		Header:     response.Header,
+		Body:       responseBody,
+	}, nil
+}
+
+// runStep выполняет промежуточный шаг конвейера
+// Результат шага становится входящим запросом для следующего шага
+func (adapter *Adapter) runStep(rule rulePkg.Rule, step rulePkg.To, request *rulePkg.Request) (*rulePkg.Request, error) {
+	headers, body, err := rulePkg.HandleTo(rule, step, request)
+	if err != nil {
+		return nil, err
+	}
+	header := parseHeaders(headers)
+	if step.URL != "" {
+		response, err := adapter.callUpstream(rule, step, headers, body, request)
+		if err != nil {
+			return nil, err
+		}
+		header, body = response.Header, response.Body
+	}
+	log.Infof("Результат шага. Headers: %v, Body: %s", header, body)
+	return rulePkg.NewRequest(stepRequest(request.HTTP(), header, body)), nil
+}
+
+// stepRequest создаёт копию входящего запроса с новыми хедерами и телом
+// Путь, метод и GET-параметры исходного запроса сохраняются
+func stepRequest(req *http.Request, header http.Header, body []byte) *http.Request {
+	next := req.WithContext(req.Context())
+	next.Header = header
+	next.Body = ioutil.NopCloser(bytes.NewReader(body))
+	next.ContentLength = int64(len(body))
+	next.Form = nil
+	next.PostForm = nil
+	next.MultipartForm = nil
+	return next
+}
@@ -0,0 +1,497 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Типы аутентификации входящих запросов, кроме basic и hmac
+const (
+	APIKey = "apikey"
+	JWT    = "jwt"
+)
+
+// Inbound описывает проверку входящих запросов
+// Используются только поля, относящиеся к указанному типу
+type Inbound struct {
+	// Allow - IP-адреса и подсети, из которых принимаются запросы, пустой список - из любых
+	Allow []string
+	// Type - apikey, basic, hmac или jwt, пустая строка - без аутентификации
+	Type string
+
+	// Keys - допустимые API-ключи для apikey
+	Keys []string
+	// Header - хедер ключа для apikey (по умолчанию X-Api-Key) или подписи для hmac (по умолчанию X-Signature)
+	Header string
+	// Query - GET-параметр с ключом для apikey, проверяется, если ключа нет в хедере
+	Query string
+
+	// Users - пользователи и пароли для basic
+	Users map[string]string
+
+	// Key, Algorithm и Encoding - ключ, алгоритм и кодировка подписи тела для hmac
+	Key       string
+	Algorithm string
+	Encoding  string
+	// Prefix - префикс значения подписи, например "sha256="
+	Prefix string
+
+	// JWKSFile - файл с открытыми ключами JWKS для jwt
+	JWKSFile string `json:"jwks-file"`
+	// Issuer и Audience - ожидаемые значения iss и aud, пустая строка - не проверять
+	Issuer   string
+	Audience string
+}
+
+// Error - отказ в доступе с кодом ответа 401 или 403
+type Error struct {
+	Status  int
+	Message string
+	// Challenge - значение хедера WWW-Authenticate
+	Challenge string
+}
+
+// Error возвращает описание отказа
+func (err *Error) Error() string {
+	return err.Message
+}
+
+// Secrets возвращает секретные значения настроек, которые нужно скрывать в логах
+func (inbound Inbound) Secrets() []string {
+	values := append([]string{inbound.Key}, inbound.Keys...)
+	for user, password := range inbound.Users {
+		values = append(values, password, base64.StdEncoding.EncodeToString([]byte(user+":"+password)))
+	}
+	return values
+}
+
+// IsSet сообщает, задана ли проверка входящих запросов
+func (inbound Inbound) IsSet() bool {
+	return inbound.Type != "" || len(inbound.Allow) > 0
+}
+
+// Check проверяет, что для выбранного типа указаны все необходимые поля
+func (inbound Inbound) Check() []error {
+	errs := []error{}
+	for _, allowed := range inbound.Allow {
+		if _, err := parseNetwork(allowed); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch inbound.Type {
+	case "":
+	case APIKey:
+		if len(inbound.Keys) == 0 {
+			errs = append(errs, fmt.Errorf("не указано поле keys"))
+		}
+	case Basic:
+		if len(inbound.Users) == 0 {
+			errs = append(errs, fmt.Errorf("не указано поле users"))
+		}
+	case HMAC:
+		if inbound.Key == "" {
+			errs = append(errs, fmt.Errorf("не указано поле key"))
+		}
+		if _, err := hashFunction(inbound.Algorithm); err != nil {
+			errs = append(errs, err)
+		}
+		if inbound.Encoding != "" && inbound.Encoding != "hex" && inbound.Encoding != "base64" {
+			errs = append(errs, fmt.Errorf("неизвестная кодировка подписи %q, ожидается hex или base64", inbound.Encoding))
+		}
+	case JWT:
+		if inbound.JWKSFile == "" {
+			errs = append(errs, fmt.Errorf("не указано поле jwks-file"))
+		} else if _, err := loadJWKS(inbound.JWKSFile); err != nil {
+			if os.IsNotExist(err) {
+				err = fmt.Errorf("файл %s не найден", inbound.JWKSFile)
+			}
+			errs = append(errs, err)
+		}
+	default:
+		errs = append(errs, fmt.Errorf("неизвестный тип аутентификации %q", inbound.Type))
+	}
+	return errs
+}
+
+// Verify проверяет входящий запрос
+// body - уже прочитанное тело запроса, используется для проверки подписи
+func (inbound Inbound) Verify(req *http.Request, body []byte) error {
+	if len(inbound.Allow) > 0 && !inbound.allowed(req.RemoteAddr) {
+		return &Error{Status: http.StatusForbidden, Message: "address not allowed"}
+	}
+	switch inbound.Type {
+	case "":
+		return nil
+	case APIKey:
+		return inbound.verifyAPIKey(req)
+	case Basic:
+		return inbound.verifyBasic(req)
+	case HMAC:
+		return inbound.verifyHMAC(req, body)
+	case JWT:
+		return inbound.verifyJWT(req)
+	}
+	return &Error{Status: http.StatusUnauthorized, Message: fmt.Sprintf("unknown authentication type %q", inbound.Type)}
+}
+
+// unauthorized возвращает отказ с кодом 401
+func unauthorized(message string, challenge string) error {
+	return &Error{Status: http.StatusUnauthorized, Message: message, Challenge: challenge}
+}
+
+// parseNetwork разбирает IP-адрес или подсеть в формате CIDR
+func parseNetwork(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("некорректный IP-адрес %q", value)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("некорректная подсеть %q", value)
+	}
+	return network, nil
+}
+
+// allowed проверяет адрес клиента по списку Allow
+func (inbound Inbound) allowed(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, allowed := range inbound.Allow {
+		if network, err := parseNetwork(allowed); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// equal сравнивает строки за постоянное время
+func equal(left string, right string) bool {
+	return subtle.ConstantTimeCompare([]byte(left), []byte(right)) == 1
+}
+
+// verifyAPIKey ищет ключ в хедере или GET-параметре
+func (inbound Inbound) verifyAPIKey(req *http.Request) error {
+	header := inbound.Header
+	if header == "" {
+		header = "X-Api-Key"
+	}
+	key := req.Header.Get(header)
+	if key == "" && inbound.Query != "" {
+		key = req.URL.Query().Get(inbound.Query)
+	}
+	if key == "" {
+		return unauthorized("api key required", "")
+	}
+	for _, allowed := range inbound.Keys {
+		if equal(key, allowed) {
+			return nil
+		}
+	}
+	return unauthorized("invalid api key", "")
+}
+
+// verifyBasic проверяет имя пользователя и пароль
+func (inbound Inbound) verifyBasic(req *http.Request) error {
+	challenge := `Basic realm="platform-service-bus"`
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return unauthorized("credentials required", challenge)
+	}
+	expected, prs := inbound.Users[username]
+	if !equal(password, expected) || !prs {
+		return unauthorized("invalid credentials", challenge)
+	}
+	return nil
+}
+
+// verifyHMAC проверяет подпись тела запроса
+func (inbound Inbound) verifyHMAC(req *http.Request, body []byte) error {
+	newHash, err := hashFunction(inbound.Algorithm)
+	if err != nil {
+		return unauthorized(err.Error(), "")
+	}
+	header := inbound.Header
+	if header == "" {
+		header = "X-Signature"
+	}
+	value := strings.TrimSpace(req.Header.Get(header))
+	if value == "" {
+		return unauthorized("signature required", "")
+	}
+	value = strings.TrimPrefix(value, inbound.Prefix)
+	var signature []byte
+	if inbound.Encoding == "base64" {
+		signature, err = base64.StdEncoding.DecodeString(value)
+	} else {
+		signature, err = hex.DecodeString(value)
+	}
+	mac := hmac.New(newHash, []byte(inbound.Key))
+	mac.Write(body)
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return unauthorized("invalid signature", "")
+	}
+	return nil
+}
+
+// jwtLeeway - допустимое расхождение часов при проверке exp и nbf
+const jwtLeeway = time.Minute
+
+// verifyJWT проверяет токен из хедера Authorization: Bearer
+func (inbound Inbound) verifyJWT(req *http.Request) error {
+	challenge := "Bearer"
+	authorization := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return unauthorized("bearer token required", challenge)
+	}
+	keys, err := loadJWKS(inbound.JWKSFile)
+	if err != nil {
+		return unauthorized("keys unavailable", challenge)
+	}
+	claims, err := verifyToken(strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer ")), keys)
+	if err != nil {
+		return unauthorized(fmt.Sprintf("invalid token: %v", err), `Bearer error="invalid_token"`)
+	}
+	current := now()
+	if exp, ok := claims["exp"].(float64); ok && current.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return unauthorized("invalid token: token expired", `Bearer error="invalid_token"`)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && current.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return unauthorized("invalid token: token not yet valid", `Bearer error="invalid_token"`)
+	}
+	if inbound.Issuer != "" && claims["iss"] != inbound.Issuer {
+		return unauthorized("invalid token: unexpected issuer", `Bearer error="invalid_token"`)
+	}
+	if inbound.Audience != "" && !hasAudience(claims["aud"], inbound.Audience) {
+		return unauthorized("invalid token: unexpected audience", `Bearer error="invalid_token"`)
+	}
+	return nil
+}
+
+// hasAudience проверяет aud, который может быть строкой или списком строк
+func hasAudience(aud interface{}, expected string) bool {
+	switch value := aud.(type) {
+	case string:
+		return value == expected
+	case []interface{}:
+		for _, item := range value {
+			if item == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jwk - открытый ключ из файла JWKS
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+	// key - разобранный ключ: *rsa.PublicKey, *ecdsa.PublicKey или []byte
+	key interface{}
+}
+
+// jwksFile - разобранный файл JWKS и время его изменения
+type jwksFile struct {
+	modTime time.Time
+	keys    []jwk
+}
+
+// jwksCache файлы JWKS по пути, перечитываются при изменении
+var jwksCache = map[string]jwksFile{}
+
+// jwksCacheMutex защищает jwksCache от одновременного доступа
+var jwksCacheMutex sync.Mutex
+
+// loadJWKS читает файл JWKS, если он изменился с прошлого чтения
+func loadJWKS(path string) ([]jwk, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	jwksCacheMutex.Lock()
+	defer jwksCacheMutex.Unlock()
+	if cached, prs := jwksCache[path]; prs && cached.modTime.Equal(info.ModTime()) {
+		return cached.keys, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	document := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("%s: некорректный JWKS: %v", path, err)
+	}
+	for i := range document.Keys {
+		key, err := document.Keys[i].parse()
+		if err != nil {
+			return nil, fmt.Errorf("%s: ключ %d: %v", path, i, err)
+		}
+		document.Keys[i].key = key
+	}
+	jwksCache[path] = jwksFile{modTime: info.ModTime(), keys: document.Keys}
+	return document.Keys, nil
+}
+
+// decodeSegment декодирует base64url без выравнивания
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+// parse разбирает открытый ключ RSA, EC или симметричный ключ
+func (key jwk) parse() (interface{}, error) {
+	switch key.Kty {
+	case "RSA":
+		n, errN := decodeSegment(key.N)
+		e, errE := decodeSegment(key.E)
+		if errN != nil || errE != nil || len(n) == 0 || len(e) == 0 {
+			return nil, fmt.Errorf("некорректный ключ RSA")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, prs := curves[key.Crv]
+		if !prs {
+			return nil, fmt.Errorf("неизвестная кривая %q", key.Crv)
+		}
+		x, errX := decodeSegment(key.X)
+		y, errY := decodeSegment(key.Y)
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("некорректный ключ EC")
+		}
+		public := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(public.X, public.Y) {
+			return nil, fmt.Errorf("точка ключа EC не лежит на кривой %s", key.Crv)
+		}
+		return public, nil
+	case "oct":
+		secret, err := decodeSegment(key.K)
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("некорректный симметричный ключ")
+		}
+		return secret, nil
+	}
+	return nil, fmt.Errorf("неизвестный тип ключа %q", key.Kty)
+}
+
+// jwtAlgorithms хэш-функции алгоритмов подписи JWT
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	"HS256": crypto.SHA256, "HS384": crypto.SHA384, "HS512": crypto.SHA512,
+}
+
+// verifyToken проверяет подпись JWT одним из ключей и возвращает утверждения токена
+func verifyToken(token string, keys []jwk) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	headerData, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed header")
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return nil, fmt.Errorf("malformed header")
+	}
+	hash, prs := jwtAlgorithms[header.Alg]
+	if !prs {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if header.Kid != "" && key.Kid != "" && key.Kid != header.Kid {
+			continue
+		}
+		if verifySignature(header.Alg, hash, key.key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("signature verification failed")
+	}
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed payload")
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed payload")
+	}
+	return claims, nil
+}
+
+// verifySignature проверяет подпись ключом, подходящим под алгоритм
+func verifySignature(alg string, hash crypto.Hash, key interface{}, signed []byte, signature []byte) bool {
+	digest := func() []byte {
+		hasher := hash.New()
+		hasher.Write(signed)
+		return hasher.Sum(nil)
+	}
+	switch public := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(public, hash, digest(), signature) == nil
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(public, digest(), r, s)
+	case []byte:
+		if !strings.HasPrefix(alg, "HS") {
+			return false
+		}
+		mac := hmac.New(hash.New, public)
+		mac.Write(signed)
+		return hmac.Equal(signature, mac.Sum(nil))
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// signToken формирует JWT с подписью RS256
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("Ошибка подписи: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerify(t *testing.T) {
+	current := time.Unix(1577836800, 0)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Ошибка генерации ключа: %v", err)
+	}
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	dir, _ := ioutil.TempDir("", "jwks")
+	defer os.RemoveAll(dir)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	jwks := fmt.Sprintf(`{"keys": [{"kid": "main", "kty": "RSA", "n": %q, "e": %q}]}`,
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+	ioutil.WriteFile(jwksFile, []byte(jwks), 0644)
+	jwtAuth := Inbound{Type: JWT, JWKSFile: jwksFile, Issuer: "https://auth.example.com", Audience: "bus"}
+	validClaims := map[string]interface{}{"iss": "https://auth.example.com", "aud": []string{"bus"}, "exp": current.Unix() + 60}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(`{"status": "DELIVRD"}`))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	table := []struct {
+		name           string
+		inbound        Inbound
+		remoteAddr     string
+		target         string
+		headers        map[string]string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:    "Без проверки",
+			inbound: Inbound{},
+		},
+		{
+			name:       "Адрес из разрешённой подсети",
+			inbound:    Inbound{Allow: []string{"10.0.0.0/8", "192.0.2.1"}},
+			remoteAddr: "10.1.2.3:5000",
+		},
+		{
+			name:           "Адрес не из списка",
+			inbound:        Inbound{Allow: []string{"10.0.0.0/8", "192.0.2.1"}},
+			remoteAddr:     "192.0.2.2:5000",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:    "Ключ в хедере",
+			inbound: Inbound{Type: APIKey, Keys: []string{"k1", "k2"}},
+			headers: map[string]string{"X-Api-Key": "k2"},
+		},
+		{
+			name:    "Ключ в GET-параметре",
+			inbound: Inbound{Type: APIKey, Keys: []string{"k1"}, Query: "key"},
+			target:  "/dlr?key=k1",
+		},
+		{
+			name:           "Неверный ключ",
+			inbound:        Inbound{Type: APIKey, Keys: []string{"k1"}, Query: "key"},
+			target:         "/dlr?key=k2",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:    "Basic",
+			inbound: Inbound{Type: Basic, Users: map[string]string{"user": "pass"}},
+			headers: map[string]string{"Authorization": "Basic dXNlcjpwYXNz"},
+		},
+		{
+			name:           "Basic с неверным паролем",
+			inbound:        Inbound{Type: Basic, Users: map[string]string{"user": "other"}},
+			headers:        map[string]string{"Authorization": "Basic dXNlcjpwYXNz"},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:    "Подпись тела",
+			inbound: Inbound{Type: HMAC, Key: "secret", Header: "X-Hub-Signature", Prefix: "sha256="},
+			headers: map[string]string{"X-Hub-Signature": "sha256=" + signature},
+			body:    `{"status": "DELIVRD"}`,
+		},
+		{
+			name:           "Подпись изменённого тела",
+			inbound:        Inbound{Type: HMAC, Key: "secret", Header: "X-Hub-Signature", Prefix: "sha256="},
+			headers:        map[string]string{"X-Hub-Signature": "sha256=" + signature},
+			body:           `{"status": "REJECTD"}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:    "Действующий JWT",
+			inbound: jwtAuth,
+			headers: map[string]string{"Authorization": "Bearer " + signToken(t, key, "main", validClaims)},
+		},
+		{
+			name:           "JWT подписан другим ключом",
+			inbound:        jwtAuth,
+			headers:        map[string]string{"Authorization": "Bearer " + signToken(t, other, "main", validClaims)},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:    "Просроченный JWT",
+			inbound: jwtAuth,
+			headers: map[string]string{"Authorization": "Bearer " + signToken(t, key, "main", map[string]interface{}{
+				"iss": "https://auth.example.com", "aud": "bus", "exp": current.Unix() - 120,
+			})},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:    "JWT для другого получателя",
+			inbound: jwtAuth,
+			headers: map[string]string{"Authorization": "Bearer " + signToken(t, key, "main", map[string]interface{}{
+				"iss": "https://auth.example.com", "aud": "billing", "exp": current.Unix() + 60,
+			})},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Нет JWT",
+			inbound:        jwtAuth,
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			target := item.target
+			if target == "" {
+				target = "/dlr"
+			}
+			req := httptest.NewRequest("POST", target, nil)
+			if item.remoteAddr != "" {
+				req.RemoteAddr = item.remoteAddr
+			}
+			for name, value := range item.headers {
+				req.Header.Set(name, value)
+			}
+			err := item.inbound.Verify(req, []byte(item.body))
+			if item.expectedStatus == 0 {
+				if err != nil {
+					t.Errorf("Expected nil, got %v", err)
+				}
+				return
+			}
+			denied, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("Expected *Error, got %v", err)
+			}
+			if denied.Status != item.expectedStatus {
+				t.Errorf("Неверный статус. Expected %d, got %d (%v)", item.expectedStatus, denied.Status, denied)
+			}
+		})
+	}
+}
+
+func TestCheckInbound(t *testing.T) {
+	table := []struct {
+		name     string
+		inbound  Inbound
+		expected []string
+	}{
+		{name: "Без проверки", inbound: Inbound{}},
+		{name: "Некорректная подсеть", inbound: Inbound{Allow: []string{"10.0.0.0/33", "localhost"}}, expected: []string{`некорректная подсеть "10.0.0.0/33"`, `некорректный IP-адрес "localhost"`}},
+		{name: "Ключи не указаны", inbound: Inbound{Type: APIKey}, expected: []string{"не указано поле keys"}},
+		{name: "Файл JWKS не найден", inbound: Inbound{Type: JWT, JWKSFile: "/nonexistent/jwks.json"}, expected: []string{"файл /nonexistent/jwks.json не найден"}},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			errs := item.inbound.Check()
+			if len(errs) != len(item.expected) {
+				t.Fatalf("Expected %v, got %v", item.expected, errs)
+			}
+			for i, err := range errs {
+				if err.Error() != item.expected[i] {
+					t.Errorf("Expected %q, got %q", item.expected[i], err.Error())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"platform-service-bus/internal/pkg/secret"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Типы аутентификации исходящих запросов
+const (
+	Basic  = "basic"
+	Bearer = "bearer"
+	OAuth2 = "oauth2"
+	HMAC   = "hmac"
+	SigV4  = "sigv4"
+)
+
+// Outbound описывает аутентификацию исходящего запроса
+// Используются только поля, относящиеся к указанному типу
+type Outbound struct {
+	// Type - basic, bearer, oauth2, hmac или sigv4, пустая строка - без аутентификации
+	Type string
+
+	// Username и Password - для basic
+	Username string
+	Password string
+
+	// Token - статический токен для bearer
+	Token string
+
+	// TokenURL, ClientID, ClientSecret и Scopes - для oauth2 client credentials
+	TokenURL     string `json:"token-url"`
+	ClientID     string `json:"client-id"`
+	ClientSecret string `json:"client-secret"`
+	Scopes       []string
+	// ClientAuth - способ передачи данных клиента: basic (по умолчанию) или body
+	ClientAuth string `json:"client-auth"`
+
+	// Key - ключ подписи hmac
+	Key string
+	// Algorithm - sha256 (по умолчанию), sha512 или sha1
+	Algorithm string
+	// Header - хедер подписи, по умолчанию X-Signature
+	Header string
+	// TimestampHeader - хедер времени подписи, по умолчанию X-Timestamp
+	TimestampHeader string `json:"timestamp-header"`
+	// Encoding - кодировка подписи: hex (по умолчанию) или base64
+	Encoding string
+
+	// AccessKey, SecretKey, SessionToken, Region и Service - для sigv4
+	AccessKey    string `json:"access-key"`
+	SecretKey    string `json:"secret-key"`
+	SessionToken string `json:"session-token"`
+	Region       string
+	Service      string
+}
+
+// now возвращает текущее время, подменяется в тестах
+var now = time.Now
+
+// Check проверяет, что для выбранного типа указаны все необходимые поля
+func (outbound Outbound) Check() []error {
+	errs := []error{}
+	require := func(fields map[string]string) {
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if fields[name] == "" {
+				errs = append(errs, fmt.Errorf("не указано поле %s", name))
+			}
+		}
+	}
+	switch outbound.Type {
+	case "":
+	case Basic:
+		require(map[string]string{"username": outbound.Username})
+	case Bearer:
+		require(map[string]string{"token": outbound.Token})
+	case OAuth2:
+		require(map[string]string{"token-url": outbound.TokenURL, "client-id": outbound.ClientID})
+		if outbound.ClientAuth != "" && outbound.ClientAuth != "basic" && outbound.ClientAuth != "body" {
+			errs = append(errs, fmt.Errorf("неизвестный способ передачи данных клиента %q, ожидается basic или body", outbound.ClientAuth))
+		}
+		if outbound.TokenURL != "" {
+			if parsed, err := url.Parse(outbound.TokenURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+				errs = append(errs, fmt.Errorf("адрес %q должен начинаться с http:// или https://", outbound.TokenURL))
+			}
+		}
+	case HMAC:
+		require(map[string]string{"key": outbound.Key})
+		if _, err := hashFunction(outbound.Algorithm); err != nil {
+			errs = append(errs, err)
+		}
+		if outbound.Encoding != "" && outbound.Encoding != "hex" && outbound.Encoding != "base64" {
+			errs = append(errs, fmt.Errorf("неизвестная кодировка подписи %q, ожидается hex или base64", outbound.Encoding))
+		}
+	case SigV4:
+		require(map[string]string{"access-key": outbound.AccessKey, "secret-key": outbound.SecretKey, "region": outbound.Region, "service": outbound.Service})
+	default:
+		errs = append(errs, fmt.Errorf("неизвестный тип аутентификации %q", outbound.Type))
+	}
+	return errs
+}
+
+// Secrets возвращает секретные значения настроек, которые нужно скрывать в логах
+// Токены oauth2 скрываются при получении
+func (outbound Outbound) Secrets() []string {
+	values := []string{outbound.Password, outbound.Token, outbound.ClientSecret, outbound.Key, outbound.SecretKey, outbound.SessionToken}
+	if outbound.Type == Basic {
+		values = append(values, base64.StdEncoding.EncodeToString([]byte(outbound.Username+":"+outbound.Password)))
+	}
+	return values
+}
+
+// Apply добавляет в исходящий запрос данные аутентификации
+// body - тело запроса, используется для подписи
+// client выполняет запросы за токенами oauth2
+func (outbound Outbound) Apply(req *http.Request, body []byte, client *http.Client) error {
+	switch outbound.Type {
+	case "":
+		return nil
+	case Basic:
+		req.SetBasicAuth(outbound.Username, outbound.Password)
+	case Bearer:
+		req.Header.Set("Authorization", "Bearer "+outbound.Token)
+	case OAuth2:
+		token, err := outbound.source().token(req, client)
+		if err != nil {
+			return fmt.Errorf("не удалось получить токен oauth2: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case HMAC:
+		return outbound.signHMAC(req, body)
+	case SigV4:
+		outbound.signV4(req, body)
+	default:
+		return fmt.Errorf("неизвестный тип аутентификации %q", outbound.Type)
+	}
+	return nil
+}
+
+// Invalidate сбрасывает закэшированный токен oauth2, например после ответа 401
+func (outbound Outbound) Invalidate() {
+	if outbound.Type == OAuth2 {
+		outbound.source().invalidate()
+	}
+}
+
+// tokenSource получает и кэширует токен oauth2 для одного набора данных клиента
+type tokenSource struct {
+	mutex    sync.Mutex
+	outbound Outbound
+	value    string
+	expires  time.Time
+}
+
+// tokenSources токены oauth2 по данным клиента
+var tokenSources = map[string]*tokenSource{}
+
+// tokenSourcesMutex защищает tokenSources от одновременного доступа
+var tokenSourcesMutex sync.Mutex
+
+// source возвращает кэш токена для данных клиента
+func (outbound Outbound) source() *tokenSource {
+	sum := sha256.Sum256([]byte(strings.Join([]string{outbound.TokenURL, outbound.ClientID, outbound.ClientSecret, strings.Join(outbound.Scopes, " "), outbound.ClientAuth}, "\n")))
+	key := hex.EncodeToString(sum[:])
+	tokenSourcesMutex.Lock()
+	defer tokenSourcesMutex.Unlock()
+	source, prs := tokenSources[key]
+	if !prs {
+		source = &tokenSource{outbound: outbound}
+		tokenSources[key] = source
+	}
+	return source
+}
+
+// tokenResponse - ответ сервера авторизации
+type tokenResponse struct {
+	AccessToken string      `json:"access_token"`
+	ExpiresIn   json.Number `json:"expires_in"`
+}
+
+// refreshBefore - за сколько до истечения токен обновляется заранее
+const refreshBefore = time.Minute
+
+// token возвращает действующий токен, запрашивая новый при необходимости
+// Одновременные запросы ждут одного обращения к серверу авторизации
+func (source *tokenSource) token(req *http.Request, client *http.Client) (string, error) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	if source.value != "" && now().Before(source.expires) {
+		return source.value, nil
+	}
+	outbound := source.outbound
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(outbound.Scopes) > 0 {
+		form.Set("scope", strings.Join(outbound.Scopes, " "))
+	}
+	if outbound.ClientAuth == "body" {
+		form.Set("client_id", outbound.ClientID)
+		form.Set("client_secret", outbound.ClientSecret)
+	}
+	request, err := http.NewRequest("POST", outbound.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request = request.WithContext(req.Context())
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if outbound.ClientAuth != "body" {
+		request.SetBasicAuth(url.QueryEscape(outbound.ClientID), url.QueryEscape(outbound.ClientSecret))
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("сервер авторизации ответил %d", response.StatusCode)
+	}
+	parsed := tokenResponse{}
+	if err := json.Unmarshal(data, &parsed); err != nil || parsed.AccessToken == "" {
+		return "", fmt.Errorf("в ответе сервера авторизации нет access_token")
+	}
+	secret.Add(parsed.AccessToken)
+	lifetime := time.Hour
+	if seconds, err := strconv.ParseInt(string(parsed.ExpiresIn), 10, 64); err == nil && seconds > 0 {
+		lifetime = time.Duration(seconds) * time.Second
+	}
+	// Токен обновляется заранее, но не раньше середины срока действия
+	margin := refreshBefore
+	if margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+	source.value = parsed.AccessToken
+	source.expires = now().Add(lifetime - margin)
+	return source.value, nil
+}
+
+// invalidate сбрасывает закэшированный токен
+func (source *tokenSource) invalidate() {
+	source.mutex.Lock()
+	source.value = ""
+	source.mutex.Unlock()
+}
+
+// hashFunction возвращает хэш-функцию подписи по названию
+func hashFunction(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case "", "sha256":
+		return sha256.New, nil
+	case "sha512":
+		return sha512.New, nil
+	case "sha1":
+		return sha1.New, nil
+	}
+	return nil, fmt.Errorf("неизвестный алгоритм подписи %q, ожидается sha256, sha512 или sha1", algorithm)
+}
+
+// signHMAC подписывает запрос: HMAC от строки "метод\nпуть?параметры\nвремя\nтело"
+func (outbound Outbound) signHMAC(req *http.Request, body []byte) error {
+	newHash, err := hashFunction(outbound.Algorithm)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(now().Unix(), 10)
+	mac := hmac.New(newHash, []byte(outbound.Key))
+	mac.Write([]byte(req.Method + "\n" + req.URL.RequestURI() + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	signature := hex.EncodeToString(mac.Sum(nil))
+	if outbound.Encoding == "base64" {
+		signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	header, timestampHeader := outbound.Header, outbound.TimestampHeader
+	if header == "" {
+		header = "X-Signature"
+	}
+	if timestampHeader == "" {
+		timestampHeader = "X-Timestamp"
+	}
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(header, signature)
+	return nil
+}
+
+// signV4 подписывает запрос по алгоритму AWS Signature Version 4
+func (outbound Outbound) signV4(req *http.Request, body []byte) {
+	current := now().UTC()
+	amzDate := current.Format("20060102T150405Z")
+	date := current.Format("20060102")
+	payloadHash := hashHex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if outbound.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", outbound.SessionToken)
+	}
+	if outbound.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	// Подписываются host и все хедеры x-amz-*
+	headers := map[string]string{"host": req.URL.Host}
+	if req.Host != "" {
+		headers["host"] = req.Host
+	}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL),
+		canonicalQuery(req.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, outbound.Region, outbound.Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hashHex([]byte(canonicalRequest))}, "\n")
+	key := []byte("AWS4" + outbound.SecretKey)
+	for _, part := range []string{date, outbound.Region, outbound.Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", outbound.AccessKey, scope, signedHeaders, signature))
+}
+
+// canonicalPath возвращает путь запроса, закодированный по правилам SigV4
+func canonicalPath(target *url.URL) string {
+	path := target.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// canonicalQuery возвращает отсортированные и закодированные параметры запроса
+func canonicalQuery(target *url.URL) string {
+	query := target.Query()
+	pairs := []string{}
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(name)+"="+awsEscape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape кодирует строку, оставляя только незарезервированные символы RFC 3986
+func awsEscape(text string) string {
+	return strings.Replace(strings.Replace(url.QueryEscape(text), "+", "%20", -1), "%7E", "~", -1)
+}
+
+// hashHex возвращает шестнадцатеричный SHA-256 данных
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 возвращает HMAC-SHA256 строки
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestApply(t *testing.T) {
+	now = func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+	table := []struct {
+		name     string
+		outbound Outbound
+		url      string
+		expected map[string]string
+	}{
+		{
+			name:     "Без аутентификации",
+			outbound: Outbound{},
+			expected: map[string]string{"Authorization": ""},
+		},
+		{
+			name:     "Basic",
+			outbound: Outbound{Type: Basic, Username: "user", Password: "pass"},
+			expected: map[string]string{"Authorization": "Basic dXNlcjpwYXNz"},
+		},
+		{
+			name:     "Статический токен",
+			outbound: Outbound{Type: Bearer, Token: "token"},
+			expected: map[string]string{"Authorization": "Bearer token"},
+		},
+		{
+			name:     "Подпись SigV4",
+			outbound: Outbound{Type: SigV4, AccessKey: "AKIDEXAMPLE", SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", Region: "us-east-1", Service: "service"},
+			url:      "http://example.amazonaws.com/",
+			expected: map[string]string{
+				"X-Amz-Date":    "20150830T123600Z",
+				"Authorization": "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+			},
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			target := item.url
+			if target == "" {
+				target = "http://example.com/"
+			}
+			req := httptest.NewRequest("GET", target, nil)
+			req.Host = ""
+			if err := item.outbound.Apply(req, nil, http.DefaultClient); err != nil {
+				t.Fatalf("Expected nil, got %v", err)
+			}
+			for name, expected := range item.expected {
+				if got := req.Header.Get(name); got != expected {
+					t.Errorf("Неверный хедер %s. Expected %q, got %q", name, expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSignHMAC(t *testing.T) {
+	now = func() time.Time { return time.Unix(1577836800, 0) }
+	defer func() { now = time.Now }()
+	req := httptest.NewRequest("POST", "http://example.com/send?a=1", nil)
+	outbound := Outbound{Type: HMAC, Key: "key", Header: "X-Sign"}
+	if err := outbound.Apply(req, []byte("{}"), nil); err != nil {
+		t.Fatalf("Expected nil, got %v", err)
+	}
+	expected := "a531389bd1f0984590901424d66756e09a170d2370d52a8c51b743a1f325f00f"
+	if got := req.Header.Get("X-Sign"); got != expected {
+		t.Errorf("Неверная подпись. Expected %q, got %q", expected, got)
+	}
+}
+
+func TestOAuth2(t *testing.T) {
+	current := time.Now()
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+	var issued int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		clientID, clientSecret, _ := r.BasicAuth()
+		if r.PostForm.Get("grant_type") != "client_credentials" || clientID != "client" || clientSecret != "secret" || r.PostForm.Get("scope") != "a b" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		n := atomic.AddInt32(&issued, 1)
+		fmt.Fprintf(w, `{"access_token": "token-%d", "token_type": "bearer", "expires_in": 3600}`, n)
+	}))
+	defer server.Close()
+	outbound := Outbound{Type: OAuth2, TokenURL: server.URL, ClientID: "client", ClientSecret: "secret", Scopes: []string{"a", "b"}}
+	authorization := func() string {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		if err := outbound.Apply(req, nil, server.Client()); err != nil {
+			t.Fatalf("Expected nil, got %v", err)
+		}
+		return req.Header.Get("Authorization")
+	}
+	table := []struct {
+		name     string
+		advance  time.Duration
+		reset    bool
+		expected string
+	}{
+		{name: "Первый запрос получает токен", expected: "Bearer token-1"},
+		{name: "Токен берётся из кэша", advance: 30 * time.Minute, expected: "Bearer token-1"},
+		{name: "Токен обновляется до истечения", advance: 29*time.Minute + 30*time.Second, expected: "Bearer token-2"},
+		{name: "Сброс токена после 401", reset: true, expected: "Bearer token-3"},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			current = current.Add(item.advance)
+			if item.reset {
+				outbound.Invalidate()
+			}
+			if got := authorization(); got != item.expected {
+				t.Errorf("Expected %q, got %q", item.expected, got)
+			}
+		})
+	}
+	failing := Outbound{Type: OAuth2, TokenURL: server.URL, ClientID: "client", ClientSecret: "wrong"}
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	if err := failing.Apply(req, nil, server.Client()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected an error with status 401, got %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	table := []struct {
+		name     string
+		outbound Outbound
+		expected []string
+	}{
+		{name: "Без аутентификации", outbound: Outbound{}},
+		{name: "Неизвестный тип", outbound: Outbound{Type: "digest"}, expected: []string{`неизвестный тип аутентификации "digest"`}},
+		{name: "Oauth2 без адреса", outbound: Outbound{Type: OAuth2, ClientID: "c"}, expected: []string{"не указано поле token-url"}},
+		{name: "Неизвестный алгоритм HMAC", outbound: Outbound{Type: HMAC, Key: "k", Algorithm: "md5"}, expected: []string{`неизвестный алгоритм подписи "md5", ожидается sha256, sha512 или sha1`}},
+		{name: "SigV4 без региона", outbound: Outbound{Type: SigV4, AccessKey: "a", SecretKey: "s", Service: "s3"}, expected: []string{"не указано поле region"}},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			errs := item.outbound.Check()
+			if len(errs) != len(item.expected) {
+				t.Fatalf("Expected %v, got %v", item.expected, errs)
+			}
+			for i, err := range errs {
+				if err.Error() != item.expected[i] {
+					t.Errorf("Expected %q, got %q", item.expected[i], err.Error())
+				}
+			}
+		})
+	}
+}
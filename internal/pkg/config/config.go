@@ -4,17 +4,25 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"platform-service-bus/internal/pkg/adapter"
+	"platform-service-bus/internal/pkg/rule"
+	"platform-service-bus/internal/pkg/secret"
+	"strings"
 )
 
 // Config описывает конфигурацию всего приложения
 type Config struct {
 	Adapters []adapter.Adapter
+	// Maps - именованные таблицы соответствия для подстановки %MAP[name][key]%
+	Maps map[string]rule.Map
+	// QueueDir - каталог очередей асинхронной доставки, по умолчанию queue
+	QueueDir string `json:"queue-dir"`
 }
 
 // fileReader описывает функцию чтения данных из файла
 type fileReader func(filename string) ([]byte, error)
 
 // Load загружает указанный файл конфигурации
+// Ссылки ${ENV:NAME} и ${FILE:path} заменяются значениями, которые затем скрываются в логах
 // На выходе получаем map или ошибку
 func Load(configPath string, opts ...interface{}) (Config, error) {
 	// Можно предоставить свою функцию чтения данных
@@ -28,8 +36,63 @@ func Load(configPath string, opts ...interface{}) (Config, error) {
 	if err != nil {
 		return config, err
 	}
+	configData, secrets, problems := expand(configData)
+	if len(problems) > 0 {
+		return config, &ValidationError{problems}
+	}
+	secret.Add(secrets...)
 	if err := json.Unmarshal(configData, &config); err != nil {
 		return config, err
 	}
+	secret.Add(config.secrets()...)
 	return config, nil
 }
+
+// LoadQueueDir читает из файла конфигурации только каталог очередей
+// В отличие от Load, ненайденные ссылки ${ENV:NAME} и ${FILE:path} вне queue-dir не считаются ошибкой:
+// команды dlq должны работать и на хосте, где секретов адаптеров нет
+// Найденные значения и пароли аутентификации регистрируются, чтобы скрывать их при выводе
+func LoadQueueDir(configPath string, opts ...interface{}) (string, error) {
+	reader := ioutil.ReadFile
+	if len(opts) > 0 {
+		reader = opts[0].(fileReader)
+	}
+	configData, err := reader(configPath)
+	if err != nil {
+		return "", err
+	}
+	configData, secrets, problems := expand(configData)
+	secret.Add(secrets...)
+	config := Config{}
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return "", err
+	}
+	secret.Add(config.secrets()...)
+	// Ненайденная ссылка остаётся в тексте, а сообщение о ней начинается с самой ссылки
+	for _, reference := range referencePattern.FindAllString(config.QueueDir, -1) {
+		for _, problem := range problems {
+			if strings.HasPrefix(problem.Message, reference+":") {
+				return "", &ValidationError{[]Problem{{"queue-dir", problem.Message}}}
+			}
+		}
+	}
+	return config.QueueDir, nil
+}
+
+// secrets возвращает пароли, ключи и токены из настроек аутентификации, чтобы скрывать их в логах
+func (config Config) secrets() []string {
+	values := []string{}
+	for _, adapterObject := range config.Adapters {
+		values = append(values, adapterObject.Auth.Secrets()...)
+		for _, ruleObject := range adapterObject.Rules {
+			values = append(values, ruleObject.From.Auth.Secrets()...)
+			for _, step := range ruleObject.Steps {
+				values = append(values, step.Auth.Secrets()...)
+			}
+			for _, to := range ruleObject.Targets() {
+				values = append(values, to.Auth.Secrets()...)
+			}
+		}
+	}
+	return values
+}
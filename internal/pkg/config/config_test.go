@@ -2,11 +2,17 @@ package config
 
 import (
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"os"
 	"platform-service-bus/internal/pkg/adapter"
+	"platform-service-bus/internal/pkg/rule"
+	"platform-service-bus/internal/pkg/secret"
 	"testing"
 )
 
 func TestLoad(t *testing.T) {
+	os.Setenv("TEST_ADAPTER_NAME", `World "SMS"`)
+	defer os.Unsetenv("TEST_ADAPTER_NAME")
 	table := []struct {
 		name          string
 		input         string
@@ -28,6 +34,69 @@ func TestLoad(t *testing.T) {
 			},
 			expectedError: false,
 		},
+		{
+			name:  "Status map",
+			input: `{"adapters":[{"rules":[{"to":{"status-map":{"202":200}}}]}]}`,
+			expected: Config{
+				Adapters: []adapter.Adapter{
+					adapter.Adapter{
+						Rules: []rule.Rule{
+							rule.Rule{
+								To: rule.To{
+									StatusMap: map[int]int{202: 200},
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			name:  "Destinations list",
+			input: `{"adapters":[{"rules":[{"to":[{"name":"billing","url":"http://billing"},{"url":"http://audit","primary":true}],"fan-out":{"response":"primary"}}]}]}`,
+			expected: Config{
+				Adapters: []adapter.Adapter{
+					adapter.Adapter{
+						Rules: []rule.Rule{
+							rule.Rule{
+								Destinations: []rule.To{
+									rule.To{Name: "billing", URL: "http://billing"},
+									rule.To{URL: "http://audit", Primary: true},
+								},
+								FanOut: rule.FanOut{Response: "primary"},
+							},
+						},
+					},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			name:  "Environment and file references",
+			input: `{"adapters":[{"name":"${ENV:TEST_ADAPTER_NAME}","rules":[{"to":{"headers":["Authorization: Basic ${FILE:testdata/secret.txt}"],"data":"$${ENV:KEEP}"}}]}]}`,
+			expected: Config{
+				Adapters: []adapter.Adapter{
+					adapter.Adapter{
+						Name: `World "SMS"`,
+						Rules: []rule.Rule{
+							rule.Rule{
+								To: rule.To{
+									Headers: []string{"Authorization: Basic dXNlcjpwYXNz"},
+									Data:    "${ENV:KEEP}",
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			name:          "Missing environment variable",
+			input:         `{"adapters":[{"name":"${ENV:TEST_MISSING_VARIABLE}"}]}`,
+			expectedError: true,
+		},
 		{
 			name:          "Wrong JSON",
 			input:         `{adapters:[]}`,
@@ -41,9 +110,358 @@ func TestLoad(t *testing.T) {
 			}))
 			if item.expectedError && err == nil {
 				t.Errorf("Expected an error, got %v", got)
-			} else if !cmp.Equal(got, item.expected) {
+			} else if !cmp.Equal(got, item.expected, cmpopts.IgnoreUnexported(adapter.Adapter{})) {
 				t.Errorf("Expected %v, got %v, err %v", item.expected, got, err)
 			}
 		})
 	}
 }
+
+func TestValidate(t *testing.T) {
+	table := []struct {
+		name             string
+		input            string
+		expectedProblems []string
+	}{
+		{
+			name: "Корректная конфигурация",
+			input: `{"adapters": [{"name": "A", "port": 8700, "rules": [{
+				"from": {"path": "/dlr", "http-method": "GET", "match": {"query": [{"name": "type", "regex": "^dlr$"}]}},
+				"to": {"url": "https://example.com", "headers": ["Content-Type: text/xml"], "data": "%QUERY[smsid]% %REGEX[from>([^<\\s]+)][1]%",
+					"timeout": "5s", "retries": 2, "retry-on": ["network", "5xx", "429"], "status-map": {"202": 200}}
+			}]}]}`,
+			expectedProblems: []string{},
+		},
+		{
+			name:  "Неизвестные поля",
+			input: `{"adapters": [{"port": 8700, "rules": [{"from": {"path": "/dlr", "http_method": "GET"}, "to": {"data_file": "x"}}]}]}`,
+			expectedProblems: []string{
+				"adapters[0].rules[0].from.http_method: неизвестное поле",
+				"adapters[0].rules[0].to.data_file: неизвестное поле",
+			},
+		},
+		{
+			name:  "Ошибки типов и диапазонов",
+			input: `{"adapters": [{"port": 70000}, {"port": "8701"}, {"port": 8702, "timeout": "soon"}]}`,
+			expectedProblems: []string{
+				"adapters[1].port: ожидается целое число, получено: строка",
+				"adapters[2].timeout: time: invalid duration \"soon\"",
+				"adapters[0].port: порт 70000 вне диапазона 1-65535",
+			},
+		},
+		{
+			name:  "Повторяющиеся порты",
+			input: `{"adapters": [{"port": 8700}, {"port": 8700}]}`,
+			expectedProblems: []string{
+				"adapters[1].port: порт 8700 уже используется адаптером adapters[0]",
+			},
+		},
+		{
+			name: "Ошибки правила",
+			input: `{"adapters": [{"port": 8700, "rules": [{
+				"from": {"path": "dlr", "match": {"body": "("}},
+				"to": {"url": "ftp://x", "headers": ["NoColon"], "data": "%QUERY% %UNKNOWN[x]%", "retry-on": ["6xx"]},
+				"response": {"data-file": "/nonexistent/template.json"}
+			}]}]}`,
+			expectedProblems: []string{
+				"adapters[0].rules[0].from.path: путь \"dlr\" должен начинаться с /",
+				"adapters[0].rules[0].from.match.body: error parsing regexp: missing closing ): `(`",
+				"adapters[0].rules[0].to.url: адрес \"ftp://x\" должен начинаться с http:// или https://",
+				"adapters[0].rules[0].to.headers[0]: хедер \"NoColon\" должен иметь вид \"Name: value\"",
+				"adapters[0].rules[0].to.data: подстановка %QUERY%: ожидается аргументов: 1, указано: 0",
+				"adapters[0].rules[0].to.data: неизвестная подстановка %UNKNOWN[x]%",
+				"adapters[0].rules[0].to.retry-on[0]: недопустимое условие повтора \"6xx\"",
+				"adapters[0].rules[0].response.data-file: файл /nonexistent/template.json не найден",
+			},
+		},
+		{
+			name: "Подстановки в адресе и хедерах",
+			input: `{"adapters": [{"port": 8700, "rules": [{
+				"from": {"path": "/dlr"},
+				"to": {"url": "https://example.com/%QUERY[id]%/%PATH[x]%", "headers": ["X-Id: %HEADER%", "X-Ok: %HEADER[X-Id]%"]}
+			}, {
+				"from": {"path": "/sms"},
+				"to": {"url": "%QUERY[base]%/sms"}
+			}]}]}`,
+			expectedProblems: []string{
+				"adapters[0].rules[0].to.url: подстановка %PATH[x]%: параметр пути \"x\" не объявлен в /dlr",
+				"adapters[0].rules[0].to.headers[0]: подстановка %HEADER%: ожидается аргументов: 1, указано: 0",
+				"adapters[0].rules[1].to.url: адрес \"%QUERY[base]%/sms\" должен начинаться с http:// или https://",
+			},
+		},
+		{
+			name: "GET-параметры исходящего запроса",
+			input: `{"adapters": [{"port": 8700, "rules": [{
+				"from": {"path": "/dlr"},
+				"to": {"url": "https://example.com", "query": {"allow": ["smsid"], "deny": ["*"], "rename": {"smsid": ""}, "set": {"ok": "%HEADER[X-Source]%", "bad": "%UNKNOWN[x]%"}}}
+			}]}]}`,
+			expectedProblems: []string{
+				"adapters[0].rules[0].to.query.rename.smsid: не указано новое имя параметра",
+				"adapters[0].rules[0].to.query.set.bad: неизвестная подстановка %UNKNOWN[x]%",
+			},
+		},
+		{
+			name: "Аутентификация исходящего запроса",
+			input: `{"adapters": [{"port": 8700, "rules": [{
+				"from": {"path": "/dlr"},
+				"to": {"url": "https://example.com", "auth": {"type": "oauth2", "client-id": "bus", "scopes": ["sms"]}},
+				"steps": [{"url": "https://example.com", "auth": {"type": "digest"}}]
+			}]}]}`,
+			expectedProblems: []string{
+				"adapters[0].rules[0].steps[0].auth: неизвестный тип аутентификации \"digest\"",
+				"adapters[0].rules[0].to.auth: не указано поле token-url",
+			},
+		},
+		{
+			name: "Аутентификация входящих запросов",
+			input: `{"adapters": [{"port": 8700, "auth": {"allow": ["10.0.0.0/40"]}, "rules": [{
+				"from": {"path": "/dlr", "auth": {"type": "hmac", "algorithm": "md5"}}
+			}]}]}`,
+			expectedProblems: []string{
+				"adapters[0].auth: некорректная подсеть \"10.0.0.0/40\"",
+				"adapters[0].rules[0].from.auth: не указано поле key",
+				"adapters[0].rules[0].from.auth: неизвестный алгоритм подписи \"md5\", ожидается sha256, sha512 или sha1",
+			},
+		},
+		{
+			name: "Настройки TLS",
+			input: `{"adapters": [{"port": 8700, "tls": {"cert-file": "/nonexistent/server.crt", "key-file": "/nonexistent/server.key", "min-version": "1.4"}, "rules": [{
+				"from": {"path": "/dlr"},
+				"to": {"url": "https://example.com", "tls": {"cert-file": "/nonexistent/client.crt"}}
+			}]}]}`,
+			expectedProblems: []string{
+				"adapters[0].tls: файл /nonexistent/server.crt не найден",
+				"adapters[0].tls: неизвестная версия TLS \"1.4\", ожидается 1.0, 1.1, 1.2 или 1.3",
+				"adapters[0].rules[0].to.tls: cert-file и key-file указываются вместе",
+			},
+		},
+		{
+			name: "Асинхронная доставка",
+			input: `{"adapters": [{"port": 8700, "rules": [{
+				"from": {"path": "/dlr"},
+				"async": true,
+				"ack": {"status": 700, "data": "%UNKNOWN[x]%"},
+				"response": {"data": "%UPSTREAM_BODY%"}
+			}]}]}`,
+			expectedProblems: []string{
+				"adapters[0].rules[0].to.url: асинхронная доставка требует адрес",
+				"adapters[0].rules[0].response: шаблон ответа не используется при асинхронной доставке, ответ задаётся в ack",
+				"adapters[0].rules[0].ack.status: недопустимый код ответа 700",
+				"adapters[0].rules[0].ack.data: неизвестная подстановка %UNKNOWN[x]%",
+			},
+		},
+		{
+			name: "Список адресатов",
+			input: `{"adapters": [{"port": 8700, "rules": [
+				{"from": {"path": "/a"}, "to": [
+					{"name": "billing", "primary": true, "url": "http://billing"},
+					{"name": "billing", "primary": true, "data": "%UNKNOWN[x]%"},
+					{"url": "ftp://audit", "timeout": "soon"}
+				], "fan-out": {"response": "all", "mode": "parallel"}},
+				{"from": {"path": "/b"}, "to": {"url": "http://billing"}, "fan-out": {"mode": "sequential"}},
+				{"from": {"path": "/c"}, "to": [{"url": "http://billing"}, {}], "async": true}
+			]}]}`,
+			expectedProblems: []string{
+				"adapters[0].rules[0].to[2].timeout: time: invalid duration \"soon\"",
+				"adapters[0].rules[0].to[1].url: не указан адрес",
+				"adapters[0].rules[0].to[1].data: неизвестная подстановка %UNKNOWN[x]%",
+				"adapters[0].rules[0].to[1].name: имя \"billing\" уже используется адресатом to[0]",
+				"adapters[0].rules[0].to[1].primary: основной адресат уже указан в to[0]",
+				"adapters[0].rules[0].to[2].url: адрес \"ftp://audit\" должен начинаться с http:// или https://",
+				"adapters[0].rules[0].fan-out: недопустимое значение response \"all\", ожидается одно из [first primary aggregate]",
+				"adapters[0].rules[1].fan-out: fan-out применяется только к списку адресатов в to",
+				"adapters[0].rules[2].to[1].url: не указан адрес",
+			},
+		},
+		{
+			name: "URL-кодированный текст в шаблоне",
+			input: `{"adapters": [{"port": 8700, "rules": [{
+				"from": {"path": "/sms"},
+				"to": {"headers": ["X-Text: %D0%9F%D1%80"], "data": "text=%D0%9F%D1%80&name=%C3%A9&sale=50%OFF%"}
+			}]}]}`,
+			expectedProblems: []string{},
+		},
+		{
+			name: "Закодированный адрес",
+			input: `{"adapters": [{"port": 8700, "rules": [{
+				"from": {"path": "/sms"},
+				"to": {"url": "https://api.example.com/send?text=%D0%9F%D1%80&name=%C3%A9&id=%QUERY[id]%"}
+			}]}]}`,
+			expectedProblems: []string{},
+		},
+		{
+			name: "Подстановки ответа вне шаблона ответа",
+			input: `{"adapters": [{"port": 8700, "rules": [{
+				"from": {"path": "/sms"},
+				"steps": [{"data": "%UPSTREAM_BODY%"}],
+				"to": {"url": "http://sms/%UPSTREAM_STATUS%", "headers": ["X-Id: %UPSTREAM_HEADER[X-Id]%"], "data": "%MAP[codes][%UPSTREAM[0].STATUS%]%"},
+				"response": {"headers": ["X-Status: %UPSTREAM_STATUS%"], "data": "%UPSTREAM[0].BODY%"}
+			}]}], "maps": {"codes": {"values": {"200": "ok"}}}}`,
+			expectedProblems: []string{
+				"adapters[0].rules[0].steps[0].data: подстановка %UPSTREAM_BODY% доступна только в шаблоне ответа",
+				"adapters[0].rules[0].to.url: подстановка %UPSTREAM_STATUS% доступна только в шаблоне ответа",
+				"adapters[0].rules[0].to.headers[0]: подстановка %UPSTREAM_HEADER[X-Id]% доступна только в шаблоне ответа",
+				"adapters[0].rules[0].to.data: подстановка %MAP[codes][%UPSTREAM[0].STATUS%]%: подстановка %UPSTREAM[0].STATUS% доступна только в шаблоне ответа",
+			},
+		},
+		{
+			name: "Ответы адресатов в шаблоне ответа",
+			input: `{"adapters": [{"port": 8700, "rules": [{
+				"from": {"path": "/balance"},
+				"to": [{"name": "billing", "url": "http://billing"}, {"url": "http://profile"}],
+				"fan-out": {"response": "aggregate"},
+				"response": {"data": "%UPSTREAM[billing].JSON[$.balance]% %UPSTREAM[1]% %UPSTREAM[other].BODY% %UPSTREAM[billing].COOKIE[a]% %UPSTREAM[billing].REGEX[(][x]% %QUERY[a].JSON[b]%"}
+			}]}]}`,
+			expectedProblems: []string{
+				"adapters[0].rules[0].response.data: подстановка %UPSTREAM[other].BODY%: адресат \"other\" не найден в to",
+				"adapters[0].rules[0].response.data: подстановка %UPSTREAM[billing].COOKIE[a]%: неизвестное уточнение COOKIE",
+				"adapters[0].rules[0].response.data: подстановка %UPSTREAM[billing].REGEX[(][x]%: error parsing regexp: missing closing ): `(`",
+				"adapters[0].rules[0].response.data: подстановка %QUERY[a].JSON[b]% не поддерживает уточнение",
+			},
+		},
+		{
+			name: "Таблицы соответствия",
+			input: `{"maps": {
+				"dlr-status": {"values": {"DELIVRD": "delivered"}, "missing": "default", "default": "unknown"},
+				"broken": {"file": "/nonexistent/map.csv", "missing": "skip"}
+			}, "adapters": [{"port": 8700, "rules": [{
+				"from": {"path": "/dlr"},
+				"to": {"data": "%MAP[dlr-status][%QUERY[status]%]% %MAP[other][x]% %MAP[dlr-status][%QUERY%]%"}
+			}]}]}`,
+			expectedProblems: []string{
+				"adapters[0].rules[0].to.data: подстановка %MAP[other][x]%: таблица other не найдена",
+				"adapters[0].rules[0].to.data: подстановка %MAP[dlr-status][%QUERY%]%: подстановка %QUERY%: ожидается аргументов: 1, указано: 0",
+				"maps.broken.missing: неизвестное поведение \"skip\", ожидается passthrough, default или error",
+				"maps.broken.file: файл /nonexistent/map.csv не найден",
+			},
+		},
+		{
+			name: "Шаблоны путей",
+			input: `{"adapters": [{"port": 8700, "rules": [
+				{"from": {"path": "/users/{id}/sms"}, "to": {"data": "%PATH[id]% %PATH%"}},
+				{"from": {"path": "/users/{id}/{id}"}},
+				{"from": {"path": "/files/{rest*}/x", "path-type": "prefix"}},
+				{"from": {"path": "/dlr/", "path-type": "all"}},
+				{"from": {"path": "/sms/"}},
+				{"from": {"path": "/sms/", "path-type": "exact"}}
+			]}]}`,
+			expectedProblems: []string{
+				"adapters[0].rules[1].from.path: параметр пути id повторяется",
+				"adapters[0].rules[2].from.path: параметр {rest*} должен быть последним сегментом пути",
+				"adapters[0].rules[3].from.path: неизвестный тип пути \"all\", ожидается exact или prefix",
+				"adapters[0].rules[5].from.path-type: тип пути exact отличается от правила adapters[0].rules[4] с тем же путём",
+			},
+		},
+		{
+			name: "Пространства имён XPath",
+			input: `{"adapters": [{"port": 8700, "rules": [{
+				"from": {"path": "/dlr"},
+				"to": {"data": "%XPATH[//sms:from]% %XPATH[//soap:Body]% %XPATH[//sms:to[0]]%"},
+				"namespaces": {"sms": "urn:sms", "empty": ""}
+			}]}]}`,
+			expectedProblems: []string{
+				"adapters[0].rules[0].namespaces.empty: не указан URI пространства имён",
+				"adapters[0].rules[0].to.data: подстановка %XPATH[//soap:Body]%: не объявлен префикс пространства имён \"soap\"",
+				"adapters[0].rules[0].to.data: подстановка %XPATH[//sms:to[0]]%: XPath \"//sms:to[0]\": номер узла должен быть больше 0",
+			},
+		},
+		{
+			name:  "Ненайденные ссылки",
+			input: `{"adapters": [{"name": "${ENV:TEST_MISSING_VARIABLE}", "port": "${FILE:/nonexistent/port}"}]}`,
+			expectedProblems: []string{
+				"${ENV:TEST_MISSING_VARIABLE}: переменная окружения TEST_MISSING_VARIABLE не задана",
+				"${FILE:/nonexistent/port}: файл /nonexistent/port не найден",
+			},
+		},
+		{
+			name:             "Некорректный JSON",
+			input:            `{adapters:[]}`,
+			expectedProblems: []string{"некорректный JSON: invalid character 'a' looking for beginning of object key string"},
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			_, err := Validate("", fileReader(func(filename string) ([]byte, error) {
+				return []byte(item.input), nil
+			}))
+			got := []string{}
+			if validationError, ok := err.(*ValidationError); ok {
+				for _, problem := range validationError.Problems {
+					got = append(got, problem.String())
+				}
+			} else if err != nil {
+				t.Fatalf("Expected ValidationError, got %v", err)
+			}
+			if !cmp.Equal(got, item.expectedProblems) {
+				t.Errorf("Неверный список ошибок: %s", cmp.Diff(item.expectedProblems, got))
+			}
+		})
+	}
+}
+
+func TestLoadQueueDir(t *testing.T) {
+	os.Setenv("TEST_QUEUE_DIR", "/var/lib/psb")
+	defer os.Unsetenv("TEST_QUEUE_DIR")
+	table := []struct {
+		name          string
+		input         string
+		expected      string
+		expectedError string
+	}{
+		{
+			name:     "Секреты адаптеров не нужны",
+			input:    `{"queue-dir": "/var/queue", "adapters":[{"rules":[{"to":{"headers":["Authorization: ${ENV:TEST_MISSING_VARIABLE}"]}}]}]}`,
+			expected: "/var/queue",
+		},
+		{
+			name:     "Каталог из переменной окружения",
+			input:    `{"queue-dir": "${ENV:TEST_QUEUE_DIR}/queue"}`,
+			expected: "/var/lib/psb/queue",
+		},
+		{
+			name:          "Каталог из ненайденной переменной",
+			input:         `{"queue-dir": "${ENV:TEST_MISSING_VARIABLE}"}`,
+			expectedError: "некорректная конфигурация: queue-dir: ${ENV:TEST_MISSING_VARIABLE}: переменная окружения TEST_MISSING_VARIABLE не задана",
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			got, err := LoadQueueDir("", fileReader(func(filename string) ([]byte, error) {
+				return []byte(item.input), nil
+			}))
+			if item.expectedError != "" {
+				if err == nil || err.Error() != item.expectedError {
+					t.Errorf("Неверная ошибка. Expected %q, got %v", item.expectedError, err)
+				}
+				return
+			}
+			if err != nil || got != item.expected {
+				t.Errorf("Неверный каталог. Expected %q, got %q, err %v", item.expected, got, err)
+			}
+		})
+	}
+}
+
+func TestSecretsRedacted(t *testing.T) {
+	_, err := Load("", fileReader(func(filename string) ([]byte, error) {
+		return []byte(`{"adapters":[{"rules":[{"to":{"headers":["Authorization: Basic ${FILE:testdata/secret.txt}"]}}]}]}`), nil
+	}))
+	if err != nil {
+		t.Fatalf("Ошибка загрузки. Expected nil, got %v", err)
+	}
+	if got := secret.Redact("Authorization: Basic dXNlcjpwYXNz"); got != "Authorization: Basic "+secret.Mask {
+		t.Errorf("Секрет из конфигурации не скрыт: %s", got)
+	}
+	// Пароли и ключи аутентификации, указанные в конфигурации явно
+	_, err = Load("", fileReader(func(filename string) ([]byte, error) {
+		return []byte(`{"adapters":[{"auth":{"type":"apikey","keys":["inbound-api-key"]},"rules":[{"to":{"auth":{"type":"oauth2","token-url":"https://auth","client-id":"bus","client-secret":"oauth-client-secret"}}}]}]}`), nil
+	}))
+	if err != nil {
+		t.Fatalf("Ошибка загрузки. Expected nil, got %v", err)
+	}
+	for _, value := range []string{"inbound-api-key", "oauth-client-secret"} {
+		if got := secret.Redact("value " + value); got != "value "+secret.Mask {
+			t.Errorf("Секрет аутентификации не скрыт: %s", got)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"platform-service-bus/internal/pkg/template"
+	"regexp"
+	"strings"
+)
+
+// referencePattern находит ссылки ${ENV:NAME} и ${FILE:path}, $${...} оставляется как ${...}
+var referencePattern = regexp.MustCompile(`\$?\$\{(ENV|FILE):([^}]*)\}`)
+
+// expand подставляет в текст конфигурации значения переменных окружения и содержимое файлов
+// Значения экранируются для вставки в JSON-строку
+// Возвращает новый текст, подставленные значения и ошибки для ненайденных ссылок
+func expand(data []byte) ([]byte, []string, []Problem) {
+	values := []string{}
+	problems := []Problem{}
+	expanded := referencePattern.ReplaceAllFunc(data, func(reference []byte) []byte {
+		if reference[1] == '$' {
+			return reference[1:]
+		}
+		parts := referencePattern.FindSubmatch(reference)
+		kind, name := string(parts[1]), string(parts[2])
+		var value string
+		switch kind {
+		case "ENV":
+			found, prs := os.LookupEnv(name)
+			if !prs {
+				problems = append(problems, Problem{"", fmt.Sprintf("%s: переменная окружения %s не задана", reference, name)})
+				return reference
+			}
+			value = found
+		case "FILE":
+			contents, err := ioutil.ReadFile(name)
+			if err != nil {
+				message := err.Error()
+				if os.IsNotExist(err) {
+					message = fmt.Sprintf("файл %s не найден", name)
+				}
+				problems = append(problems, Problem{"", fmt.Sprintf("%s: %s", reference, message)})
+				return reference
+			}
+			// Файлы секретов обычно заканчиваются переводом строки, который не входит в значение
+			value = strings.TrimRight(string(contents), "\r\n")
+		}
+		values = append(values, value)
+		escaped, _ := template.Escape(template.Value{Text: value}, template.FormatJSON)
+		return []byte(escaped)
+	})
+	return expanded, values, problems
+}
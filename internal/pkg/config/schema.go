@@ -0,0 +1,187 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// unmarshalerType тип интерфейса json.Unmarshaler
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// jsonName возвращает имя поля структуры в JSON
+// Второе значение false, если поле не участвует в разборе JSON
+func jsonName(field reflect.StructField) (string, bool) {
+	if field.PkgPath != "" {
+		return "", false
+	}
+	tag := strings.Split(field.Tag.Get("json"), ",")[0]
+	if tag == "-" {
+		return "", false
+	}
+	if tag != "" {
+		return tag, true
+	}
+	return field.Name, true
+}
+
+// describe возвращает название JSON-типа значения для сообщений об ошибках
+func describe(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "объект"
+	case []interface{}:
+		return "массив"
+	case string:
+		return "строка"
+	case json.Number:
+		return "число"
+	case bool:
+		return "логическое значение"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// checkSchema сверяет разобранный JSON с типом Go и собирает ошибки:
+// неизвестные поля, несовпадение типов и выход чисел за допустимый диапазон
+// Поля сопоставляются без учёта регистра, как в encoding/json
+// Возвращает копию значения без ошибочных частей, пригодную для json.Unmarshal
+func checkSchema(value interface{}, t reflect.Type, location string) (interface{}, []Problem) {
+	if value == nil {
+		return nil, nil
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// Типы с собственным разбором проверяем их же методом, у структур сверяем поля как обычно
+	if t.Kind() != reflect.Struct && reflect.PtrTo(t).Implements(unmarshalerType) {
+		data, _ := json.Marshal(value)
+		target := reflect.New(t).Interface().(json.Unmarshaler)
+		if err := target.UnmarshalJSON(data); err != nil {
+			return nil, []Problem{{location, err.Error()}}
+		}
+		return value, nil
+	}
+	mismatch := func(expected string) (interface{}, []Problem) {
+		return nil, []Problem{{location, fmt.Sprintf("ожидается %s, получено: %s", expected, describe(value))}}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch("объект")
+		}
+		return checkStruct(object, t, location)
+	case reflect.Slice:
+		array, ok := value.([]interface{})
+		if !ok {
+			return mismatch("массив")
+		}
+		cleaned := make([]interface{}, len(array))
+		problems := []Problem{}
+		for i, item := range array {
+			var itemProblems []Problem
+			cleaned[i], itemProblems = checkSchema(item, t.Elem(), fmt.Sprintf("%s[%d]", location, i))
+			problems = append(problems, itemProblems...)
+		}
+		return cleaned, problems
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch("объект")
+		}
+		cleaned := make(map[string]interface{})
+		problems := []Problem{}
+		for _, key := range sortedKeys(object) {
+			itemLocation := fmt.Sprintf("%s.%s", location, key)
+			switch t.Key().Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				if _, err := strconv.ParseInt(key, 10, t.Key().Bits()); err != nil {
+					problems = append(problems, Problem{itemLocation, "ключ должен быть целым числом"})
+					continue
+				}
+			}
+			item, itemProblems := checkSchema(object[key], t.Elem(), itemLocation)
+			if item != nil {
+				cleaned[key] = item
+			}
+			problems = append(problems, itemProblems...)
+		}
+		return cleaned, problems
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			return mismatch("строка")
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			return mismatch("логическое значение")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number, ok := value.(json.Number)
+		if !ok {
+			return mismatch("целое число")
+		}
+		if _, err := strconv.ParseInt(number.String(), 10, t.Bits()); err != nil {
+			return nil, []Problem{{location, fmt.Sprintf("недопустимое целое число %s", number)}}
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := value.(json.Number); !ok {
+			return mismatch("число")
+		}
+	}
+	return value, nil
+}
+
+// checkStruct проверяет поля JSON-объекта по полям структуры
+func checkStruct(object map[string]interface{}, t reflect.Type, location string) (interface{}, []Problem) {
+	cleaned := make(map[string]interface{})
+	problems := []Problem{}
+	for _, key := range sortedKeys(object) {
+		itemLocation := key
+		if location != "" {
+			itemLocation = location + "." + key
+		}
+		field, found := findField(t, key)
+		if !found {
+			problems = append(problems, Problem{itemLocation, "неизвестное поле"})
+			continue
+		}
+		// Поле с тегом schema:"list" принимает как одно значение, так и список значений
+		fieldType := field.Type
+		if _, isList := object[key].([]interface{}); isList && field.Tag.Get("schema") == "list" {
+			fieldType = reflect.SliceOf(field.Type)
+		}
+		item, itemProblems := checkSchema(object[key], fieldType, itemLocation)
+		if item != nil {
+			cleaned[key] = item
+		}
+		problems = append(problems, itemProblems...)
+	}
+	return cleaned, problems
+}
+
+// findField ищет поле структуры по имени из JSON без учёта регистра
+func findField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if name, ok := jsonName(field); ok && strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// sortedKeys возвращает ключи объекта по алфавиту, чтобы порядок ошибок был стабильным
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
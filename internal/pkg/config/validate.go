@@ -0,0 +1,375 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"platform-service-bus/internal/pkg/jsonpath"
+	"platform-service-bus/internal/pkg/rule"
+	"platform-service-bus/internal/pkg/secret"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Problem описывает ошибку конфигурации и её расположение
+type Problem struct {
+	// Location - путь к значению в конфигурации, например adapters[0].rules[1].to.data-file
+	Location string
+	Message  string
+}
+
+// String возвращает описание ошибки вместе с расположением
+func (problem Problem) String() string {
+	if problem.Location == "" {
+		return problem.Message
+	}
+	return fmt.Sprintf("%s: %s", problem.Location, problem.Message)
+}
+
+// ValidationError содержит все ошибки, найденные при проверке конфигурации
+type ValidationError struct {
+	Problems []Problem
+}
+
+// Error объединяет все ошибки в одну строку
+func (err *ValidationError) Error() string {
+	messages := []string{}
+	for _, problem := range err.Problems {
+		messages = append(messages, problem.String())
+	}
+	return fmt.Sprintf("некорректная конфигурация: %s", strings.Join(messages, "; "))
+}
+
+// Validate загружает указанный файл конфигурации и проверяет его
+// Неизвестные поля, ошибки типов и смысловые ошибки собираются в ValidationError
+func Validate(configPath string, opts ...interface{}) (Config, error) {
+	reader := ioutil.ReadFile
+	if len(opts) > 0 {
+		reader = opts[0].(fileReader)
+	}
+	config := Config{}
+	configData, err := reader(configPath)
+	if err != nil {
+		return config, err
+	}
+	// Подставляем переменные окружения и файлы секретов
+	configData, secrets, expandProblems := expand(configData)
+	if len(expandProblems) > 0 {
+		return config, &ValidationError{expandProblems}
+	}
+	secret.Add(secrets...)
+	// Сначала сверяем JSON со структурой конфигурации
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(configData))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return config, &ValidationError{[]Problem{{"", fmt.Sprintf("некорректный JSON: %v", err)}}}
+	}
+	cleaned, problems := checkSchema(document, reflect.TypeOf(config), "")
+	// Смысл значений проверяем на документе без ошибочных частей, чтобы сообщить обо всех ошибках сразу
+	cleanedData, _ := json.Marshal(cleaned)
+	if err := json.Unmarshal(cleanedData, &config); err != nil {
+		problems = append(problems, Problem{"", err.Error()})
+	} else {
+		secret.Add(config.secrets()...)
+		// Не повторяем ошибки для значений, уже отброшенных при сверке со структурой
+		reported := make(map[string]bool)
+		for _, problem := range problems {
+			reported[problem.Location] = true
+		}
+		for _, problem := range config.Check() {
+			if !reported[problem.Location] {
+				problems = append(problems, problem)
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return config, &ValidationError{problems}
+	}
+	return config, nil
+}
+
+// Check проверяет смысловую корректность конфигурации
+func (config Config) Check() []Problem {
+	problems := []Problem{}
+	ports := make(map[int]int)
+	for i, adapterObject := range config.Adapters {
+		location := fmt.Sprintf("adapters[%d]", i)
+		if adapterObject.Port < 1 || adapterObject.Port > 65535 {
+			problems = append(problems, Problem{location + ".port", fmt.Sprintf("порт %d вне диапазона 1-65535", adapterObject.Port)})
+		} else if first, prs := ports[adapterObject.Port]; prs {
+			problems = append(problems, Problem{location + ".port", fmt.Sprintf("порт %d уже используется адаптером adapters[%d]", adapterObject.Port, first)})
+		} else {
+			ports[adapterObject.Port] = i
+		}
+		for _, err := range adapterObject.Auth.Check() {
+			problems = append(problems, Problem{location + ".auth", err.Error()})
+		}
+		for _, err := range adapterObject.TLS.Check() {
+			problems = append(problems, Problem{location + ".tls", err.Error()})
+		}
+		pathTypes := make(map[string]int)
+		for j, ruleObject := range adapterObject.Rules {
+			ruleLocation := fmt.Sprintf("%s.rules[%d]", location, j)
+			problems = append(problems, config.checkRule(ruleObject, ruleLocation)...)
+			// Правила с одним путём обслуживаются одним обработчиком, поэтому тип пути должен совпадать
+			pattern, err := ruleObject.From.Pattern()
+			if err != nil {
+				continue
+			}
+			if first, prs := pathTypes[ruleObject.From.Path]; prs {
+				if other, _ := adapterObject.Rules[first].From.Pattern(); other.Type != pattern.Type {
+					problems = append(problems, Problem{ruleLocation + ".from.path-type", fmt.Sprintf("тип пути %s отличается от правила %s.rules[%d] с тем же путём", pattern.Type, location, first)})
+				}
+			} else {
+				pathTypes[ruleObject.From.Path] = j
+			}
+		}
+	}
+	names := make([]string, 0, len(config.Maps))
+	for name := range config.Maps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		location := "maps." + name
+		if err := rule.CheckMissing(config.Maps[name].Missing); err != nil {
+			problems = append(problems, Problem{location + ".missing", err.Error()})
+		}
+		if _, err := config.Maps[name].Load(); err != nil {
+			message := err.Error()
+			if os.IsNotExist(err) {
+				message = fmt.Sprintf("файл %s не найден", config.Maps[name].File)
+			}
+			problems = append(problems, Problem{location + ".file", message})
+		}
+	}
+	return problems
+}
+
+// checkRule проверяет правило адаптера
+func (config Config) checkRule(ruleObject rule.Rule, location string) []Problem {
+	problems := []Problem{}
+	add := func(itemLocation string, err error) {
+		problems = append(problems, Problem{itemLocation, err.Error()})
+	}
+	from := ruleObject.From
+	if _, err := from.Pattern(); err != nil {
+		add(location+".from.path", err)
+	}
+	conditions := map[string][]rule.Condition{
+		"query":   from.Match.Query,
+		"headers": from.Match.Headers,
+		"form":    from.Match.Form,
+		"json":    from.Match.JSON,
+	}
+	for _, kind := range []string{"query", "headers", "form", "json"} {
+		for k, condition := range conditions[kind] {
+			conditionLocation := fmt.Sprintf("%s.from.match.%s[%d]", location, kind, k)
+			if condition.Name == "" {
+				add(conditionLocation+".name", fmt.Errorf("не указано имя"))
+			}
+			if condition.Regex != "" {
+				if err := rule.CheckRegex(condition.Regex); err != nil {
+					add(conditionLocation+".regex", err)
+				}
+			}
+			if kind == "json" && condition.Name != "" {
+				if err := jsonpath.Check(condition.Name); err != nil {
+					add(conditionLocation+".name", err)
+				}
+			}
+		}
+	}
+	if from.Match.Body != "" {
+		if err := rule.CheckRegex(from.Match.Body); err != nil {
+			add(location+".from.match.body", err)
+		}
+	}
+	for _, err := range from.Auth.Check() {
+		add(location+".from.auth", err)
+	}
+	for _, prefix := range sortedNames(ruleObject.Namespaces) {
+		if ruleObject.Namespaces[prefix] == "" {
+			add(location+".namespaces."+prefix, fmt.Errorf("не указан URI пространства имён"))
+		}
+	}
+	for k, step := range ruleObject.Steps {
+		problems = append(problems, config.checkTo(step, ruleObject, fmt.Sprintf("%s.steps[%d]", location, k))...)
+	}
+	problems = append(problems, config.checkDestinations(ruleObject, location)...)
+	if ruleObject.Async {
+		// Адрес каждого адресата из списка to проверяется в checkDestinations
+		if len(ruleObject.Destinations) == 0 && ruleObject.To.URL == "" {
+			problems = append(problems, Problem{location + ".to.url", "асинхронная доставка требует адрес"})
+		}
+		if ruleObject.Response.IsSet() {
+			problems = append(problems, Problem{location + ".response", "шаблон ответа не используется при асинхронной доставке, ответ задаётся в ack"})
+		}
+	}
+	ack := ruleObject.Ack
+	if ack.Status != 0 && (ack.Status < 100 || ack.Status > 599) {
+		problems = append(problems, Problem{location + ".ack.status", fmt.Sprintf("недопустимый код ответа %d", ack.Status)})
+	}
+	problems = append(problems, config.checkHeaders(ack.Headers, ruleObject, location+".ack.headers", rule.CheckTemplate)...)
+	for _, err := range rule.CheckTemplate(ack.Data, ruleObject, config.Maps) {
+		problems = append(problems, Problem{location + ".ack.data", err.Error()})
+	}
+	response := ruleObject.Response
+	problems = append(problems, config.checkHeaders(response.Headers, ruleObject, location+".response.headers", rule.CheckResponseTemplate)...)
+	if err := rule.CheckEscape(response.Escape); err != nil {
+		problems = append(problems, Problem{location + ".response.escape", err.Error()})
+	}
+	problems = append(problems, config.checkTemplate(response.Data, response.DataFile, ruleObject, location+".response", rule.CheckResponseTemplate)...)
+	return problems
+}
+
+// checkDestinations проверяет адресата правила или список адресатов вместе с настройками fan-out
+// Каждый адресат из списка должен иметь адрес: без него fan-out отправить запрос некуда
+func (config Config) checkDestinations(ruleObject rule.Rule, location string) []Problem {
+	if len(ruleObject.Destinations) == 0 {
+		problems := config.checkTo(ruleObject.To, ruleObject, location+".to")
+		if ruleObject.FanOut.IsSet() {
+			problems = append(problems, Problem{location + ".fan-out", "fan-out применяется только к списку адресатов в to"})
+		}
+		return problems
+	}
+	problems := []Problem{}
+	names := make(map[string]int)
+	primary := -1
+	for k, to := range ruleObject.Destinations {
+		toLocation := fmt.Sprintf("%s.to[%d]", location, k)
+		if to.URL == "" {
+			problems = append(problems, Problem{toLocation + ".url", "не указан адрес"})
+		}
+		problems = append(problems, config.checkTo(to, ruleObject, toLocation)...)
+		name := to.DestinationName(k)
+		if first, prs := names[name]; prs {
+			problems = append(problems, Problem{toLocation + ".name", fmt.Sprintf("имя %q уже используется адресатом to[%d]", name, first)})
+		} else {
+			names[name] = k
+		}
+		if to.Primary {
+			if primary >= 0 {
+				problems = append(problems, Problem{toLocation + ".primary", fmt.Sprintf("основной адресат уже указан в to[%d]", primary)})
+			} else {
+				primary = k
+			}
+		}
+	}
+	for _, err := range rule.CheckFanOut(ruleObject.FanOut) {
+		problems = append(problems, Problem{location + ".fan-out", err.Error()})
+	}
+	return problems
+}
+
+// checkTo проверяет описание исходящего запроса
+func (config Config) checkTo(to rule.To, ruleObject rule.Rule, location string) []Problem {
+	problems := []Problem{}
+	if to.URL != "" {
+		if err := rule.CheckURL(to.URL); err != nil {
+			problems = append(problems, Problem{location + ".url", err.Error()})
+		} else {
+			for _, err := range rule.CheckTemplate(to.URL, ruleObject, config.Maps) {
+				problems = append(problems, Problem{location + ".url", err.Error()})
+			}
+		}
+	}
+	for _, name := range sortedNames(to.Query.Rename) {
+		if to.Query.Rename[name] == "" {
+			problems = append(problems, Problem{location + ".query.rename." + name, "не указано новое имя параметра"})
+		}
+	}
+	for _, name := range sortedNames(to.Query.Set) {
+		for _, err := range rule.CheckTemplate(to.Query.Set[name], ruleObject, config.Maps) {
+			problems = append(problems, Problem{location + ".query.set." + name, err.Error()})
+		}
+	}
+	problems = append(problems, config.checkHeaders(to.Headers, ruleObject, location+".headers", rule.CheckTemplate)...)
+	for _, err := range to.Auth.Check() {
+		problems = append(problems, Problem{location + ".auth", err.Error()})
+	}
+	for _, err := range to.TLS.Check() {
+		problems = append(problems, Problem{location + ".tls", err.Error()})
+	}
+	if err := rule.CheckEscape(to.Escape); err != nil {
+		problems = append(problems, Problem{location + ".escape", err.Error()})
+	}
+	problems = append(problems, config.checkTemplate(to.Data, to.DataFile, ruleObject, location, rule.CheckTemplate)...)
+	codes := []int{}
+	for from := range to.StatusMap {
+		codes = append(codes, from)
+	}
+	sort.Ints(codes)
+	for _, from := range codes {
+		if status := to.StatusMap[from]; status < 100 || status > 599 {
+			problems = append(problems, Problem{fmt.Sprintf("%s.status-map.%d", location, from), fmt.Sprintf("недопустимый код ответа %d", status)})
+		}
+	}
+	for k, condition := range to.RetryOn {
+		if err := rule.CheckRetryOn(condition); err != nil {
+			problems = append(problems, Problem{fmt.Sprintf("%s.retry-on[%d]", location, k), err.Error()})
+		}
+	}
+	if to.Retries < 0 {
+		problems = append(problems, Problem{location + ".retries", "количество повторов не может быть отрицательным"})
+	}
+	return problems
+}
+
+// checkHeaders проверяет, что каждый хедер имеет вид "Name: value" и содержит корректные подстановки
+// check - проверка шаблона запроса или ответа
+func (config Config) checkHeaders(headers []string, ruleObject rule.Rule, location string, check templateCheck) []Problem {
+	problems := []Problem{}
+	for k, header := range headers {
+		headerLocation := fmt.Sprintf("%s[%d]", location, k)
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			problems = append(problems, Problem{headerLocation, fmt.Sprintf("хедер %q должен иметь вид \"Name: value\"", header)})
+			continue
+		}
+		for _, err := range check(header, ruleObject, config.Maps) {
+			problems = append(problems, Problem{headerLocation, err.Error()})
+		}
+	}
+	return problems
+}
+
+// templateCheck проверяет шаблон в контексте правила: rule.CheckTemplate или rule.CheckResponseTemplate
+type templateCheck func(text string, ruleObject rule.Rule, maps map[string]rule.Map) []error
+
+// checkTemplate проверяет шаблон из строки или файла
+func (config Config) checkTemplate(data string, dataFile string, ruleObject rule.Rule, location string, check templateCheck) []Problem {
+	problems := []Problem{}
+	if dataFile != "" {
+		fileData, err := ioutil.ReadFile(dataFile)
+		if err != nil {
+			message := err.Error()
+			if os.IsNotExist(err) {
+				message = fmt.Sprintf("файл %s не найден", dataFile)
+			}
+			return append(problems, Problem{location + ".data-file", message})
+		}
+		for _, err := range check(string(fileData), ruleObject, config.Maps) {
+			problems = append(problems, Problem{location + ".data-file", fmt.Sprintf("%s: %v", dataFile, err)})
+		}
+		return problems
+	}
+	for _, err := range check(data, ruleObject, config.Maps) {
+		problems = append(problems, Problem{location + ".data", err.Error()})
+	}
+	return problems
+}
+
+// sortedNames возвращает ключи таблицы в алфавитном порядке
+func sortedNames(values map[string]string) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
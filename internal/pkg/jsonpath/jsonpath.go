@@ -0,0 +1,228 @@
+package jsonpath
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Parse разбирает JSON-документ, сохраняя числа в исходном виде
+func Parse(data []byte) (interface{}, error) {
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+// Виды шагов пути
+const (
+	stepKey = iota
+	stepIndex
+	stepWildcard
+	stepRecursive
+)
+
+// step описывает один шаг пути
+type step struct {
+	kind  int
+	key   string
+	index int
+}
+
+// compile разбирает путь вида $.message.to, $.items[0].id, $.items[*].id, $['key'] или $..id
+func compile(path string) ([]step, error) {
+	path = strings.TrimSpace(path)
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("путь %q должен начинаться с $", path)
+	}
+	steps := []step{}
+	rest := path[1:]
+	for len(rest) > 0 {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			key, tail := splitKey(rest[2:])
+			if key == "" {
+				return nil, fmt.Errorf("пустой ключ после .. в пути %q", path)
+			}
+			steps = append(steps, step{kind: stepRecursive, key: key})
+			rest = tail
+		case rest[0] == '.':
+			key, tail := splitKey(rest[1:])
+			switch key {
+			case "":
+				return nil, fmt.Errorf("пустой ключ в пути %q", path)
+			case "*":
+				steps = append(steps, step{kind: stepWildcard})
+			default:
+				steps = append(steps, step{kind: stepKey, key: key})
+			}
+			rest = tail
+		case rest[0] == '[':
+			parsed, tail, err := parseBracket(rest)
+			if err != nil {
+				return nil, fmt.Errorf("путь %q: %v", path, err)
+			}
+			steps = append(steps, parsed)
+			rest = tail
+		default:
+			return nil, fmt.Errorf("недопустимый символ %q в пути %q", rest[0], path)
+		}
+	}
+	return steps, nil
+}
+
+// Check проверяет синтаксис пути
+func Check(path string) error {
+	_, err := compile(path)
+	return err
+}
+
+// splitKey отделяет ключ до следующей точки или скобки
+func splitKey(text string) (string, string) {
+	end := strings.IndexAny(text, ".[")
+	if end == -1 {
+		return text, ""
+	}
+	return text[:end], text[end:]
+}
+
+// parseBracket разбирает шаг в квадратных скобках: [0], [-1], [*], ['key'] или ["key"]
+func parseBracket(text string) (step, string, error) {
+	if len(text) > 1 && (text[1] == '\'' || text[1] == '"') {
+		quote := text[1]
+		end := strings.IndexByte(text[2:], quote)
+		if end == -1 || len(text) < end+4 || text[end+3] != ']' {
+			return step{}, "", fmt.Errorf("незакрытый ключ в кавычках")
+		}
+		return step{kind: stepKey, key: text[2 : end+2]}, text[end+4:], nil
+	}
+	end := strings.IndexByte(text, ']')
+	if end == -1 {
+		return step{}, "", fmt.Errorf("незакрытая скобка")
+	}
+	inner := strings.TrimSpace(text[1:end])
+	if inner == "*" {
+		return step{kind: stepWildcard}, text[end+1:], nil
+	}
+	index, err := strconv.Atoi(inner)
+	if err != nil {
+		return step{}, "", fmt.Errorf("недопустимый индекс %q", inner)
+	}
+	return step{kind: stepIndex, index: index}, text[end+1:], nil
+}
+
+// GetAll возвращает все значения, найденные по пути в разобранном документе
+func GetAll(document interface{}, path string) ([]interface{}, error) {
+	steps, err := compile(path)
+	if err != nil {
+		return nil, err
+	}
+	current := []interface{}{document}
+	for _, s := range steps {
+		next := []interface{}{}
+		for _, value := range current {
+			next = append(next, apply(s, value)...)
+		}
+		current = next
+	}
+	return current, nil
+}
+
+// Get возвращает первое значение по пути
+// Второе значение сообщает, найдено ли значение
+func Get(document interface{}, path string) (interface{}, bool, error) {
+	values, err := GetAll(document, path)
+	if err != nil || len(values) == 0 {
+		return nil, false, err
+	}
+	return values[0], true, nil
+}
+
+// apply применяет шаг пути к значению
+func apply(s step, value interface{}) []interface{} {
+	switch s.kind {
+	case stepKey:
+		if object, ok := value.(map[string]interface{}); ok {
+			if child, prs := object[s.key]; prs {
+				return []interface{}{child}
+			}
+		}
+	case stepIndex:
+		if array, ok := value.([]interface{}); ok {
+			index := s.index
+			if index < 0 {
+				index += len(array)
+			}
+			if index >= 0 && index < len(array) {
+				return []interface{}{array[index]}
+			}
+		}
+	case stepWildcard:
+		return children(value)
+	case stepRecursive:
+		result := []interface{}{}
+		if object, ok := value.(map[string]interface{}); ok {
+			if child, prs := object[s.key]; prs {
+				result = append(result, child)
+			}
+		}
+		for _, child := range children(value) {
+			result = append(result, apply(s, child)...)
+		}
+		return result
+	}
+	return nil
+}
+
+// children возвращает элементы массива или значения объекта в порядке ключей
+func children(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		return v
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		result := make([]interface{}, 0, len(v))
+		for _, key := range keys {
+			result = append(result, v[key])
+		}
+		return result
+	}
+	return nil
+}
+
+// IsString сообщает, является ли значение JSON-строкой
+func IsString(value interface{}) bool {
+	_, ok := value.(string)
+	return ok
+}
+
+// String возвращает текстовое представление значения
+// Строки возвращаются без кавычек, объекты и массивы - в виде JSON
+func String(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		var buffer bytes.Buffer
+		encoder := json.NewEncoder(&buffer)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(v)
+		return strings.TrimSuffix(buffer.String(), "\n")
+	}
+}
@@ -0,0 +1,143 @@
+package jsonpath
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	document, err := Parse([]byte(`{"message": {"to": "79001234567", "count": 2, "flags": [true, false], "meta": {"a": 1}}}`))
+	if err != nil {
+		t.Fatalf("Ошибка разбора документа: %v", err)
+	}
+	table := []struct {
+		name          string
+		path          string
+		expected      string
+		expectedFound bool
+		expectedError bool
+	}{
+		{
+			name:          "Вложенный ключ",
+			path:          "$.message.to",
+			expected:      "79001234567",
+			expectedFound: true,
+		},
+		{
+			name:          "Число без изменения формата",
+			path:          "$.message.count",
+			expected:      "2",
+			expectedFound: true,
+		},
+		{
+			name:          "Элемент массива",
+			path:          "$.message.flags[1]",
+			expected:      "false",
+			expectedFound: true,
+		},
+		{
+			name:          "Отрицательный индекс",
+			path:          "$.message.flags[-1]",
+			expected:      "false",
+			expectedFound: true,
+		},
+		{
+			name:          "Объект в виде JSON",
+			path:          "$.message.meta",
+			expected:      `{"a":1}`,
+			expectedFound: true,
+		},
+		{
+			name:          "Отсутствующий ключ",
+			path:          "$.message.from",
+			expectedFound: false,
+		},
+		{
+			name:          "Путь без $",
+			path:          "message.to",
+			expectedError: true,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			value, found, err := Get(document, item.path)
+			if item.expectedError {
+				if err == nil {
+					t.Errorf("Expected an error, got %v", value)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Expected nil, got %v", err)
+			}
+			if found != item.expectedFound {
+				t.Errorf("Неверный признак наличия. Expected %v, got %v", item.expectedFound, found)
+			}
+			if found && String(value) != item.expected {
+				t.Errorf("Неверное значение. Expected %v, got %v", item.expected, String(value))
+			}
+		})
+	}
+}
+
+func TestGetAll(t *testing.T) {
+	document, err := Parse([]byte(`{"messages": [{"to": "7900", "id": 1}, {"to": "7901", "id": 2}], "meta": {"first key": {"id": 3}}}`))
+	if err != nil {
+		t.Fatalf("Ошибка разбора документа: %v", err)
+	}
+	table := []struct {
+		name          string
+		path          string
+		expected      []string
+		expectedError bool
+	}{
+		{
+			name:     "Все элементы массива",
+			path:     "$.messages[*].to",
+			expected: []string{"7900", "7901"},
+		},
+		{
+			name:     "Ключ в кавычках",
+			path:     "$.meta['first key'].id",
+			expected: []string{"3"},
+		},
+		{
+			name:     "Рекурсивный поиск",
+			path:     "$..id",
+			expected: []string{"1", "2", "3"},
+		},
+		{
+			name:     "Значения объекта",
+			path:     "$.messages[0].*",
+			expected: []string{"1", "7900"},
+		},
+		{
+			name:     "Нет совпадений",
+			path:     "$.messages[5].to",
+			expected: []string{},
+		},
+		{
+			name:          "Незакрытая скобка",
+			path:          "$.messages[0",
+			expectedError: true,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			values, err := GetAll(document, item.path)
+			if item.expectedError {
+				if err == nil {
+					t.Errorf("Expected an error, got %v", values)
+				}
+				return
+			}
+			got := []string{}
+			for _, value := range values {
+				got = append(got, String(value))
+			}
+			if strings.Join(got, ",") != strings.Join(item.expected, ",") {
+				t.Errorf("Неверные значения. Expected %v, got %v", item.expected, got)
+			}
+		})
+	}
+}
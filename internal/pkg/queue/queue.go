@@ -0,0 +1,218 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDir - корневой каталог очередей по умолчанию
+const DefaultDir = "queue"
+
+// Message - подготовленный исходящий запрос, ожидающий доставки
+type Message struct {
+	ID string
+	// Rule - номер правила в адаптере, из которого берутся таймаут, повторы, TLS и аутентификация
+	Rule int
+	// Path - входящий путь правила, по нему проверяется, что номер правила не устарел
+	Path string
+	// Destination - номер адресата в списке to правила
+	Destination int `json:",omitempty"`
+	Method      string
+	URL         string
+	Headers     []string
+	Body        []byte
+	// Attempts - количество выполненных попыток доставки
+	Attempts int
+	Created  time.Time
+	// Next - время следующей попытки
+	Next time.Time
+	// Status и Error - результат последней попытки
+	Status int    `json:",omitempty"`
+	Error  string `json:",omitempty"`
+	// Failed - время переноса в очередь недоставленных
+	Failed time.Time
+}
+
+// Queue хранит сообщения в каталоге, по одному JSON-файлу на сообщение
+// Файлы записываются атомарно, поэтому очередь переживает перезапуск процесса
+// и может обрабатываться из нескольких процессов
+type Queue struct {
+	dir string
+}
+
+// New создаёт очередь в каталоге dir, каталог создаётся при первой записи
+func New(dir string) *Queue {
+	return &Queue{dir: dir}
+}
+
+// Dir возвращает каталог очереди
+func (queue *Queue) Dir() string {
+	return queue.dir
+}
+
+// Pending возвращает очередь сообщений адаптера, ожидающих доставки
+func Pending(root string, port int) *Queue {
+	return New(filepath.Join(root, strconv.Itoa(port), "pending"))
+}
+
+// Dead возвращает очередь недоставленных сообщений адаптера
+func Dead(root string, port int) *Queue {
+	return New(filepath.Join(root, strconv.Itoa(port), "dead"))
+}
+
+// Ports возвращает порты адаптеров, для которых в root есть очереди
+func Ports(root string) ([]int, error) {
+	files, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ports := []int{}
+	for _, file := range files {
+		if port, err := strconv.Atoi(file.Name()); err == nil && file.IsDir() {
+			ports = append(ports, port)
+		}
+	}
+	sort.Ints(ports)
+	return ports, nil
+}
+
+// extension - расширение файлов сообщений
+const extension = ".json"
+
+// newID возвращает идентификатор, упорядочивающий сообщения по времени создания
+func newID() string {
+	return fmt.Sprintf("%019d-%08x", time.Now().UnixNano(), rand.Uint32())
+}
+
+// path возвращает путь к файлу сообщения
+// Идентификатор не может указывать за пределы каталога очереди
+func (queue *Queue) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("некорректный идентификатор сообщения %q", id)
+	}
+	return filepath.Join(queue.dir, id+extension), nil
+}
+
+// Put сохраняет сообщение, новому сообщению присваивается идентификатор
+func (queue *Queue) Put(message *Message) error {
+	if message.ID == "" {
+		message.ID = newID()
+	}
+	if message.Created.IsZero() {
+		message.Created = time.Now()
+	}
+	target, err := queue.path(message.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(message, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(queue.dir, 0700); err != nil {
+		return err
+	}
+	// TempFile создаёт файл с правами 0600: сообщения содержат подставленные секреты хедеров
+	temp, err := ioutil.TempFile(queue.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Rename(temp.Name(), target)
+}
+
+// Get читает сообщение по идентификатору
+func (queue *Queue) Get(id string) (*Message, error) {
+	source, err := queue.path(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		return nil, err
+	}
+	message := &Message{}
+	if err := json.Unmarshal(data, message); err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	return message, nil
+}
+
+// Delete удаляет сообщение, отсутствие сообщения ошибкой не считается
+func (queue *Queue) Delete(id string) error {
+	target, err := queue.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// IDs возвращает идентификаторы сообщений в порядке создания
+func (queue *Queue) IDs() ([]string, error) {
+	files, err := ioutil.ReadDir(queue.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, file := range files {
+		name := file.Name()
+		if !file.IsDir() && !strings.HasPrefix(name, ".") && strings.HasSuffix(name, extension) {
+			ids = append(ids, strings.TrimSuffix(name, extension))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// List возвращает все сообщения в порядке создания
+// Сообщения, удалённые во время чтения, и повреждённые файлы пропускаются
+func (queue *Queue) List() ([]*Message, error) {
+	ids, err := queue.IDs()
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*Message, 0, len(ids))
+	for _, id := range ids {
+		message, err := queue.Get(id)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Errorf("Пропускаем сообщение очереди: %v", err)
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
@@ -0,0 +1,102 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueue(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+	queue := New(filepath.Join(dir, "8080", "pending"))
+
+	messages, err := queue.List()
+	if err != nil || len(messages) != 0 {
+		t.Fatalf("Пустая очередь без каталога. Expected no messages, got %v, %v", messages, err)
+	}
+	first := &Message{URL: "http://example.com/1", Body: []byte(`{"a": 1}`)}
+	second := &Message{URL: "http://example.com/2"}
+	for _, message := range []*Message{first, second} {
+		if err := queue.Put(message); err != nil {
+			t.Fatalf("Ошибка записи. Expected nil, got %v", err)
+		}
+	}
+	first.Attempts = 2
+	if err := queue.Put(first); err != nil {
+		t.Fatalf("Ошибка перезаписи. Expected nil, got %v", err)
+	}
+	// Сообщения содержат подставленные секреты, поэтому доступны только владельцу
+	if info, err := os.Stat(filepath.Join(queue.Dir(), first.ID+".json")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Неверные права файла сообщения: %v, %v", info, err)
+	}
+	ioutil.WriteFile(filepath.Join(queue.Dir(), "broken.json"), []byte("{"), 0600)
+
+	table := []struct {
+		name          string
+		action        func() ([]*Message, error)
+		expectedURLs  []string
+		expectedError bool
+	}{
+		{
+			name:         "Сообщения в порядке создания, повреждённые пропускаются",
+			action:       queue.List,
+			expectedURLs: []string{"http://example.com/1", "http://example.com/2"},
+		},
+		{
+			name: "Чтение по идентификатору",
+			action: func() ([]*Message, error) {
+				message, err := queue.Get(first.ID)
+				if err == nil && (message.Attempts != 2 || string(message.Body) != `{"a": 1}`) {
+					t.Errorf("Неверное сообщение: %+v", message)
+				}
+				return []*Message{message}, err
+			},
+			expectedURLs: []string{"http://example.com/1"},
+		},
+		{
+			name: "Удаление",
+			action: func() ([]*Message, error) {
+				if err := queue.Delete(first.ID); err != nil {
+					return nil, err
+				}
+				if err := queue.Delete(first.ID); err != nil {
+					return nil, err
+				}
+				return queue.List()
+			},
+			expectedURLs: []string{"http://example.com/2"},
+		},
+		{
+			name: "Идентификатор за пределами каталога",
+			action: func() ([]*Message, error) {
+				message, err := queue.Get("../../secret")
+				return []*Message{message}, err
+			},
+			expectedError: true,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			messages, err := item.action()
+			if item.expectedError {
+				if err == nil {
+					t.Errorf("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected nil, got %v", err)
+			}
+			if len(messages) != len(item.expectedURLs) {
+				t.Fatalf("Expected %d messages, got %d", len(item.expectedURLs), len(messages))
+			}
+			for i, message := range messages {
+				if message.URL != item.expectedURLs[i] {
+					t.Errorf("Expected %q, got %q", item.expectedURLs[i], message.URL)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Типы сопоставления пути
+const (
+	// Exact - путь запроса должен полностью совпадать с шаблоном
+	Exact = "exact"
+	// Prefix - путь запроса должен начинаться с сегментов шаблона
+	Prefix = "prefix"
+)
+
+// Виды сегментов шаблона в порядке убывания приоритета
+const (
+	literalSegment = iota
+	paramSegment
+	anySegment
+	restSegment
+)
+
+// segment описывает сегмент шаблона пути
+type segment struct {
+	kind  int
+	value string
+}
+
+// Pattern - разобранный шаблон пути вида /users/{id}/sms
+type Pattern struct {
+	Path     string
+	Type     string
+	segments []segment
+}
+
+// Compile разбирает шаблон пути
+// {name} захватывает один сегмент, * - любой один сегмент без захвата,
+// {name*} в конце шаблона захватывает остаток пути
+// Если тип не указан, путь с / на конце сопоставляется по префиксу, остальные - точно
+func Compile(path string, pathType string) (*Pattern, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("путь %q должен начинаться с /", path)
+	}
+	if pathType == "" {
+		pathType = Exact
+		if strings.HasSuffix(path, "/") {
+			pathType = Prefix
+		}
+	}
+	if pathType != Exact && pathType != Prefix {
+		return nil, fmt.Errorf("неизвестный тип пути %q, ожидается %s или %s", pathType, Exact, Prefix)
+	}
+	pattern := &Pattern{Path: path, Type: pathType}
+	names := make(map[string]bool)
+	parts := split(path)
+	for i, part := range parts {
+		var parsed segment
+		switch {
+		case part == "":
+			return nil, fmt.Errorf("путь %q содержит пустой сегмент", path)
+		case part == "*":
+			parsed = segment{kind: anySegment}
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+			parsed = segment{kind: paramSegment, value: name}
+			if strings.HasSuffix(name, "*") {
+				if i != len(parts)-1 {
+					return nil, fmt.Errorf("параметр %s должен быть последним сегментом пути", part)
+				}
+				parsed = segment{kind: restSegment, value: strings.TrimSuffix(name, "*")}
+			}
+			if !validName(parsed.value) {
+				return nil, fmt.Errorf("недопустимое имя параметра пути %s", part)
+			}
+			if names[parsed.value] {
+				return nil, fmt.Errorf("параметр пути %s повторяется", parsed.value)
+			}
+			names[parsed.value] = true
+		case strings.ContainsAny(part, "{}"):
+			return nil, fmt.Errorf("сегмент %q: параметр должен занимать весь сегмент", part)
+		default:
+			parsed = segment{kind: literalSegment, value: part}
+		}
+		pattern.segments = append(pattern.segments, parsed)
+	}
+	return pattern, nil
+}
+
+// validName проверяет, что имя параметра состоит из букв, цифр, _ и -
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, char := range name {
+		if !(char == '_' || char == '-' || char >= '0' && char <= '9' || char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// split делит путь на сегменты без начального и конечного /
+func split(path string) []string {
+	trimmed := strings.Trim(path, "/")
+	if trimmed == "" {
+		return nil
+	}
+	return strings.Split(trimmed, "/")
+}
+
+// Params возвращает имена параметров шаблона
+func (pattern *Pattern) Params() []string {
+	names := []string{}
+	for _, s := range pattern.segments {
+		if s.kind == paramSegment || s.kind == restSegment {
+			names = append(names, s.value)
+		}
+	}
+	return names
+}
+
+// Match сопоставляет экранированный путь запроса с шаблоном и возвращает значения параметров
+func (pattern *Pattern) Match(escapedPath string) (map[string]string, bool) {
+	parts := split(escapedPath)
+	params := make(map[string]string)
+	for i, s := range pattern.segments {
+		if s.kind == restSegment {
+			from := i
+			if from > len(parts) {
+				from = len(parts)
+			}
+			rest, err := url.PathUnescape(strings.Join(parts[from:], "/"))
+			if err != nil {
+				return nil, false
+			}
+			params[s.value] = rest
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		part, err := url.PathUnescape(parts[i])
+		if err != nil || part == "" {
+			return nil, false
+		}
+		switch s.kind {
+		case literalSegment:
+			if part != s.value {
+				return nil, false
+			}
+		case paramSegment:
+			params[s.value] = part
+		}
+	}
+	if len(parts) > len(pattern.segments) && pattern.Type != Prefix {
+		return nil, false
+	}
+	return params, true
+}
+
+// before сообщает, должен ли шаблон проверяться раньше другого
+// Литералы важнее параметров, длинные шаблоны важнее коротких, точные - важнее префиксных
+func (pattern *Pattern) before(other *Pattern) bool {
+	for i := 0; i < len(pattern.segments) && i < len(other.segments); i++ {
+		if left, right := pattern.segments[i].kind, other.segments[i].kind; left != right {
+			return left < right
+		}
+	}
+	if len(pattern.segments) != len(other.segments) {
+		return len(pattern.segments) > len(other.segments)
+	}
+	return pattern.Type == Exact && other.Type == Prefix
+}
+
+// route связывает шаблон пути с обработчиком
+type route struct {
+	pattern *Pattern
+	handler http.Handler
+}
+
+// Router выбирает обработчик по шаблонам путей
+type Router struct {
+	routes []route
+}
+
+// New создаёт пустой маршрутизатор
+func New() *Router {
+	return &Router{}
+}
+
+// Handle регистрирует обработчик для шаблона пути
+func (router *Router) Handle(pattern *Pattern, handler http.Handler) {
+	router.routes = append(router.routes, route{pattern, handler})
+	sort.SliceStable(router.routes, func(i, j int) bool {
+		return router.routes[i].pattern.before(router.routes[j].pattern)
+	})
+}
+
+// ServeHTTP передаёт запрос обработчику наиболее точного подходящего шаблона
+// Значения параметров пути доступны через Params
+func (router *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	for _, r := range router.routes {
+		if params, ok := r.pattern.Match(req.URL.EscapedPath()); ok {
+			r.handler.ServeHTTP(w, WithParams(req, params))
+			return
+		}
+	}
+	http.NotFound(w, req)
+}
+
+// paramsKey - ключ параметров пути в контексте запроса
+type paramsKey struct{}
+
+// WithParams возвращает копию запроса с параметрами пути в контексте
+func WithParams(req *http.Request, params map[string]string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), paramsKey{}, params))
+}
+
+// Params возвращает параметры пути, найденные маршрутизатором
+func Params(req *http.Request) map[string]string {
+	params, _ := req.Context().Value(paramsKey{}).(map[string]string)
+	return params
+}
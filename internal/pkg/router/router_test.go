@@ -0,0 +1,138 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	table := []struct {
+		name           string
+		path           string
+		pathType       string
+		requestPath    string
+		expectedMatch  bool
+		expectedParams string
+	}{
+		{
+			name:           "Параметр пути",
+			path:           "/users/{id}/sms",
+			requestPath:    "/users/42/sms",
+			expectedMatch:  true,
+			expectedParams: "map[id:42]",
+		},
+		{
+			name:          "Точный путь не совпадает с более длинным",
+			path:          "/users/{id}/sms",
+			requestPath:   "/users/42/sms/1",
+			expectedMatch: false,
+		},
+		{
+			name:          "Пустой параметр не совпадает",
+			path:          "/users/{id}",
+			requestPath:   "/users/",
+			expectedMatch: false,
+		},
+		{
+			name:           "Путь с / на конце совпадает по префиксу",
+			path:           "/dlr/",
+			requestPath:    "/dlr/world-sms/1",
+			expectedMatch:  true,
+			expectedParams: "map[]",
+		},
+		{
+			name:          "Префикс сравнивается по сегментам",
+			path:          "/dlr",
+			pathType:      Prefix,
+			requestPath:   "/dlrx",
+			expectedMatch: false,
+		},
+		{
+			name:           "Любой сегмент",
+			path:           "/*/sms",
+			requestPath:    "/v2/sms",
+			expectedMatch:  true,
+			expectedParams: "map[]",
+		},
+		{
+			name:           "Остаток пути",
+			path:           "/files/{rest*}",
+			requestPath:    "/files/a/b%2Fc",
+			expectedMatch:  true,
+			expectedParams: "map[rest:a/b/c]",
+		},
+		{
+			name:           "Экранированный параметр",
+			path:           "/users/{id}",
+			requestPath:    "/users/a%20b",
+			expectedMatch:  true,
+			expectedParams: "map[id:a b]",
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			pattern, err := Compile(item.path, item.pathType)
+			if err != nil {
+				t.Fatalf("Ошибка разбора шаблона. Expected nil, got %v", err)
+			}
+			params, ok := pattern.Match(item.requestPath)
+			if ok != item.expectedMatch {
+				t.Fatalf("Неверное сопоставление. Expected %v, got %v", item.expectedMatch, ok)
+			}
+			if ok && fmt.Sprint(params) != item.expectedParams {
+				t.Errorf("Неверные параметры. Expected %v, got %v", item.expectedParams, params)
+			}
+		})
+	}
+}
+
+func TestRouter(t *testing.T) {
+	mux := New()
+	for _, path := range []string{"/", "/users/{id}", "/users/me", "/users/{id}/", "/files/{rest*}"} {
+		pattern, err := Compile(path, "")
+		if err != nil {
+			t.Fatalf("Ошибка разбора шаблона %s: %v", path, err)
+		}
+		path := path
+		mux.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, "%s %v", path, Params(req))
+		}))
+	}
+	table := []struct {
+		name        string
+		requestPath string
+		expected    string
+	}{
+		{
+			name:        "Литерал важнее параметра",
+			requestPath: "/users/me",
+			expected:    "/users/me map[]",
+		},
+		{
+			name:        "Точный путь с параметром",
+			requestPath: "/users/42",
+			expected:    "/users/{id} map[id:42]",
+		},
+		{
+			name:        "Более длинный префикс",
+			requestPath: "/users/42/sms",
+			expected:    "/users/{id}/ map[id:42]",
+		},
+		{
+			name:        "Корневой префикс",
+			requestPath: "/other",
+			expected:    "/ map[]",
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, httptest.NewRequest("GET", item.requestPath, nil))
+			if recorder.Body.String() != item.expected {
+				t.Errorf("Неверный обработчик. Expected %q, got %q", item.expected, recorder.Body.String())
+			}
+		})
+	}
+}
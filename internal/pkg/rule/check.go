@@ -0,0 +1,263 @@
+package rule
+
+import (
+	"fmt"
+	"net/url"
+	"platform-service-bus/internal/pkg/jsonpath"
+	"platform-service-bus/internal/pkg/template"
+	"platform-service-bus/internal/pkg/xpath"
+	"strconv"
+)
+
+// placeholderArgs количество аргументов в квадратных скобках для каждой подстановки
+var placeholderArgs = map[string]int{
+	"BODY":             0,
+	"QUERY":            1,
+	"FORM":             1,
+	"HEADER":           1,
+	"COOKIE":           1,
+	"ENV":              1,
+	"PATH":             1,
+	"METHOD":           0,
+	"REMOTE_ADDR":      0,
+	"REGEX":            2,
+	"MAP":              2,
+	"JSON":             1,
+	"XPATH":            1,
+	"UPSTREAM_BODY":    0,
+	"UPSTREAM_STATUS":  0,
+	"UPSTREAM_HEADER":  1,
+	"UPSTREAM_REGEX":   2,
+	"UPSTREAM_XPATH":   1,
+	"UPSTREAM":         1,
+	template.ItemName:  0,
+	template.IndexName: 0,
+}
+
+// Регистрируем имена подстановок: теги с другими именами, например %D0% в URL-кодированном тексте, остаются текстом
+func init() {
+	for name := range placeholderArgs {
+		template.RegisterPlaceholder(name)
+	}
+}
+
+// upstreamSubArgs количество аргументов уточнений подстановки %UPSTREAM[name].SUB%
+var upstreamSubArgs = map[string]int{
+	"BODY":   0,
+	"STATUS": 0,
+	"HEADER": 1,
+	"JSON":   1,
+	"XPATH":  1,
+	"REGEX":  2,
+}
+
+// optionalArgs подстановки, аргументы которых можно не указывать
+var optionalArgs = map[string]bool{
+	"PATH": true,
+}
+
+// CheckTemplate проверяет синтаксис и подстановки шаблона запроса в контексте правила
+// Возвращает ошибки для неизвестных подстановок, неверного числа аргументов,
+// некорректных регулярных выражений, XPath с необъявленными префиксами
+// параметров пути, которых нет в from.path, и неизвестных таблиц соответствия
+// Подстановки из ответа вышестоящего сервиса в шаблоне запроса недоступны
+func CheckTemplate(text string, rule Rule, maps map[string]Map) []error {
+	return checkTemplate(text, rule, maps, false)
+}
+
+// CheckResponseTemplate проверяет шаблон ответа клиенту, как CheckTemplate,
+// но разрешает подстановки из ответа вышестоящего сервиса
+func CheckResponseTemplate(text string, rule Rule, maps map[string]Map) []error {
+	return checkTemplate(text, rule, maps, true)
+}
+
+// checkTemplate проверяет шаблон, response разрешает подстановки %UPSTREAM...%
+func checkTemplate(text string, rule Rule, maps map[string]Map, response bool) []error {
+	parsed, err := template.Parse(text)
+	if err != nil {
+		return []error{err}
+	}
+	errs := []error{}
+	for _, placeholder := range parsed.Placeholders() {
+		expected := placeholderArgs[placeholder.Name]
+		if len(placeholder.Args) != expected && !(optionalArgs[placeholder.Name] && len(placeholder.Args) == 0) {
+			errs = append(errs, fmt.Errorf("подстановка %s: ожидается аргументов: %d, указано: %d", placeholder, expected, len(placeholder.Args)))
+			continue
+		}
+		if upstreamPlaceholders[placeholder.Name] && !response {
+			errs = append(errs, fmt.Errorf("подстановка %s доступна только в шаблоне ответа", placeholder))
+			continue
+		}
+		if placeholder.Sub != nil && placeholder.Name != "UPSTREAM" {
+			errs = append(errs, fmt.Errorf("подстановка %s не поддерживает уточнение", placeholder))
+			continue
+		}
+		if placeholder.Name == "UPSTREAM" {
+			if err := checkUpstream(placeholder, rule); err != nil {
+				errs = append(errs, fmt.Errorf("подстановка %s: %v", placeholder, err))
+			}
+		}
+		if placeholder.Name == "JSON" {
+			if err := jsonpath.Check(placeholder.Arg(0)); err != nil {
+				errs = append(errs, fmt.Errorf("подстановка %s: %v", placeholder, err))
+			}
+		}
+		if placeholder.Name == "MAP" {
+			if _, prs := maps[placeholder.Arg(0)]; !prs {
+				errs = append(errs, fmt.Errorf("подстановка %s: таблица %s не найдена", placeholder, placeholder.Arg(0)))
+			}
+			for _, err := range checkTemplate(placeholder.Arg(1), rule, maps, response) {
+				errs = append(errs, fmt.Errorf("подстановка %s: %v", placeholder, err))
+			}
+		}
+		if placeholder.Name == "PATH" && len(placeholder.Args) == 1 {
+			if err := checkPathParam(placeholder.Arg(0), rule.From); err != nil {
+				errs = append(errs, fmt.Errorf("подстановка %s: %v", placeholder, err))
+			}
+		}
+		if placeholder.Name == "XPATH" || placeholder.Name == "UPSTREAM_XPATH" {
+			if err := CheckXPath(placeholder.Arg(0), rule.Namespaces); err != nil {
+				errs = append(errs, fmt.Errorf("подстановка %s: %v", placeholder, err))
+			}
+		}
+		if placeholder.Name == "REGEX" || placeholder.Name == "UPSTREAM_REGEX" {
+			if err := CheckRegex(placeholder.Arg(0)); err != nil {
+				errs = append(errs, fmt.Errorf("подстановка %s: %v", placeholder, err))
+			}
+			if _, err := strconv.Atoi(placeholder.Arg(1)); err != nil {
+				errs = append(errs, fmt.Errorf("подстановка %s: индекс группы должен быть числом", placeholder))
+			}
+		}
+	}
+	// Теги с незарегистрированным именем остаются текстом, но с аргументами это скорее опечатка
+	for _, placeholder := range parsed.Unknown() {
+		errs = append(errs, fmt.Errorf("неизвестная подстановка %s", placeholder))
+	}
+	return errs
+}
+
+// checkUpstream проверяет, что адресат подстановки %UPSTREAM[name].SUB% есть в to, и само уточнение
+func checkUpstream(placeholder *template.Placeholder, rule Rule) error {
+	found := false
+	for k, to := range rule.Targets() {
+		if to.DestinationName(k) == placeholder.Arg(0) {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("адресат %q не найден в to", placeholder.Arg(0))
+	}
+	sub := placeholder.Sub
+	if sub == nil {
+		return nil
+	}
+	expected, known := upstreamSubArgs[sub.Name]
+	if !known {
+		return fmt.Errorf("неизвестное уточнение %s", sub.Name)
+	}
+	if len(sub.Args) != expected {
+		return fmt.Errorf("уточнение %s: ожидается аргументов: %d, указано: %d", sub.Name, expected, len(sub.Args))
+	}
+	switch sub.Name {
+	case "JSON":
+		return jsonpath.Check(sub.Arg(0))
+	case "XPATH":
+		return CheckXPath(sub.Arg(0), rule.Namespaces)
+	case "REGEX":
+		if err := CheckRegex(sub.Arg(0)); err != nil {
+			return err
+		}
+		if _, err := strconv.Atoi(sub.Arg(1)); err != nil {
+			return fmt.Errorf("индекс группы должен быть числом")
+		}
+	}
+	return nil
+}
+
+// CheckEscape проверяет формат экранирования
+func CheckEscape(format string) error {
+	for _, known := range template.Formats {
+		if format == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("неизвестный формат экранирования %q", format)
+}
+
+// CheckRegex проверяет, что регулярное выражение компилируется
+func CheckRegex(pattern string) error {
+	_, err := compileRegex(pattern)
+	return err
+}
+
+// checkPathParam проверяет, что параметр объявлен в шаблоне входящего пути
+// Ошибки самого шаблона пути проверяются отдельно
+func checkPathParam(name string, from From) error {
+	pattern, err := from.Pattern()
+	if err != nil {
+		return nil
+	}
+	for _, param := range pattern.Params() {
+		if param == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("параметр пути %q не объявлен в %s", name, from.Path)
+}
+
+// CheckXPath проверяет выражение XPath и объявление его префиксов
+func CheckXPath(expression string, namespaces map[string]string) error {
+	expr, err := xpath.Compile(expression)
+	if err != nil {
+		return err
+	}
+	for _, prefix := range expr.Prefixes() {
+		if _, prs := namespaces[prefix]; !prs {
+			return fmt.Errorf("не объявлен префикс пространства имён %q", prefix)
+		}
+	}
+	return nil
+}
+
+// CheckRetryOn проверяет условие повтора запроса
+func CheckRetryOn(condition string) error {
+	if condition == RetryOnNetwork {
+		return nil
+	}
+	if len(condition) == 3 && condition[1:] == "xx" && condition[0] >= '1' && condition[0] <= '5' {
+		return nil
+	}
+	if code, err := strconv.Atoi(condition); err == nil && code >= 100 && code <= 599 {
+		return nil
+	}
+	return fmt.Errorf("недопустимое условие повтора %q", condition)
+}
+
+// CheckURL проверяет адрес исходящего запроса
+// Подстановки в адресе заменяются пробным значением перед разбором
+func CheckURL(rawURL string) error {
+	parsed, err := template.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	sample, err := parsed.Render(sampleResolver{}, template.FormatURL)
+	if err != nil {
+		return err
+	}
+	target, err := url.Parse(sample)
+	if err != nil {
+		return err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return fmt.Errorf("адрес %q должен начинаться с http:// или https://", rawURL)
+	}
+	return nil
+}
+
+// sampleResolver подставляет пробное значение вместо любой подстановки
+type sampleResolver struct{}
+
+// Resolve возвращает пробное значение
+func (sampleResolver) Resolve(placeholder *template.Placeholder) ([]template.Value, error) {
+	return texts("sample"), nil
+}
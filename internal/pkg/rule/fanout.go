@@ -0,0 +1,110 @@
+package rule
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Политики доставки по нескольким адресатам
+const (
+	// FanOutFirst - клиент получает первый успешный ответ
+	FanOutFirst = "first"
+	// FanOutPrimary - клиент получает ответ основного адресата
+	FanOutPrimary = "primary"
+	// FanOutAggregate - клиент получает JSON с ответами всех адресатов
+	FanOutAggregate = "aggregate"
+
+	FanOutParallel   = "parallel"
+	FanOutSequential = "sequential"
+
+	// FanOutBestEffort - ошибки отдельных адресатов не влияют на ответ клиенту
+	FanOutBestEffort = "best-effort"
+	// FanOutAllOrNothing - при ошибке любого адресата клиент получает ошибку
+	FanOutAllOrNothing = "all-or-nothing"
+)
+
+// FanOut настраивает доставку по нескольким адресатам, когда to задан списком
+type FanOut struct {
+	// Response - first (по умолчанию), primary или aggregate
+	Response string
+	// Mode - parallel (по умолчанию) или sequential
+	Mode string
+	// Failure - best-effort (по умолчанию) или all-or-nothing
+	// all-or-nothing меняет только ответ клиенту: при любой неудаче он получает ошибку
+	// Отката нет: при parallel запросы уходят всем адресатам сразу, при sequential
+	// отправка останавливается на первой неудаче, но уже выполненные запросы остаются в силе
+	Failure string
+}
+
+// IsSet сообщает, заданы ли настройки доставки по нескольким адресатам
+func (fanOut FanOut) IsSet() bool {
+	return fanOut != FanOut{}
+}
+
+// CheckFanOut проверяет названия политик
+func CheckFanOut(fanOut FanOut) []error {
+	errs := []error{}
+	check := func(field string, value string, allowed ...string) {
+		if value == "" {
+			return
+		}
+		for _, item := range allowed {
+			if value == item {
+				return
+			}
+		}
+		errs = append(errs, fmt.Errorf("недопустимое значение %s %q, ожидается одно из %v", field, value, allowed))
+	}
+	check("response", fanOut.Response, FanOutFirst, FanOutPrimary, FanOutAggregate)
+	check("mode", fanOut.Mode, FanOutParallel, FanOutSequential)
+	check("failure", fanOut.Failure, FanOutBestEffort, FanOutAllOrNothing)
+	return errs
+}
+
+// UnmarshalJSON разбирает правило, в котором to может быть объектом или списком адресатов
+func (rule *Rule) UnmarshalJSON(data []byte) error {
+	type plain Rule
+	document := struct {
+		*plain
+		To json.RawMessage
+	}{plain: (*plain)(rule)}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	raw := bytes.TrimSpace(document.To)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil
+	}
+	if raw[0] == '[' {
+		return json.Unmarshal(raw, &rule.Destinations)
+	}
+	return json.Unmarshal(raw, &rule.To)
+}
+
+// Targets возвращает адресатов правила: список из to или единственный To
+func (rule Rule) Targets() []To {
+	if len(rule.Destinations) > 0 {
+		return rule.Destinations
+	}
+	return []To{rule.To}
+}
+
+// PrimaryIndex возвращает номер основного адресата, по умолчанию первого
+func (rule Rule) PrimaryIndex() int {
+	for k, to := range rule.Destinations {
+		if to.Primary {
+			return k
+		}
+	}
+	return 0
+}
+
+// DestinationName возвращает имя адресата с номером k, по умолчанию сам номер
+func (to To) DestinationName(k int) string {
+	if to.Name != "" {
+		return to.Name
+	}
+	return strconv.Itoa(k)
+}
@@ -0,0 +1,136 @@
+package rule
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Поведение таблицы соответствия для отсутствующих ключей
+const (
+	// MissingPassthrough - подставляется сам ключ
+	MissingPassthrough = "passthrough"
+	// MissingDefault - подставляется значение Default
+	MissingDefault = "default"
+	// MissingError - запрос завершается ошибкой шаблона
+	MissingError = "error"
+)
+
+// Map описывает именованную таблицу соответствия значений
+type Map struct {
+	// Values - таблица, заданная прямо в конфигурации
+	Values map[string]string
+	// File - CSV-файл со строками "ключ,значение" или JSON-объект
+	File string
+	// Missing - поведение для отсутствующих ключей: passthrough (по умолчанию), default или error
+	Missing string
+	// Default - значение для отсутствующих ключей при "missing": "default"
+	Default string
+}
+
+// Load возвращает таблицу из конфигурации или из файла
+func (m Map) Load() (map[string]string, error) {
+	if m.File == "" {
+		return m.Values, nil
+	}
+	if m.Values != nil {
+		return nil, fmt.Errorf("таблица задаётся либо values, либо file")
+	}
+	data, err := ioutil.ReadFile(m.File)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(filepath.Ext(m.File)) == ".json" {
+		values := map[string]string{}
+		if err := json.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("%s: ожидается JSON-объект со строковыми значениями: %v", m.File, err)
+		}
+		return values, nil
+	}
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", m.File, err)
+	}
+	values := make(map[string]string, len(records))
+	for _, record := range records {
+		values[record[0]] = record[1]
+	}
+	return values, nil
+}
+
+// CheckMissing проверяет поведение для отсутствующих ключей
+func CheckMissing(missing string) error {
+	switch missing {
+	case "", MissingPassthrough, MissingDefault, MissingError:
+		return nil
+	}
+	return fmt.Errorf("неизвестное поведение %q, ожидается %s, %s или %s", missing, MissingPassthrough, MissingDefault, MissingError)
+}
+
+// loadedMap - таблица соответствия с загруженными значениями
+type loadedMap struct {
+	Map
+	values map[string]string
+}
+
+// lookup возвращает значение по ключу с учётом поведения для отсутствующих ключей
+func (m *loadedMap) lookup(key string) (string, error) {
+	if value, prs := m.values[key]; prs {
+		return value, nil
+	}
+	switch m.Missing {
+	case MissingDefault:
+		return m.Default, nil
+	case MissingError:
+		return "", fmt.Errorf("ключ %q не найден в таблице", key)
+	}
+	return key, nil
+}
+
+// maps таблицы соответствия, доступные в шаблонах
+var maps = map[string]*loadedMap{}
+
+// mapsMutex защищает maps от одновременного доступа
+var mapsMutex sync.RWMutex
+
+// SetMaps загружает таблицы соответствия и заменяет ими текущие
+// Если хотя бы одну таблицу не удалось загрузить, текущие таблицы сохраняются
+func SetMaps(definitions map[string]Map) error {
+	loaded := make(map[string]*loadedMap, len(definitions))
+	names := make([]string, 0, len(definitions))
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values, err := definitions[name].Load()
+		if err != nil {
+			return fmt.Errorf("таблица %s: %v", name, err)
+		}
+		loaded[name] = &loadedMap{Map: definitions[name], values: values}
+	}
+	mapsMutex.Lock()
+	maps = loaded
+	mapsMutex.Unlock()
+	return nil
+}
+
+// lookupMap ищет значение в именованной таблице соответствия
+func lookupMap(name string, key string) (string, error) {
+	mapsMutex.RLock()
+	m, prs := maps[name]
+	mapsMutex.RUnlock()
+	if !prs {
+		return "", fmt.Errorf("таблица %s не найдена", name)
+	}
+	return m.lookup(key)
+}
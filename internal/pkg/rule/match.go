@@ -0,0 +1,163 @@
+package rule
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"platform-service-bus/internal/pkg/jsonpath"
+	"regexp"
+	"sync"
+)
+
+// Match описывает условия, при которых правило применяется к запросу
+type Match struct {
+	Query   []Condition
+	Headers []Condition
+	Form    []Condition
+	JSON    []Condition
+	// Body - регулярное выражение, которому должно соответствовать тело запроса
+	Body string
+}
+
+// Condition описывает проверку одного значения входящего запроса
+// Без Equals и Regex проверяется только наличие значения
+type Condition struct {
+	// Name - имя параметра, хедера, поля формы или JSON-путь вида $.message.type
+	Name   string
+	Equals string
+	Regex  string
+	// Exists со значением false требует отсутствия значения
+	Exists *bool
+}
+
+// regexCache кэш скомпилированных регулярных выражений
+var regexCache sync.Map
+
+// compileRegex компилирует регулярное выражение и кэширует результат
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	if cached, prs := regexCache.Load(pattern); prs {
+		return cached.(*regexp.Regexp), nil
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexCache.Store(pattern, compiled)
+	return compiled, nil
+}
+
+// readBody читает тело запроса, оставляя его доступным для повторного чтения
+func readBody(req *http.Request) []byte {
+	if req.Body == nil {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	return body
+}
+
+// parseForm разбирает параметры формы, сохраняя прочитанное тело запроса
+func parseForm(req *http.Request, body []byte) {
+	req.ParseForm()
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+}
+
+// check проверяет набор значений на соответствие условию
+func (condition Condition) check(values []string) bool {
+	if condition.Exists != nil && !*condition.Exists {
+		return len(values) == 0
+	}
+	if len(values) == 0 {
+		return false
+	}
+	if condition.Equals == "" && condition.Regex == "" {
+		return true
+	}
+	for _, value := range values {
+		if condition.Equals != "" && value != condition.Equals {
+			continue
+		}
+		if condition.Regex != "" {
+			rx, err := compileRegex(condition.Regex)
+			if err != nil {
+				log.Errorf("Ошибка компиляции регулярного выражения условия: %v", err)
+				return false
+			}
+			if !rx.MatchString(value) {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// checkAll проверяет список условий, получая значения через lookup
+func checkAll(conditions []Condition, lookup func(name string) []string) bool {
+	for _, condition := range conditions {
+		if !condition.check(lookup(condition.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches проверяет, подходит ли запрос под условия правила
+func (from From) Matches(request *Request) bool {
+	req := request.req
+	match := from.Match
+	if !checkAll(match.Query, func(name string) []string {
+		return req.URL.Query()[name]
+	}) {
+		return false
+	}
+	if !checkAll(match.Headers, func(name string) []string {
+		return req.Header[textproto.CanonicalMIMEHeaderKey(name)]
+	}) {
+		return false
+	}
+	if len(match.Form) > 0 {
+		if !checkAll(match.Form, func(name string) []string {
+			return req.PostForm[name]
+		}) {
+			return false
+		}
+	}
+	if match.Body == "" && len(match.JSON) == 0 {
+		return true
+	}
+	body := request.body
+	if match.Body != "" {
+		rx, err := compileRegex(match.Body)
+		if err != nil {
+			log.Errorf("Ошибка компиляции регулярного выражения тела: %v", err)
+			return false
+		}
+		if !rx.Match(body) {
+			return false
+		}
+	}
+	if len(match.JSON) > 0 {
+		document := request.json()
+		if document == nil {
+			return false
+		}
+		if !checkAll(match.JSON, func(path string) []string {
+			found, err := jsonpath.GetAll(document, path)
+			if err != nil {
+				log.Errorf("Ошибка JSON-пути условия: %v", err)
+			}
+			values := []string{}
+			for _, value := range found {
+				values = append(values, jsonpath.String(value))
+			}
+			return values
+		}) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package rule
+
+import (
+	"net/url"
+	"platform-service-bus/internal/pkg/template"
+	"sort"
+)
+
+// DenyAll в списке Deny запрещает передавать любые GET-параметры входящего запроса
+const DenyAll = "*"
+
+// Query описывает GET-параметры исходящего запроса
+// Операции применяются по порядку: allow, deny, rename, set
+type Query struct {
+	// Allow - параметры входящего запроса, которые передаются дальше; пустой список - все
+	Allow []string
+	// Deny - параметры, которые не передаются; "*" - не передавать ни одного
+	Deny []string
+	// Rename переименовывает параметры: {"smsid": "id"}
+	Rename map[string]string
+	// Set задаёт параметры по шаблону: {"source": "%HEADER[X-Source]%"}
+	Set map[string]string
+}
+
+// HandleQuery формирует GET-параметры, добавляемые к адресу исходящего запроса
+// Без секции query передаются все параметры входящего запроса
+func HandleQuery(rule Rule, to To, request *Request) (url.Values, error) {
+	query := to.Query
+	result := url.Values{}
+	allowed := make(map[string]bool)
+	for _, name := range query.Allow {
+		allowed[name] = true
+	}
+	denied := make(map[string]bool)
+	for _, name := range query.Deny {
+		denied[name] = true
+	}
+	if !denied[DenyAll] {
+		for name, values := range request.req.URL.Query() {
+			if (len(allowed) > 0 && !allowed[name]) || denied[name] {
+				continue
+			}
+			if renamed, prs := query.Rename[name]; prs {
+				name = renamed
+			}
+			result[name] = append(result[name], values...)
+		}
+	}
+	if len(query.Set) == 0 {
+		return result, nil
+	}
+	resolver := newResolver(rule, request, nil)
+	names := make([]string, 0, len(query.Set))
+	for name := range query.Set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, err := render(query.Set[name], template.FormatNone, resolver)
+		if err != nil {
+			return nil, err
+		}
+		result.Set(name, string(value))
+	}
+	return result, nil
+}
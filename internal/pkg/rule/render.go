@@ -0,0 +1,404 @@
+package rule
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"os"
+	"platform-service-bus/internal/pkg/jsonpath"
+	"platform-service-bus/internal/pkg/router"
+	"platform-service-bus/internal/pkg/secret"
+	"platform-service-bus/internal/pkg/template"
+	"platform-service-bus/internal/pkg/xpath"
+	"strconv"
+	"sync"
+)
+
+// templateCache кэш разобранных шаблонов по их тексту
+var templateCache sync.Map
+
+// envSecrets значения окружения, уже переданные в secret.Add
+// Чтение sync.Map не блокирует, поэтому повторные запросы не берут блокировку записи secret
+var envSecrets sync.Map
+
+// addEnvSecret регистрирует значение окружения как секрет при первом обращении
+func addEnvSecret(value string) {
+	if _, loaded := envSecrets.LoadOrStore(value, true); !loaded {
+		secret.Add(value)
+	}
+}
+
+// parseTemplate разбирает шаблон и кэширует результат
+func parseTemplate(text string) (*template.Template, error) {
+	if cached, prs := templateCache.Load(text); prs {
+		return cached.(*template.Template), nil
+	}
+	parsed, err := template.Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	templateCache.Store(text, parsed)
+	return parsed, nil
+}
+
+// HandleRule формирует ответ согласно правилу адаптера
+func HandleRule(rule Rule, request *Request) ([]string, []byte, error) {
+	return HandleTo(rule, rule.To, request)
+}
+
+// HandleTo формирует хедеры и тело исходящего запроса по описанию To
+// Из правила берутся общие настройки, например пространства имён XML
+func HandleTo(rule Rule, to To, request *Request) ([]string, []byte, error) {
+	resolver := newResolver(rule, request, nil)
+	headers, err := renderHeaders(to.Headers, resolver)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := render(loadTemplate(to.Data, to.DataFile), to.Escape, resolver)
+	return headers, body, err
+}
+
+// HandleURL формирует адрес исходящего запроса по описанию To
+// Подставляемые значения экранируются для URL
+func HandleURL(rule Rule, to To, request *Request) (string, error) {
+	target, err := render(to.URL, template.FormatURL, newResolver(rule, request, nil))
+	return string(target), err
+}
+
+// HandleResponse формирует ответ клиенту из ответа вышестоящего сервиса
+// upstreams - ответы адресатов по именам для подстановок %UPSTREAM[name]...%
+func HandleResponse(rule Rule, request *Request, upstream *Upstream, upstreams map[string]*Upstream) ([]string, []byte, error) {
+	response := rule.Response
+	resolver := newResolver(rule, request, upstream)
+	resolver.upstreams = upstreams
+	headers, err := renderHeaders(response.Headers, resolver)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := render(loadTemplate(response.Data, response.DataFile), response.Escape, resolver)
+	return headers, body, err
+}
+
+// HandleAck формирует ответ клиенту при асинхронной доставке
+func HandleAck(rule Rule, request *Request) ([]string, []byte, error) {
+	resolver := newResolver(rule, request, nil)
+	headers, err := renderHeaders(rule.Ack.Headers, resolver)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := render(rule.Ack.Data, template.FormatNone, resolver)
+	return headers, body, err
+}
+
+// renderHeaders подставляет значения в хедеры вида "Name: value"
+func renderHeaders(headers []string, resolver *requestResolver) ([]string, error) {
+	result := make([]string, 0, len(headers))
+	for _, header := range headers {
+		rendered, err := render(header, template.FormatNone, resolver)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, string(rendered))
+	}
+	return result, nil
+}
+
+// loadTemplate достаёт шаблон из файла или из строки
+func loadTemplate(data string, dataFile string) string {
+	if dataFile != "" {
+		return string(getFileContents(dataFile))
+	}
+	return data
+}
+
+// RenderError - ошибка разбора или отрисовки шаблона
+type RenderError struct {
+	Err error
+}
+
+// Error возвращает описание ошибки шаблона
+func (err *RenderError) Error() string {
+	return fmt.Sprintf("ошибка шаблона: %v", err.Err)
+}
+
+// render разбирает и отрисовывает шаблон
+func render(text string, format string, resolver *requestResolver) ([]byte, error) {
+	parsed, err := parseTemplate(text)
+	if err != nil {
+		return nil, &RenderError{err}
+	}
+	result, err := parsed.Render(resolver, format)
+	if err != nil {
+		return nil, &RenderError{err}
+	}
+	return []byte(result), nil
+}
+
+// requestResolver предоставляет значения подстановок из входящего запроса
+// и, при формировании ответа клиенту, из ответа вышестоящего сервиса
+type requestResolver struct {
+	// request - входящий запрос, общий для всех шаблонов правила
+	request  *Request
+	upstream *Upstream
+	// upstreams - ответы адресатов по именам, если запрос отправлялся нескольким адресатам
+	upstreams map[string]*Upstream
+	// upstreamDocuments - тела ответов адресатов, разобранные как JSON при первом обращении
+	upstreamDocuments map[string]interface{}
+	// namespaces - префиксы пространств имён для XPath
+	namespaces map[string]string
+	// xmlDocuments - тела ответов, разобранные как XML при первом обращении
+	xmlDocuments map[string]*xpath.Node
+}
+
+// newResolver создаёт источник подстановок для шаблонов правила
+// Тело входящего запроса уже прочитано в Request и повторно не разбирается
+func newResolver(rule Rule, request *Request, upstream *Upstream) *requestResolver {
+	return &requestResolver{
+		request:      request,
+		upstream:     upstream,
+		namespaces:   rule.Namespaces,
+		xmlDocuments: make(map[string]*xpath.Node),
+	}
+}
+
+// texts превращает список строк в значения подстановки
+func texts(values ...string) []template.Value {
+	result := make([]template.Value, 0, len(values))
+	for _, value := range values {
+		result = append(result, template.Value{Text: value})
+	}
+	return result
+}
+
+// Resolve возвращает значения подстановки
+func (resolver *requestResolver) Resolve(placeholder *template.Placeholder) ([]template.Value, error) {
+	if placeholder.Sub != nil && placeholder.Name != "UPSTREAM" {
+		return nil, fmt.Errorf("подстановка не поддерживает уточнение")
+	}
+	switch placeholder.Name {
+	case "QUERY":
+		return texts(resolver.request.req.URL.Query()[placeholder.Arg(0)]...), nil
+	case "FORM":
+		return texts(resolver.request.req.PostForm[placeholder.Arg(0)]...), nil
+	case "REGEX":
+		return regexSubmatch(placeholder.Arg(0), placeholder.Arg(1), resolver.request.body)
+	case "BODY":
+		return texts(string(resolver.request.body)), nil
+	case "JSON":
+		return resolver.resolveJSON(placeholder.Arg(0))
+	case "HEADER":
+		return texts(resolver.request.req.Header[http.CanonicalHeaderKey(placeholder.Arg(0))]...), nil
+	case "COOKIE":
+		cookie, err := resolver.request.req.Cookie(placeholder.Arg(0))
+		if err != nil {
+			return nil, nil
+		}
+		return texts(cookie.Value), nil
+	case "PATH":
+		if len(placeholder.Args) == 0 {
+			return texts(resolver.request.req.URL.Path), nil
+		}
+		if value, prs := router.Params(resolver.request.req)[placeholder.Arg(0)]; prs {
+			return texts(value), nil
+		}
+		return nil, nil
+	case "METHOD":
+		return texts(resolver.request.req.Method), nil
+	case "REMOTE_ADDR":
+		host, _, err := net.SplitHostPort(resolver.request.req.RemoteAddr)
+		if err != nil {
+			return texts(resolver.request.req.RemoteAddr), nil
+		}
+		return texts(host), nil
+	case "ENV":
+		value, prs := os.LookupEnv(placeholder.Arg(0))
+		if !prs {
+			return nil, nil
+		}
+		// Значения окружения считаются секретами и скрываются в логах
+		addEnvSecret(value)
+		return texts(value), nil
+	case "MAP":
+		// Ключ может содержать вложенные подстановки: %MAP[dlr-status][%QUERY[status]%]%
+		parsed, err := parseTemplate(placeholder.Arg(1))
+		if err != nil {
+			return nil, err
+		}
+		key, err := parsed.Render(resolver, template.FormatNone)
+		if err != nil {
+			return nil, err
+		}
+		value, err := lookupMap(placeholder.Arg(0), key)
+		if err != nil {
+			return nil, err
+		}
+		return texts(value), nil
+	case "XPATH":
+		return resolver.resolveXPath(placeholder.Arg(0), resolver.request.xml())
+	}
+	if upstreamPlaceholders[placeholder.Name] {
+		if resolver.upstream == nil {
+			return nil, fmt.Errorf("подстановка доступна только в шаблоне ответа")
+		}
+		upstream := resolver.upstream
+		switch placeholder.Name {
+		case "UPSTREAM_BODY":
+			return texts(string(upstream.Body)), nil
+		case "UPSTREAM_STATUS":
+			return []template.Value{{Text: strconv.Itoa(upstream.StatusCode), JSON: true}}, nil
+		case "UPSTREAM_HEADER":
+			return texts(upstream.Header[http.CanonicalHeaderKey(placeholder.Arg(0))]...), nil
+		case "UPSTREAM_REGEX":
+			return regexSubmatch(placeholder.Arg(0), placeholder.Arg(1), upstream.Body)
+		case "UPSTREAM_XPATH":
+			return resolver.resolveXPath(placeholder.Arg(0), resolver.upstreamXML("ответа", upstream.Body))
+		case "UPSTREAM":
+			return resolver.resolveUpstream(placeholder.Arg(0), placeholder.Sub)
+		}
+	}
+	return nil, fmt.Errorf("неизвестная подстановка")
+}
+
+// resolveJSON возвращает значения по JSON-пути в теле запроса
+// Строки подставляются без кавычек, числа, логические значения, объекты и массивы - как JSON
+func (resolver *requestResolver) resolveJSON(path string) ([]template.Value, error) {
+	return jsonValues(resolver.request.json(), path)
+}
+
+// resolveUpstream возвращает значения из ответа адресата с указанным именем
+// Уточнение BODY, STATUS, HEADER, JSON, XPATH или REGEX выбирает часть ответа, без уточнения подставляется тело
+// Адресат без ответа, например из-за сетевой ошибки, не содержит значений
+func (resolver *requestResolver) resolveUpstream(name string, sub *template.Placeholder) ([]template.Value, error) {
+	upstream, prs := resolver.upstreams[name]
+	if !prs || upstream == nil {
+		return nil, nil
+	}
+	if sub == nil {
+		return texts(string(upstream.Body)), nil
+	}
+	switch sub.Name {
+	case "BODY":
+		return texts(string(upstream.Body)), nil
+	case "STATUS":
+		return []template.Value{{Text: strconv.Itoa(upstream.StatusCode), JSON: true}}, nil
+	case "HEADER":
+		return texts(upstream.Header[http.CanonicalHeaderKey(sub.Arg(0))]...), nil
+	case "REGEX":
+		return regexSubmatch(sub.Arg(0), sub.Arg(1), upstream.Body)
+	case "XPATH":
+		return resolver.resolveXPath(sub.Arg(0), resolver.upstreamXML("ответа "+name, upstream.Body))
+	case "JSON":
+		if resolver.upstreamDocuments == nil {
+			resolver.upstreamDocuments = make(map[string]interface{})
+		}
+		document, parsed := resolver.upstreamDocuments[name]
+		if !parsed {
+			var err error
+			document, err = jsonpath.Parse(upstream.Body)
+			if err != nil {
+				log.Warnf("Тело ответа %s не является JSON: %v", name, err)
+				document = nil
+			}
+			resolver.upstreamDocuments[name] = document
+		}
+		return jsonValues(document, sub.Arg(0))
+	}
+	return nil, fmt.Errorf("неизвестное уточнение %s", sub.Name)
+}
+
+// jsonValues возвращает значения по JSON-пути в разобранном документе
+// Строки подставляются без кавычек, числа, логические значения, объекты и массивы - как JSON
+func jsonValues(document interface{}, path string) ([]template.Value, error) {
+	if document == nil {
+		return nil, nil
+	}
+	found, err := jsonpath.GetAll(document, path)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]template.Value, 0, len(found))
+	for _, value := range found {
+		values = append(values, template.Value{
+			Text: jsonpath.String(value),
+			JSON: !jsonpath.IsString(value),
+		})
+	}
+	return values, nil
+}
+
+// upstreamXML возвращает тело ответа, разобранное как XML, или nil, если тело не является XML
+// source - название ответа для кэша и сообщений
+func (resolver *requestResolver) upstreamXML(source string, body []byte) *xpath.Node {
+	document, prs := resolver.xmlDocuments[source]
+	if !prs {
+		var err error
+		document, err = xpath.Parse(body)
+		if err != nil {
+			log.Warnf("Тело %s не является XML: %v", source, err)
+			document = nil
+		}
+		resolver.xmlDocuments[source] = document
+	}
+	return document
+}
+
+// resolveXPath возвращает строковые значения узлов XML-документа по выражению XPath
+// Тело, не являющееся XML, не содержит значений
+func (resolver *requestResolver) resolveXPath(expression string, document *xpath.Node) ([]template.Value, error) {
+	expr, err := compileXPath(expression)
+	if err != nil {
+		return nil, err
+	}
+	if document == nil {
+		return nil, nil
+	}
+	found, err := expr.Strings(document, resolver.namespaces)
+	if err != nil {
+		return nil, err
+	}
+	return texts(found...), nil
+}
+
+// xpathCache кэш разобранных выражений XPath
+var xpathCache sync.Map
+
+// compileXPath разбирает выражение XPath и кэширует результат
+func compileXPath(expression string) (*xpath.Expr, error) {
+	if cached, prs := xpathCache.Load(expression); prs {
+		return cached.(*xpath.Expr), nil
+	}
+	expr, err := xpath.Compile(expression)
+	if err != nil {
+		return nil, err
+	}
+	xpathCache.Store(expression, expr)
+	return expr, nil
+}
+
+// upstreamPlaceholders подстановки из ответа вышестоящего сервиса
+var upstreamPlaceholders = map[string]bool{
+	"UPSTREAM_BODY":   true,
+	"UPSTREAM_STATUS": true,
+	"UPSTREAM_HEADER": true,
+	"UPSTREAM_REGEX":  true,
+	"UPSTREAM_XPATH":  true,
+	"UPSTREAM":        true,
+}
+
+// regexSubmatch ищет в тексте группу регулярного выражения с указанным индексом
+func regexSubmatch(pattern string, index string, text []byte) ([]template.Value, error) {
+	searchRx, err := compileRegex(pattern)
+	if err != nil {
+		return nil, err
+	}
+	submatchIndex, err := strconv.Atoi(index)
+	if err != nil {
+		return nil, fmt.Errorf("недопустимый индекс группы регулярного выражения: %v", err)
+	}
+	matches := searchRx.FindSubmatch(text)
+	if submatchIndex < 0 || submatchIndex >= len(matches) {
+		return nil, nil
+	}
+	return texts(string(matches[submatchIndex])), nil
+}
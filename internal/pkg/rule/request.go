@@ -0,0 +1,68 @@
+package rule
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"platform-service-bus/internal/pkg/jsonpath"
+	"platform-service-bus/internal/pkg/xpath"
+)
+
+// Request - входящий запрос, тело которого читается и разбирается один раз
+// Обработчик создаёт его на каждый входящий запрос и передаёт в From.Matches и функции Handle*
+// Разобранные документы кэшируются без блокировок, поэтому Request используется из одной горутины
+type Request struct {
+	req  *http.Request
+	body []byte
+	// document - тело, разобранное как JSON при первом обращении
+	document       interface{}
+	documentParsed bool
+	// xmlDocument - тело, разобранное как XML при первом обращении
+	xmlDocument *xpath.Node
+	xmlParsed   bool
+}
+
+// NewRequest читает тело и параметры формы входящего запроса
+// Тело остаётся доступным для повторного чтения
+func NewRequest(req *http.Request) *Request {
+	body := readBody(req)
+	parseForm(req, body)
+	return &Request{req: req, body: body}
+}
+
+// HTTP возвращает исходный запрос
+func (request *Request) HTTP() *http.Request {
+	return request.req
+}
+
+// Body возвращает тело запроса
+func (request *Request) Body() []byte {
+	return request.body
+}
+
+// json возвращает тело, разобранное как JSON, или nil, если тело не является JSON
+func (request *Request) json() interface{} {
+	if !request.documentParsed {
+		request.documentParsed = true
+		document, err := jsonpath.Parse(request.body)
+		if err != nil {
+			log.Warnf("Тело запроса не является JSON: %v", err)
+		} else {
+			request.document = document
+		}
+	}
+	return request.document
+}
+
+// xml возвращает тело, разобранное как XML, или nil, если тело не является XML
+func (request *Request) xml() *xpath.Node {
+	if !request.xmlParsed {
+		request.xmlParsed = true
+		document, err := xpath.Parse(request.body)
+		if err != nil {
+			log.Warnf("Тело запроса не является XML: %v", err)
+		} else {
+			request.xmlDocument = document
+		}
+	}
+	return request.xmlDocument
+}
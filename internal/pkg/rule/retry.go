@@ -0,0 +1,100 @@
+package rule
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// DefaultRetryOn условия повтора запроса, если RetryOn не задан
+var DefaultRetryOn = []string{RetryOnNetwork, "502", "503", "504"}
+
+// RetryOnNetwork обозначает повтор запроса при сетевых ошибках и таймаутах
+const RetryOnNetwork = "network"
+
+// Значения по умолчанию для экспоненциальной задержки между повторами
+const (
+	defaultBackoffInitial = 100 * time.Millisecond
+	defaultBackoffMax     = 5 * time.Second
+)
+
+// Duration - длительность, задаваемая в конфигурации строкой вида "1.5s" или числом миллисекунд
+type Duration time.Duration
+
+// UnmarshalJSON разбирает длительность из строки или числа миллисекунд
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		*duration = Duration(time.Duration(v) * time.Millisecond)
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*duration = Duration(parsed)
+	default:
+		return fmt.Errorf("недопустимая длительность: %s", data)
+	}
+	return nil
+}
+
+// MarshalJSON сохраняет длительность в виде строки
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(duration).String())
+}
+
+// Backoff описывает экспоненциальную задержку между повторами запроса
+type Backoff struct {
+	Initial Duration
+	Max     Duration
+}
+
+// Delay возвращает задержку перед повтором с номером attempt (начиная с 0)
+// Используется полный джиттер: случайное значение от 0 до экспоненциальной границы
+func (backoff Backoff) Delay(attempt int) time.Duration {
+	initial := time.Duration(backoff.Initial)
+	if initial <= 0 {
+		initial = defaultBackoffInitial
+	}
+	max := time.Duration(backoff.Max)
+	if max <= 0 {
+		max = defaultBackoffMax
+	}
+	limit := initial
+	for i := 0; i < attempt && limit < max; i++ {
+		limit *= 2
+	}
+	if limit > max {
+		limit = max
+	}
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// ShouldRetry сообщает, нужно ли повторить запрос после ответа со статусом status или ошибки err
+func (to To) ShouldRetry(status int, err error) bool {
+	retryOn := to.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = DefaultRetryOn
+	}
+	for _, condition := range retryOn {
+		switch {
+		case err != nil:
+			if condition == RetryOnNetwork {
+				return true
+			}
+		case len(condition) == 3 && condition[1:] == "xx":
+			if strconv.Itoa(status/100) == condition[:1] {
+				return true
+			}
+		case condition == strconv.Itoa(status):
+			return true
+		}
+	}
+	return false
+}
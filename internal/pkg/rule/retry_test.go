@@ -0,0 +1,109 @@
+package rule
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestShouldRetry(t *testing.T) {
+	table := []struct {
+		name     string
+		retryOn  []string
+		status   int
+		err      error
+		expected bool
+	}{
+		{
+			name:     "Сетевая ошибка по умолчанию",
+			err:      errors.New("connection refused"),
+			expected: true,
+		},
+		{
+			name:     "503 по умолчанию",
+			status:   503,
+			expected: true,
+		},
+		{
+			name:     "500 по умолчанию не повторяется",
+			status:   500,
+			expected: false,
+		},
+		{
+			name:     "Класс кодов",
+			retryOn:  []string{"5xx"},
+			status:   500,
+			expected: true,
+		},
+		{
+			name:     "Конкретный код",
+			retryOn:  []string{"429"},
+			status:   429,
+			expected: true,
+		},
+		{
+			name:     "Сетевая ошибка без network",
+			retryOn:  []string{"5xx"},
+			err:      errors.New("timeout"),
+			expected: false,
+		},
+		{
+			name:     "Успешный ответ",
+			retryOn:  []string{"5xx", "network"},
+			status:   200,
+			expected: false,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			to := To{RetryOn: item.retryOn}
+			if got := to.ShouldRetry(item.status, item.err); got != item.expected {
+				t.Errorf("Неверный результат. Expected %v, got %v", item.expected, got)
+			}
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{
+		Initial: Duration(10 * time.Millisecond),
+		Max:     Duration(50 * time.Millisecond),
+	}
+	for attempt, limit := range []time.Duration{10, 20, 40, 50, 50} {
+		limit *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if delay := backoff.Delay(attempt); delay < 0 || delay > limit {
+				t.Errorf("Задержка попытки %d вне границ. Expected <= %v, got %v", attempt, limit, delay)
+			}
+		}
+	}
+}
+
+func TestDurationUnmarshal(t *testing.T) {
+	table := []struct {
+		input         string
+		expected      time.Duration
+		expectedError bool
+	}{
+		{input: `"1.5s"`, expected: 1500 * time.Millisecond},
+		{input: `250`, expected: 250 * time.Millisecond},
+		{input: `"soon"`, expectedError: true},
+		{input: `true`, expectedError: true},
+	}
+	for _, item := range table {
+		t.Run(item.input, func(t *testing.T) {
+			var duration Duration
+			err := json.Unmarshal([]byte(item.input), &duration)
+			if item.expectedError {
+				if err == nil {
+					t.Errorf("Expected an error, got %v", time.Duration(duration))
+				}
+				return
+			}
+			if err != nil || time.Duration(duration) != item.expected {
+				t.Errorf("Expected %v, got %v, err %v", item.expected, time.Duration(duration), err)
+			}
+		})
+	}
+}
@@ -1,132 +1,222 @@
 package rule
 
 import (
-	"bytes"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"net/http"
-	"regexp"
-	"strconv"
+	"platform-service-bus/internal/pkg/auth"
+	"platform-service-bus/internal/pkg/router"
+	"platform-service-bus/internal/pkg/tlsconfig"
 	"strings"
+	"sync"
 )
 
-// queryRx регулярка для подстановки GET-параметров
-var queryRx = regexp.MustCompile(`%QUERY\[([^]]+)\]%`)
-
-// formRx регулярка для подстановки Form-параметров
-var formRx = regexp.MustCompile(`%FORM\[([^]]+)\]%`)
-
-// regexpRx регулярка для подстановки результатов поиска по регулярным выражениям
-var regexpRx = regexp.MustCompile(`%REGEX\[(.+?)\]\[(\d+)\]%`)
-
 // Rule описывает правило адаптера
 type Rule struct {
 	From From
-	To   To
+	// Steps - промежуточные шаги конвейера, выполняемые до To
+	// Результат каждого шага становится входящим запросом для следующего
+	Steps []To
+	// To - адресат исходящего запроса, в конфигурации может быть списком адресатов
+	To To `schema:"list"`
+	// Destinations - адресаты, если to задан списком
+	Destinations []To `json:"-"`
+	// FanOut настраивает доставку по списку адресатов
+	FanOut FanOut `json:"fan-out"`
+	// Response описывает преобразование ответа вышестоящего сервиса
+	Response Response
+	// Async включает асинхронную доставку: запрос сохраняется в очередь,
+	// клиент сразу получает Ack, а запрос на To.URL выполняется в фоне
+	Async bool
+	// Ack - ответ клиенту при асинхронной доставке
+	Ack Ack
+	// Namespaces сопоставляет префиксы XPath с URI пространств имён XML: {"sms": "urn:sms"}
+	Namespaces map[string]string
+}
+
+// Response описывает ответ клиенту, сформированный из ответа вышестоящего сервиса
+type Response struct {
+	Headers  []string
+	Data     string
+	DataFile string `json:"data-file"`
+	// Escape - формат экранирования подставляемых значений: xml, json, url или none
+	Escape string
+}
+
+// IsSet сообщает, задан ли шаблон ответа
+func (response Response) IsSet() bool {
+	return response.Data != "" || response.DataFile != ""
+}
+
+// Ack описывает ответ клиенту, принявшему запрос в асинхронную доставку
+type Ack struct {
+	// Status - код ответа, по умолчанию 200
+	Status  int
+	Headers []string
+	Data    string
+}
+
+// StatusCode возвращает код ответа с учётом значения по умолчанию
+func (ack Ack) StatusCode() int {
+	if ack.Status == 0 {
+		return http.StatusOK
+	}
+	return ack.Status
 }
 
+// Upstream описывает ответ вышестоящего сервиса
+type Upstream struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// AnyMethod обозначает правило, принимающее запросы с любым HTTP-методом
+const AnyMethod = "*"
+
 // From описывает входящий запрос сервиса
 type From struct {
-	Path       string
+	// Path - шаблон пути, например /users/{id}/sms
+	Path string
+	// PathType - exact или prefix, по умолчанию путь с / на конце сопоставляется по префиксу
+	PathType string `json:"path-type"`
+	// HTTPMethod может содержать один метод, список через запятую или "*"
 	HTTPMethod string `json:"http-method"`
+	// Match задаёт дополнительные условия применения правила
+	Match Match
+	// Auth - проверка входящих запросов, выполняется в дополнение к проверке адаптера
+	Auth auth.Inbound
+}
+
+// Pattern разбирает шаблон входящего пути
+func (from From) Pattern() (*router.Pattern, error) {
+	return router.Compile(from.Path, from.PathType)
+}
+
+// Methods возвращает список HTTP-методов правила
+// Пустой список означает, что подходит любой метод
+func (from From) Methods() []string {
+	methods := []string{}
+	for _, method := range strings.Split(from.HTTPMethod, ",") {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == AnyMethod {
+			return nil
+		}
+		if method != "" {
+			methods = append(methods, method)
+		}
+	}
+	if len(methods) == 0 {
+		return nil
+	}
+	return methods
+}
+
+// MatchMethod проверяет, подходит ли HTTP-метод запроса под правило
+func (from From) MatchMethod(method string) bool {
+	methods := from.Methods()
+	if methods == nil {
+		return true
+	}
+	for _, allowed := range methods {
+		if allowed == strings.ToUpper(method) {
+			return true
+		}
+	}
+	return false
 }
 
 // To описывает исходящий запрос сервиса
 type To struct {
-	URL        string
+	// Name - имя адресата в списке to
+	Name string
+	// Primary отмечает основного адресата в списке to
+	Primary bool
+	// URL - адрес исходящего запроса, может содержать подстановки
+	URL string
+	// Query управляет GET-параметрами исходящего запроса
+	Query      Query
 	HTTPMethod string `json:"http-method"`
 	Headers    []string
-	Data       string
-	DataFile   string `json:"data-file"`
+	// Auth добавляет в исходящий запрос данные аутентификации
+	Auth auth.Outbound
+	// TLS - центры сертификации, сертификат клиента и имя сервера для исходящего соединения
+	TLS      tlsconfig.Client
+	Data     string
+	DataFile string `json:"data-file"`
+	// Escape - формат экранирования подставляемых значений: xml, json, url или none
+	Escape string
+	// StatusMap переопределяет коды ответа вышестоящего сервиса: {"202": 200}
+	StatusMap map[int]int `json:"status-map"`
+	// Timeout ограничивает время одной попытки запроса
+	Timeout Duration
+	// Retries - количество повторов запроса после первой неудачной попытки
+	Retries int
+	// RetryOn - коды ответа ("503", "5xx") или "network", при которых запрос повторяется
+	RetryOn []string `json:"retry-on"`
+	Backoff Backoff
+}
+
+// MapStatus возвращает код ответа для клиента с учётом StatusMap
+func (to To) MapStatus(status int) int {
+	if mapped, prs := to.StatusMap[status]; prs {
+		return mapped
+	}
+	return status
 }
 
 // filesCache кэш для подгруженных шаблонов
 var filesCache = make(map[string][]byte)
 
+// filesCacheMutex защищает filesCache от одновременного доступа
+var filesCacheMutex sync.RWMutex
+
 // getFileContents подгружает файл и кэширует данные
 func getFileContents(fileName string) []byte {
+	filesCacheMutex.RLock()
 	data, prs := filesCache[fileName]
+	filesCacheMutex.RUnlock()
 	if !prs {
 		data, err := ioutil.ReadFile(fileName)
 		if err != nil {
 			log.Errorf("Ошибка чтения файла %s: %v", fileName, err)
 		} else {
+			filesCacheMutex.Lock()
 			filesCache[fileName] = data
+			filesCacheMutex.Unlock()
 		}
 		return data
 	}
 	return data
 }
 
-// replaceAllStringSubmatchFunc заменяет все вхождения с помощью функции, принимающей submatches
-func replaceAllStringSubmatchFunc(re *regexp.Regexp, str string, repl func([]string) string) string {
-	result := ""
-	lastIndex := 0
-	for _, v := range re.FindAllSubmatchIndex([]byte(str), -1) {
-		groups := []string{}
-		for i := 0; i < len(v); i += 2 {
-			groups = append(groups, str[v[i]:v[i+1]])
-		}
-		result += str[lastIndex:v[0]] + repl(groups)
-		lastIndex = v[1]
-	}
-	return result + str[lastIndex:]
+// ResetCache сбрасывает кэш шаблонов, чтобы файлы были перечитаны
+func ResetCache() {
+	filesCacheMutex.Lock()
+	filesCache = make(map[string][]byte)
+	filesCacheMutex.Unlock()
+	// Карта очищается на месте: её одновременно читают обработчики запросов
+	templateCache.Range(func(key, value interface{}) bool {
+		templateCache.Delete(key)
+		return true
+	})
 }
 
-// HandleRule формирует ответ согласно правилу адаптера
-func HandleRule(rule Rule, req *http.Request) ([]string, []byte) {
-	var response string
-	query := req.URL.Query()
-	body, _ := ioutil.ReadAll(req.Body)
-	req.Body.Close()
-	req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-	req.ParseForm()
-	req.Body.Close()
-	req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-	// Достаём шаблон ответа
-	var responseTemplate string
-	if rule.To.DataFile != "" {
-		responseTemplate = string(getFileContents(rule.To.DataFile))
-	} else {
-		responseTemplate = rule.To.Data
-	}
-	// Делаем подстановки GET-параметров
-	response = replaceAllStringSubmatchFunc(queryRx, responseTemplate, func(groups []string) string {
-		if len(query[groups[1]]) == 1 {
-			return query[groups[1]][0]
+// DataFiles возвращает файлы шаблонов, используемые правилом
+func (rule Rule) DataFiles() []string {
+	files := []string{}
+	for _, step := range rule.Steps {
+		if step.DataFile != "" {
+			files = append(files, step.DataFile)
 		}
-		return ""
-	})
-	// Делаем подстановки Form-параметров
-	response = replaceAllStringSubmatchFunc(formRx, responseTemplate, func(groups []string) string {
-		if len(req.PostForm[groups[1]]) == 1 {
-			return req.PostForm[groups[1]][0]
-		}
-		return ""
-	})
-	// Делаем подстановки REGEXP
-	response = replaceAllStringSubmatchFunc(regexpRx, response, func(groups []string) string {
-		searchRx, err := regexp.Compile(groups[1])
-		if err != nil {
-			log.Errorf("Ошибка компиляции регулярного выражения: %v", err)
-			return ""
-		}
-		submatchIndex, err := strconv.Atoi(groups[2])
-		if err != nil {
-			log.Errorf("Недопустимый индекс группы регулярного выражения: %v", err)
-			return ""
-		}
-		if len(body) > 0 {
-			matches := searchRx.FindSubmatch(body)
-			if submatchIndex >= 0 && submatchIndex < len(matches) {
-				return string(matches[submatchIndex])
-			}
-			log.Errorf("Группа регулярного выражения не существует по указанному индексу: %v", err)
-			return ""
+	}
+	for _, to := range rule.Targets() {
+		if to.DataFile != "" {
+			files = append(files, to.DataFile)
 		}
-		return ""
-	})
-	// Делаем подстановки тела запроса
-	response = strings.ReplaceAll(response, "%BODY%", string(body))
-	return rule.To.Headers, []byte(response)
+	}
+	if rule.Response.DataFile != "" {
+		files = append(files, rule.Response.DataFile)
+	}
+	return files
 }
@@ -1,13 +1,25 @@
 package rule
 
 import (
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"platform-service-bus/internal/pkg/secret"
 	"strings"
+	"sync"
 	"testing"
 )
 
 func TestHandleRule(t *testing.T) {
+	formRequest := httptest.NewRequest("POST", "/test5?q1=value1", strings.NewReader("f1=form1&text=%3Csms+%26+more%3E"))
+	formRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	os.Setenv("TEST_RULE_TOKEN", "token-value")
+	defer os.Unsetenv("TEST_RULE_TOKEN")
+	requestWithMeta := httptest.NewRequest("PUT", "/test9", strings.NewReader(""))
+	requestWithMeta.Header.Set("X-Request-Id", "r-1")
+	requestWithMeta.AddCookie(&http.Cookie{Name: "session", Value: "s-2"})
 	table := []struct {
 		name     string
 		rule     Rule
@@ -70,13 +82,516 @@ func TestHandleRule(t *testing.T) {
 			request:  httptest.NewRequest("GET", "/test1?q1=value1", strings.NewReader("")),
 			expected: `{"rule": "test4", "query": "value1"}`,
 		},
+		{
+			name: "Подстановка GET-параметров и полей формы вместе",
+			rule: Rule{
+				To: To{
+					Data:   `<sms><q>%QUERY[q1]%</q><f>%FORM[f1]%</f><text>%FORM[text]%</text></sms>`,
+					Escape: "xml",
+				},
+			},
+			request:  formRequest,
+			expected: `<sms><q>value1</q><f>form1</f><text>&lt;sms &amp; more&gt;</text></sms>`,
+		},
+		{
+			name: "Подстановка значений по JSON-пути",
+			rule: Rule{
+				To: To{
+					Data:   `{"to": "%JSON[$.message.to]%", "text": "%JSON[$.message.text]%", "count": %JSON[$.message.count]%, "flag": %JSON[$.flag]%, "first": "%JSON[$.list[0].id]%", "missing": "%JSON[$.none|-]%"}`,
+					Escape: "json",
+				},
+			},
+			request:  httptest.NewRequest("POST", "/test6", strings.NewReader(`{"flag": true, "list": [{"id": "a"}], "message": {"count": 2, "text": "say \"hi\"", "to": "7900"}}`)),
+			expected: `{"to": "7900", "text": "say \"hi\"", "count": 2, "flag": true, "first": "a", "missing": "-"}`,
+		},
+		{
+			name: "Цикл по JSON-массиву",
+			rule: Rule{
+				To: To{
+					Data: `%EACH JSON[$.to[*]]%<to>%ITEM%</to>%END%`,
+				},
+			},
+			request:  httptest.NewRequest("POST", "/test7", strings.NewReader(`{"to": ["7900", "7901"]}`)),
+			expected: `<to>7900</to><to>7901</to>`,
+		},
+		{
+			name: "Подстановка данных запроса",
+			rule: Rule{
+				To: To{
+					Data: `%METHOD% %PATH% %HEADER[X-Request-Id]% %COOKIE[session]% %REMOTE_ADDR% %COOKIE[none|-]%`,
+				},
+			},
+			request:  requestWithMeta,
+			expected: `PUT /test9 r-1 s-2 192.0.2.1 -`,
+		},
+		{
+			name: "Переменные окружения",
+			rule: Rule{
+				To: To{
+					Data: `%ENV[TEST_RULE_TOKEN]% %ENV[TEST_RULE_MISSING|none]%`,
+				},
+			},
+			request:  httptest.NewRequest("GET", "/env", strings.NewReader("")),
+			expected: `token-value none`,
+		},
+		{
+			name: "Функции преобразования значений",
+			rule: Rule{
+				To: To{
+					Data:   `<receivedts>%QUERY[receivedts]|unix_to_rfc3339%</receivedts><status>%QUERY[status]|upper%</status>`,
+					Escape: "xml",
+				},
+			},
+			request:  httptest.NewRequest("GET", "/dlr?receivedts=1577836800&status=delivrd", strings.NewReader("")),
+			expected: `<receivedts>2020-01-01T00:00:00Z</receivedts><status>DELIVRD</status>`,
+		},
+		{
+			name: "Подстановка значений по XPath",
+			rule: Rule{
+				To: To{
+					Data:   `{"from": "%XPATH[//sms:from]%", "id": "%XPATH[//sms:report/@id]%", "text": "%XPATH[//sms:text]%"}`,
+					Escape: "json",
+				},
+				Namespaces: map[string]string{"sms": "urn:sms"},
+			},
+			request:  httptest.NewRequest("POST", "/test8", strings.NewReader(`<r:report xmlns:r="urn:sms" id="42"><r:from> 7900 </r:from><r:text><![CDATA["hi" & bye]]></r:text></r:report>`)),
+			expected: `{"from": "7900", "id": "42", "text": "\"hi\" & bye"}`,
+		},
+		{
+			name: "URL-кодированный текст в теле остаётся как есть",
+			rule: Rule{
+				To: To{
+					Data: `text=%D0%9F%D1%80&name=%C3%A9&sale=50%OFF%&q=%QUERY[q1]%`,
+				},
+			},
+			request:  httptest.NewRequest("GET", "/test10?q1=value1", strings.NewReader("")),
+			expected: `text=%D0%9F%D1%80&name=%C3%A9&sale=50%OFF%&q=value1`,
+		},
 	}
 	for _, item := range table {
 		t.Run(item.name, func(t *testing.T) {
-			_, body := HandleRule(item.rule, item.request)
+			_, body, err := HandleRule(item.rule, NewRequest(item.request))
+			if err != nil {
+				t.Errorf("Ошибка формирования запроса. Expected nil, got %v", err)
+			}
 			if string(body) != item.expected {
 				t.Errorf("Неверный новый запрос. Expected %v, got %q, len %d", item.expected, body, len(body))
 			}
 		})
 	}
 }
+
+func TestResetCacheConcurrent(t *testing.T) {
+	rule := Rule{To: To{Data: `{"status": "%QUERY[status]%"}`}}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				request := httptest.NewRequest("GET", "/dlr?status=ok", strings.NewReader(""))
+				if _, body, err := HandleRule(rule, NewRequest(request)); err != nil || string(body) != `{"status": "ok"}` {
+					t.Errorf("Неверный ответ. Expected {\"status\": \"ok\"}, got %s, %v", body, err)
+					return
+				}
+			}
+		}()
+	}
+	for j := 0; j < 100; j++ {
+		ResetCache()
+	}
+	wg.Wait()
+}
+
+func TestEnvSecret(t *testing.T) {
+	os.Setenv("TEST_RULE_ENV_SECRET", "env-secret-value")
+	defer os.Unsetenv("TEST_RULE_ENV_SECRET")
+	rule := Rule{To: To{Data: `%ENV[TEST_RULE_ENV_SECRET]%`}}
+	for i := 0; i < 2; i++ {
+		request := httptest.NewRequest("GET", "/", strings.NewReader(""))
+		if _, body, err := HandleRule(rule, NewRequest(request)); err != nil || string(body) != "env-secret-value" {
+			t.Fatalf("Неверный ответ. Expected env-secret-value, got %s, %v", body, err)
+		}
+	}
+	if got := secret.Redact("token env-secret-value"); got != "token "+secret.Mask {
+		t.Errorf("Значение окружения не скрыто: %s", got)
+	}
+}
+
+func TestHandleURL(t *testing.T) {
+	request := httptest.NewRequest("GET", "/dlr?smsid=1%2F2&status=ok", strings.NewReader(""))
+	request.Header.Set("X-Token", "secret")
+	rule := Rule{
+		To: To{
+			URL:     "https://example.com/dlr/%QUERY[smsid]%?status=%QUERY[status]%",
+			Headers: []string{"Authorization: Bearer %HEADER[X-Token]%", "X-Method: %METHOD%"},
+		},
+	}
+	target, err := HandleURL(rule, rule.To, NewRequest(request))
+	if err != nil {
+		t.Fatalf("Ошибка формирования адреса. Expected nil, got %v", err)
+	}
+	if expected := "https://example.com/dlr/1%2F2?status=ok"; target != expected {
+		t.Errorf("Неверный адрес. Expected %v, got %v", expected, target)
+	}
+	// Адрес, уже закодированный в конфигурации, не меняется
+	encoded := To{URL: "https://api.example.com/send?text=%D0%9F%D1%80&name=%C3%A9&id=%QUERY[status]%"}
+	target, err = HandleURL(rule, encoded, NewRequest(request))
+	if err != nil {
+		t.Fatalf("Ошибка формирования адреса. Expected nil, got %v", err)
+	}
+	if expected := "https://api.example.com/send?text=%D0%9F%D1%80&name=%C3%A9&id=ok"; target != expected {
+		t.Errorf("Неверный адрес. Expected %v, got %v", expected, target)
+	}
+	headers, _, err := HandleRule(rule, NewRequest(request))
+	if err != nil {
+		t.Fatalf("Ошибка формирования хедеров. Expected nil, got %v", err)
+	}
+	if expected := "Authorization: Bearer secret|X-Method: GET"; strings.Join(headers, "|") != expected {
+		t.Errorf("Неверные хедеры. Expected %v, got %v", expected, headers)
+	}
+}
+
+func TestHandleQuery(t *testing.T) {
+	request := httptest.NewRequest("GET", "/dlr?smsid=1&status=ok&token=secret&to=1&to=2", strings.NewReader(""))
+	request.Header.Set("X-Source", "world-sms")
+	table := []struct {
+		name     string
+		query    Query
+		expected string
+	}{
+		{
+			name:     "Все параметры по умолчанию",
+			expected: "smsid=1&status=ok&to=1&to=2&token=secret",
+		},
+		{
+			name:     "Разрешённые параметры",
+			query:    Query{Allow: []string{"smsid", "to"}},
+			expected: "smsid=1&to=1&to=2",
+		},
+		{
+			name:     "Запрещённые параметры",
+			query:    Query{Deny: []string{"token", "to"}},
+			expected: "smsid=1&status=ok",
+		},
+		{
+			name: "Переименование и новые параметры",
+			query: Query{
+				Deny:   []string{"token"},
+				Rename: map[string]string{"smsid": "id", "to": "phone"},
+				Set:    map[string]string{"source": "%HEADER[X-Source]%", "status": "%QUERY[status]%-1"},
+			},
+			expected: "id=1&phone=1&phone=2&source=world-sms&status=ok-1",
+		},
+		{
+			name: "Запрет всех параметров",
+			query: Query{
+				Deny: []string{DenyAll},
+				Set:  map[string]string{"id": "%QUERY[smsid]%"},
+			},
+			expected: "id=1",
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			query, err := HandleQuery(Rule{}, To{Query: item.query}, NewRequest(request))
+			if err != nil {
+				t.Fatalf("Ошибка формирования параметров. Expected nil, got %v", err)
+			}
+			if query.Encode() != item.expected {
+				t.Errorf("Неверные параметры. Expected %v, got %v", item.expected, query.Encode())
+			}
+		})
+	}
+}
+
+func TestMaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maps")
+	if err != nil {
+		t.Fatalf("Ошибка создания каталога: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	csvFile := filepath.Join(dir, "status.csv")
+	ioutil.WriteFile(csvFile, []byte("DELIVRD,delivered\nUNDELIV, failed\n\"A,B\",ab\n"), 0644)
+	jsonFile := filepath.Join(dir, "codes.json")
+	ioutil.WriteFile(jsonFile, []byte(`{"0": "ok", "1": "error"}`), 0644)
+	err = SetMaps(map[string]Map{
+		"dlr-status": Map{File: csvFile, Missing: MissingDefault, Default: "unknown"},
+		"codes":      Map{File: jsonFile},
+		"strict":     Map{Values: map[string]string{"a": "b"}, Missing: MissingError},
+	})
+	if err != nil {
+		t.Fatalf("Ошибка загрузки таблиц. Expected nil, got %v", err)
+	}
+	defer SetMaps(nil)
+	table := []struct {
+		name          string
+		data          string
+		expected      string
+		expectedError bool
+	}{
+		{
+			name:     "Ключ из вложенной подстановки",
+			data:     `%MAP[dlr-status][%QUERY[status]%]% %MAP[dlr-status][UNDELIV]% %MAP[dlr-status][A,B]%`,
+			expected: `delivered failed ab`,
+		},
+		{
+			name:     "Значение по умолчанию для отсутствующего ключа",
+			data:     `%MAP[dlr-status][%QUERY[missing]%]%`,
+			expected: `unknown`,
+		},
+		{
+			name:     "Отсутствующий ключ без изменений",
+			data:     `%MAP[codes][%QUERY[code]%]% %MAP[codes][%QUERY[status]|lower%]%`,
+			expected: `ok delivrd`,
+		},
+		{
+			name:     "Значение по умолчанию подстановки",
+			data:     `%MAP[strict][a]|upper% %MAP[codes][%QUERY[none]%|-]%`,
+			expected: `B -`,
+		},
+		{
+			name:          "Ошибка для отсутствующего ключа",
+			data:          `%MAP[strict][%QUERY[status]%]%`,
+			expectedError: true,
+		},
+		{
+			name:          "Неизвестная таблица",
+			data:          `%MAP[none][a]%`,
+			expectedError: true,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/dlr?status=DELIVRD&code=0", strings.NewReader(""))
+			_, body, err := HandleRule(Rule{To: To{Data: item.data}}, NewRequest(request))
+			if item.expectedError {
+				if _, ok := err.(*RenderError); !ok {
+					t.Errorf("Expected RenderError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Ошибка формирования запроса. Expected nil, got %v", err)
+			}
+			if string(body) != item.expected {
+				t.Errorf("Неверный запрос. Expected %v, got %q", item.expected, body)
+			}
+		})
+	}
+}
+
+func TestMatchMethod(t *testing.T) {
+	table := []struct {
+		name     string
+		from     From
+		method   string
+		expected bool
+	}{
+		{
+			name:     "Совпадение метода",
+			from:     From{HTTPMethod: "GET"},
+			method:   "GET",
+			expected: true,
+		},
+		{
+			name:     "Несовпадение метода",
+			from:     From{HTTPMethod: "GET"},
+			method:   "POST",
+			expected: false,
+		},
+		{
+			name:     "Регистр метода не важен",
+			from:     From{HTTPMethod: "post"},
+			method:   "POST",
+			expected: true,
+		},
+		{
+			name:     "Любой метод",
+			from:     From{HTTPMethod: "*"},
+			method:   "DELETE",
+			expected: true,
+		},
+		{
+			name:     "Метод не указан",
+			from:     From{},
+			method:   "PUT",
+			expected: true,
+		},
+		{
+			name:     "Список методов",
+			from:     From{HTTPMethod: "GET, HEAD"},
+			method:   "HEAD",
+			expected: true,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			if got := item.from.MatchMethod(item.method); got != item.expected {
+				t.Errorf("Неверный результат. Expected %v, got %v", item.expected, got)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	absent := false
+	formRequest := httptest.NewRequest("POST", "/test", strings.NewReader("kind=inbound&text=hello"))
+	formRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	headerRequest := httptest.NewRequest("GET", "/test", nil)
+	headerRequest.Header.Set("X-Provider", "world-sms-42")
+	table := []struct {
+		name     string
+		match    Match
+		request  *http.Request
+		expected bool
+	}{
+		{
+			name:     "Без условий",
+			request:  httptest.NewRequest("GET", "/test", nil),
+			expected: true,
+		},
+		{
+			name: "GET-параметр равен значению",
+			match: Match{
+				Query: []Condition{Condition{Name: "type", Equals: "dlr"}},
+			},
+			request:  httptest.NewRequest("GET", "/test?type=dlr", nil),
+			expected: true,
+		},
+		{
+			name: "GET-параметр не равен значению",
+			match: Match{
+				Query: []Condition{Condition{Name: "type", Equals: "dlr"}},
+			},
+			request:  httptest.NewRequest("GET", "/test?type=mo", nil),
+			expected: false,
+		},
+		{
+			name: "GET-параметр существует",
+			match: Match{
+				Query: []Condition{Condition{Name: "smsid"}},
+			},
+			request:  httptest.NewRequest("GET", "/test?smsid=", nil),
+			expected: true,
+		},
+		{
+			name: "GET-параметр должен отсутствовать",
+			match: Match{
+				Query: []Condition{Condition{Name: "smsid", Exists: &absent}},
+			},
+			request:  httptest.NewRequest("GET", "/test?smsid=1", nil),
+			expected: false,
+		},
+		{
+			name: "Хедер по регулярному выражению",
+			match: Match{
+				Headers: []Condition{Condition{Name: "x-provider", Regex: `^world-sms-\d+$`}},
+			},
+			request:  headerRequest,
+			expected: true,
+		},
+		{
+			name: "Тело по регулярному выражению",
+			match: Match{
+				Body: `<DeliveryReport>`,
+			},
+			request:  httptest.NewRequest("POST", "/test", strings.NewReader("<DeliveryReport></DeliveryReport>")),
+			expected: true,
+		},
+		{
+			name: "Значение по JSON-пути",
+			match: Match{
+				JSON: []Condition{Condition{Name: "$.message.type", Equals: "dlr"}},
+			},
+			request:  httptest.NewRequest("POST", "/test", strings.NewReader(`{"message": {"type": "dlr"}}`)),
+			expected: true,
+		},
+		{
+			name: "Тело не JSON",
+			match: Match{
+				JSON: []Condition{Condition{Name: "$.message.type", Equals: "dlr"}},
+			},
+			request:  httptest.NewRequest("POST", "/test", strings.NewReader("type=dlr")),
+			expected: false,
+		},
+		{
+			name: "Поле формы",
+			match: Match{
+				Form: []Condition{Condition{Name: "kind", Equals: "inbound"}},
+			},
+			request:  formRequest,
+			expected: true,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			from := From{Match: item.match}
+			if got := from.Matches(NewRequest(item.request)); got != item.expected {
+				t.Errorf("Неверный результат. Expected %v, got %v", item.expected, got)
+			}
+		})
+	}
+}
+
+func TestHandleResponse(t *testing.T) {
+	upstream := &Upstream{
+		StatusCode: 202,
+		Header:     http.Header{"X-Message-Id": []string{"42"}},
+		Body:       []byte(`<soap:Envelope><soap:Body><status>queued</status></soap:Body></soap:Envelope>`),
+	}
+	upstreams := map[string]*Upstream{
+		"soap":    upstream,
+		"billing": &Upstream{StatusCode: 200, Header: http.Header{}, Body: []byte(`{"balance": 10.5, "currency": "RUB"}`)},
+		"profile": &Upstream{StatusCode: 200, Header: http.Header{}, Body: []byte(`{"name": "Tom"}`)},
+		"audit":   nil,
+	}
+	table := []struct {
+		name     string
+		response Response
+		expected string
+	}{
+		{
+			name:     "Статус и хедер ответа",
+			response: Response{Data: `{"status": %UPSTREAM_STATUS%, "id": "%UPSTREAM_HEADER[X-Message-Id]%"}`},
+			expected: `{"status": 202, "id": "42"}`,
+		},
+		{
+			name:     "Поиск по телу ответа",
+			response: Response{Data: `{"state": "%UPSTREAM_REGEX[<status>([^<]+)][1]%"}`},
+			expected: `{"state": "queued"}`,
+		},
+		{
+			name:     "XPath по телу ответа",
+			response: Response{Data: `{"state": "%UPSTREAM_XPATH[//Body/status]%"}`},
+			expected: `{"state": "queued"}`,
+		},
+		{
+			name:     "Тело ответа и тело запроса",
+			response: Response{Data: `%BODY%:%UPSTREAM_BODY%`},
+			expected: `request:<soap:Envelope><soap:Body><status>queued</status></soap:Body></soap:Envelope>`,
+		},
+		{
+			name:     "Ответы адресатов по именам",
+			response: Response{Data: `{"name": "%UPSTREAM[profile].JSON[$.name]%", "balance": %UPSTREAM[billing].JSON[$.balance]%, "state": "%UPSTREAM[soap].XPATH[//Body/status]%", "code": %UPSTREAM[billing].STATUS%}`},
+			expected: `{"name": "Tom", "balance": 10.5, "state": "queued", "code": 200}`,
+		},
+		{
+			name:     "Адресат без ответа",
+			response: Response{Data: `%UPSTREAM[audit].JSON[$.id|none]% %IF UPSTREAM[audit]%yes%ELSE%no%END%`},
+			expected: `none no`,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			request := httptest.NewRequest("POST", "/test", strings.NewReader("request"))
+			_, body, err := HandleResponse(Rule{Response: item.response}, NewRequest(request), upstream, upstreams)
+			if err != nil {
+				t.Errorf("Ошибка формирования ответа. Expected nil, got %v", err)
+			}
+			if string(body) != item.expected {
+				t.Errorf("Неверный ответ. Expected %v, got %q", item.expected, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package secret
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mask заменяет секретные значения в логах и сообщениях об ошибках
+const Mask = "******"
+
+// minLength - значения короче не считаются секретами, чтобы не скрывать случайные совпадения
+const minLength = 4
+
+// values известные секретные значения
+var values = map[string]bool{}
+
+// replacer заменяет все известные секретные значения на Mask
+var replacer = strings.NewReplacer()
+
+// mutex защищает values и replacer от одновременного доступа
+var mutex sync.RWMutex
+
+// Add запоминает секретные значения, которые нужно скрывать
+func Add(secrets ...string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	added := false
+	for _, value := range secrets {
+		if len(value) >= minLength && !values[value] {
+			values[value] = true
+			added = true
+		}
+	}
+	if !added {
+		return
+	}
+	// Длинные значения заменяем первыми, чтобы секрет, содержащий другой секрет, скрывался целиком
+	sorted := make([]string, 0, len(values))
+	for value := range values {
+		sorted = append(sorted, value)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return len(sorted[i]) > len(sorted[j])
+	})
+	pairs := make([]string, 0, len(sorted)*2)
+	for _, value := range sorted {
+		pairs = append(pairs, value, Mask)
+	}
+	replacer = strings.NewReplacer(pairs...)
+}
+
+// Redact скрывает известные секретные значения в тексте
+func Redact(text string) string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return replacer.Replace(text)
+}
+
+// Formatter скрывает секретные значения в сообщениях и строковых полях логов
+type Formatter struct {
+	log.Formatter
+}
+
+// Format скрывает секреты и передаёт запись исходному форматтеру
+func (formatter *Formatter) Format(entry *log.Entry) ([]byte, error) {
+	entry.Message = Redact(entry.Message)
+	for key, value := range entry.Data {
+		if text, ok := value.(string); ok {
+			entry.Data[key] = Redact(text)
+		}
+	}
+	return formatter.Formatter.Format(entry)
+}
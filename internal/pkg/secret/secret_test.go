@@ -0,0 +1,55 @@
+package secret
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	Add("token-123", "token-123-long", "abc", "")
+	table := []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{
+			name:     "Секрет в тексте",
+			text:     "Authorization: Bearer token-123",
+			expected: "Authorization: Bearer " + Mask,
+		},
+		{
+			name:     "Длинный секрет скрывается целиком",
+			text:     "key=token-123-long",
+			expected: "key=" + Mask,
+		},
+		{
+			name:     "Короткие значения не скрываются",
+			text:     "abc",
+			expected: "abc",
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			if got := Redact(item.text); got != item.expected {
+				t.Errorf("Неверный результат. Expected %q, got %q", item.expected, got)
+			}
+		})
+	}
+}
+
+func TestFormatter(t *testing.T) {
+	Add("password-42")
+	var buffer bytes.Buffer
+	logger := log.New()
+	logger.Out = &buffer
+	logger.Formatter = &Formatter{Formatter: &log.TextFormatter{DisableTimestamp: true}}
+	logger.WithField("header", "Basic password-42").Infof("Request: %s", "?key=password-42")
+	if strings.Contains(buffer.String(), "password-42") {
+		t.Errorf("Секрет попал в лог: %s", buffer.String())
+	}
+	if !strings.Contains(buffer.String(), Mask) {
+		t.Errorf("В логе нет маски: %s", buffer.String())
+	}
+}
@@ -0,0 +1,194 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"platform-service-bus/internal/pkg/adapter"
+	"platform-service-bus/internal/pkg/config"
+	"platform-service-bus/internal/pkg/queue"
+	"platform-service-bus/internal/pkg/rule"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Supervisor управляет запущенными адаптерами и перезагрузкой конфигурации
+type Supervisor struct {
+	configPath string
+	mutex      sync.Mutex
+	// adapters - запущенные адаптеры по номеру порта
+	adapters map[int]*adapter.Adapter
+	// files - отслеживаемые файлы и время их последнего изменения
+	files map[string]time.Time
+}
+
+// New создаёт Supervisor для указанного файла конфигурации
+func New(configPath string) *Supervisor {
+	return &Supervisor{
+		configPath: configPath,
+		adapters:   make(map[int]*adapter.Adapter),
+		files:      make(map[string]time.Time),
+	}
+}
+
+// reloadTimeout ограничивает время ожидания завершения запросов перезапускаемых адаптеров
+const reloadTimeout = 30 * time.Second
+
+// Start загружает конфигурацию и запускает все адаптеры
+// Если хотя бы один адаптер не удалось запустить, остальные останавливаются
+func (supervisor *Supervisor) Start(ctx context.Context) error {
+	if err := supervisor.Reload(ctx); err != nil {
+		supervisor.Shutdown(ctx)
+		return err
+	}
+	return nil
+}
+
+// Reload перечитывает конфигурацию и перезапускает изменившиеся адаптеры
+// Если новая конфигурация некорректна, продолжают работать прежние адаптеры
+func (supervisor *Supervisor) Reload(ctx context.Context) error {
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+	log.Infof("Загружаем %s", supervisor.configPath)
+	configObject, err := config.Validate(supervisor.configPath)
+	if err != nil {
+		log.Errorf("Ошибка загрузки конфигурации, продолжаем работу с прежней: %v", err)
+		// Запоминаем время изменения, чтобы не перечитывать тот же некорректный файл
+		supervisor.files[supervisor.configPath] = modTime(supervisor.configPath)
+		return err
+	}
+	if err := rule.SetMaps(configObject.Maps); err != nil {
+		log.Errorf("Ошибка загрузки таблиц соответствия, продолжаем работу с прежней конфигурацией: %v", err)
+		supervisor.files[supervisor.configPath] = modTime(supervisor.configPath)
+		return err
+	}
+	rule.ResetCache()
+	supervisor.files = supervisor.snapshot(configObject)
+	return supervisor.apply(ctx, configObject)
+}
+
+// apply сравнивает запущенные адаптеры с новой конфигурацией
+// Удалённые адаптеры останавливаются, изменившиеся перезапускаются, новые запускаются
+// Если изменившийся адаптер не удалось запустить, возвращается прежняя версия
+func (supervisor *Supervisor) apply(ctx context.Context, configObject config.Config) error {
+	queueDir := configObject.QueueDir
+	if queueDir == "" {
+		queueDir = queue.DefaultDir
+	}
+	next := make(map[int]*adapter.Adapter)
+	for i := range configObject.Adapters {
+		configObject.Adapters[i].SetQueueDir(queueDir)
+		next[configObject.Adapters[i].Port] = &configObject.Adapters[i]
+	}
+	previous := make(map[int]*adapter.Adapter)
+	for port, running := range supervisor.adapters {
+		if updated, prs := next[port]; !prs || !running.Equal(updated) {
+			if err := running.Shutdown(ctx); err != nil {
+				log.Errorf("Адаптер '%s':%d остановлен принудительно: %v", running.Name, port, err)
+			}
+			delete(supervisor.adapters, port)
+			previous[port] = running
+		}
+	}
+	errs := []string{}
+	for port, updated := range next {
+		if _, prs := supervisor.adapters[port]; prs {
+			continue
+		}
+		if err := updated.Start(ctx); err != nil {
+			log.Error(err)
+			errs = append(errs, err.Error())
+			if old, prs := previous[port]; prs && old.Start(ctx) == nil {
+				supervisor.adapters[port] = old
+			}
+			continue
+		}
+		supervisor.adapters[port] = updated
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Shutdown останавливает все адаптеры, дожидаясь завершения обрабатываемых запросов
+func (supervisor *Supervisor) Shutdown(ctx context.Context) error {
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(supervisor.adapters))
+	for port, running := range supervisor.adapters {
+		wg.Add(1)
+		go func(running *adapter.Adapter) {
+			defer wg.Done()
+			if err := running.Shutdown(ctx); err != nil {
+				errs <- err
+			}
+		}(running)
+		delete(supervisor.adapters, port)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// snapshot запоминает время изменения файла конфигурации и файлов шаблонов
+func (supervisor *Supervisor) snapshot(configObject config.Config) map[string]time.Time {
+	files := map[string]time.Time{supervisor.configPath: modTime(supervisor.configPath)}
+	for _, adapterObject := range configObject.Adapters {
+		for _, ruleObject := range adapterObject.Rules {
+			for _, fileName := range ruleObject.DataFiles() {
+				files[fileName] = modTime(fileName)
+			}
+		}
+	}
+	for _, m := range configObject.Maps {
+		if m.File != "" {
+			files[m.File] = modTime(m.File)
+		}
+	}
+	return files
+}
+
+// changed сообщает, изменился ли какой-либо из отслеживаемых файлов
+func (supervisor *Supervisor) changed() bool {
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+	for fileName, known := range supervisor.files {
+		if !modTime(fileName).Equal(known) {
+			log.Infof("Изменён файл %s", fileName)
+			return true
+		}
+	}
+	return false
+}
+
+// Watch периодически проверяет файлы и перезагружает конфигурацию при их изменении
+// Работает до закрытия канала stop
+func (supervisor *Supervisor) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if supervisor.changed() {
+				ctx, cancel := context.WithTimeout(context.Background(), reloadTimeout)
+				supervisor.Reload(ctx)
+				cancel()
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// modTime возвращает время изменения файла или нулевое время, если файла нет
+func modTime(fileName string) time.Time {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,173 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// freePort подбирает свободный порт
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// get выполняет запрос к адаптеру, дожидаясь запуска сервера
+func get(t *testing.T, url string) string {
+	var lastErr error
+	for i := 0; i < 50; i++ {
+		response, err := http.Get(url)
+		if err == nil {
+			body, _ := ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			return string(body)
+		}
+		lastErr = err
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Адаптер недоступен: %v", lastErr)
+	return ""
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervisor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "config.json")
+	templatePath := filepath.Join(dir, "template.txt")
+	port := freePort(t)
+	writeConfig := func(data string) {
+		config := fmt.Sprintf(`{"adapters": [{"name": "Test", "port": %d, "rules": [
+			{"from": {"path": "/inline"}, "to": {"data": %q}},
+			{"from": {"path": "/file"}, "to": {"data-file": %q}}
+		]}]}`, port, data, templatePath)
+		if err := ioutil.WriteFile(configPath, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("v1")
+	ioutil.WriteFile(templatePath, []byte("file v1"), 0644)
+
+	bus := New(configPath)
+	if err := bus.Start(context.Background()); err != nil {
+		t.Fatalf("Ошибка запуска. Expected nil, got %v", err)
+	}
+	defer bus.Shutdown(context.Background())
+	url := fmt.Sprintf("http://127.0.0.1:%d", port)
+
+	table := []struct {
+		name          string
+		change        func()
+		path          string
+		expected      string
+		expectedError bool
+	}{
+		{
+			name:     "Исходная конфигурация",
+			change:   func() {},
+			path:     "/inline",
+			expected: "v1",
+		},
+		{
+			name:     "Изменённое правило",
+			change:   func() { writeConfig("v2") },
+			path:     "/inline",
+			expected: "v2",
+		},
+		{
+			name:     "Изменённый шаблон",
+			change:   func() { ioutil.WriteFile(templatePath, []byte("file v2"), 0644) },
+			path:     "/file",
+			expected: "file v2",
+		},
+		{
+			name:          "Некорректная конфигурация не применяется",
+			change:        func() { ioutil.WriteFile(configPath, []byte("{adapters"), 0644) },
+			path:          "/inline",
+			expected:      "v2",
+			expectedError: true,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			// Шаблон читается в кэш при первом запросе
+			get(t, url+"/file")
+			item.change()
+			err := bus.Reload(context.Background())
+			if item.expectedError && err == nil {
+				t.Errorf("Expected an error, got nil")
+			} else if !item.expectedError && err != nil {
+				t.Errorf("Expected nil, got %v", err)
+			}
+			if got := get(t, url+item.path); got != item.expected {
+				t.Errorf("Неверный ответ. Expected %v, got %v", item.expected, got)
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervisor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(configPath, []byte(`{"adapters": []}`), 0644)
+
+	bus := New(configPath)
+	if err := bus.Start(context.Background()); err != nil {
+		t.Fatalf("Ошибка запуска. Expected nil, got %v", err)
+	}
+	defer bus.Shutdown(context.Background())
+	if bus.changed() {
+		t.Errorf("Файлы не менялись, но обнаружено изменение")
+	}
+	// Сдвигаем время изменения, чтобы не зависеть от точности файловой системы
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(configPath, future, future)
+	if !bus.changed() {
+		t.Errorf("Изменение файла конфигурации не обнаружено")
+	}
+	stop := make(chan struct{})
+	go bus.Watch(5*time.Millisecond, stop)
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	if bus.changed() {
+		t.Errorf("Конфигурация не перезагружена после изменения")
+	}
+}
+
+func TestStartPortConflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervisor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	port := freePort(t)
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	configPath := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(configPath, []byte(fmt.Sprintf(`{"adapters": [{"name": "Busy", "port": %d}]}`, port)), 0644)
+
+	bus := New(configPath)
+	if err := bus.Start(context.Background()); err == nil {
+		bus.Shutdown(context.Background())
+		t.Errorf("Expected an error for busy port, got nil")
+	}
+}
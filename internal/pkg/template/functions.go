@@ -0,0 +1,258 @@
+package template
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Требования функции к аргументу после двоеточия
+const (
+	ArgNone = iota
+	ArgOptional
+	ArgRequired
+)
+
+// Function - функция преобразования значения подстановки
+type Function struct {
+	// Apply преобразует значение, arg - аргумент вызова или пустая строка
+	Apply func(value Value, arg string) (Value, error)
+	// Arg - требования к аргументу: ArgNone, ArgOptional или ArgRequired
+	Arg int
+	// Check проверяет аргумент при разборе шаблона, может быть nil
+	Check func(arg string) error
+}
+
+// functions реестр функций преобразования по имени
+var functions = map[string]Function{}
+
+// functionsMutex защищает functions от одновременного доступа
+var functionsMutex sync.RWMutex
+
+// RegisterFunction добавляет функцию преобразования в реестр или заменяет существующую
+func RegisterFunction(name string, function Function) {
+	functionsMutex.Lock()
+	functions[name] = function
+	functionsMutex.Unlock()
+}
+
+// LookupFunction возвращает функцию преобразования по имени
+func LookupFunction(name string) (Function, bool) {
+	functionsMutex.RLock()
+	function, prs := functions[name]
+	functionsMutex.RUnlock()
+	return function, prs
+}
+
+// checkCall проверяет, что функция существует и аргумент ей подходит
+func checkCall(call Call) error {
+	function, prs := LookupFunction(call.Name)
+	if !prs {
+		return fmt.Errorf("неизвестная функция %s", call.Name)
+	}
+	switch {
+	case function.Arg == ArgNone && call.HasArg:
+		return fmt.Errorf("функция %s не принимает аргумент", call.Name)
+	case function.Arg == ArgRequired && !call.HasArg:
+		return fmt.Errorf("функции %s требуется аргумент", call.Name)
+	}
+	if function.Check != nil && call.HasArg {
+		if err := function.Check(call.Arg); err != nil {
+			return fmt.Errorf("функция %s: %v", call.Name, err)
+		}
+	}
+	return nil
+}
+
+// applyCalls применяет функции преобразования к значению по порядку
+func applyCalls(value Value, calls []Call) (Value, error) {
+	for _, call := range calls {
+		function, prs := LookupFunction(call.Name)
+		if !prs {
+			return value, fmt.Errorf("неизвестная функция %s", call.Name)
+		}
+		var err error
+		value, err = function.Apply(value, call.Arg)
+		if err != nil {
+			return value, fmt.Errorf("функция %s: %v", call.Name, err)
+		}
+	}
+	return value, nil
+}
+
+// text создаёт функцию, результат которой - обычный текст
+func text(apply func(text string, arg string) (string, error), arg int, check func(arg string) error) Function {
+	return Function{
+		Apply: func(value Value, argument string) (Value, error) {
+			result, err := apply(value.Text, argument)
+			return Value{Text: result}, err
+		},
+		Arg:   arg,
+		Check: check,
+	}
+}
+
+// escaper создаёт функцию экранирования, результат которой не экранируется форматом шаблона
+func escaper(format string) Function {
+	return Function{
+		Apply: func(value Value, arg string) (Value, error) {
+			escaped, err := Escape(Value{Text: value.Text}, format)
+			return Value{Text: escaped, Raw: true}, err
+		},
+	}
+}
+
+// hash создаёт функцию, возвращающую шестнадцатеричный хэш значения
+func hash(sum func(data []byte) []byte) Function {
+	return text(func(value string, arg string) (string, error) {
+		return hex.EncodeToString(sum([]byte(value))), nil
+	}, ArgNone, nil)
+}
+
+// parseUnix разбирает время в секундах или миллисекундах с начала эпохи, допускается дробная часть
+func parseUnix(value string, unit time.Duration) (time.Time, error) {
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("ожидается число, получено %q", value)
+	}
+	return time.Unix(0, int64(number*float64(unit))).UTC(), nil
+}
+
+// parseTime разбирает время в формате RFC3339 или в секундах с начала эпохи
+func parseTime(value string) (time.Time, error) {
+	if parsed, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(value)); err == nil {
+		return parsed, nil
+	}
+	parsed, err := parseUnix(value, time.Second)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("ожидается время в формате RFC3339 или unix, получено %q", value)
+	}
+	return parsed, nil
+}
+
+// parseLookup разбирает таблицу вида key=value,key2=value2,*=default
+func parseLookup(arg string) (map[string]string, error) {
+	table := make(map[string]string)
+	for _, pair := range strings.Split(arg, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("элемент таблицы %q должен иметь вид key=value", pair)
+		}
+		table[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return table, nil
+}
+
+// parseDecimals разбирает количество знаков после запятой
+func parseDecimals(arg string) (int, error) {
+	decimals, err := strconv.Atoi(arg)
+	if err != nil || decimals < 0 || decimals > 20 {
+		return 0, fmt.Errorf("количество знаков должно быть числом от 0 до 20, получено %q", arg)
+	}
+	return decimals, nil
+}
+
+func init() {
+	RegisterFunction("upper", text(func(value string, arg string) (string, error) {
+		return strings.ToUpper(value), nil
+	}, ArgNone, nil))
+	RegisterFunction("lower", text(func(value string, arg string) (string, error) {
+		return strings.ToLower(value), nil
+	}, ArgNone, nil))
+	RegisterFunction("trim", text(func(value string, arg string) (string, error) {
+		if arg == "" {
+			return strings.TrimSpace(value), nil
+		}
+		return strings.Trim(value, arg), nil
+	}, ArgOptional, nil))
+	RegisterFunction("base64", text(func(value string, arg string) (string, error) {
+		return base64.StdEncoding.EncodeToString([]byte(value)), nil
+	}, ArgNone, nil))
+	RegisterFunction("base64_decode", text(func(value string, arg string) (string, error) {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		return string(decoded), err
+	}, ArgNone, nil))
+	RegisterFunction("md5", hash(func(data []byte) []byte {
+		sum := md5.Sum(data)
+		return sum[:]
+	}))
+	RegisterFunction("sha1", hash(func(data []byte) []byte {
+		sum := sha1.Sum(data)
+		return sum[:]
+	}))
+	RegisterFunction("sha256", hash(func(data []byte) []byte {
+		sum := sha256.Sum256(data)
+		return sum[:]
+	}))
+	RegisterFunction("url", escaper(FormatURL))
+	RegisterFunction("xml", escaper(FormatXML))
+	RegisterFunction("json", escaper(FormatJSON))
+	RegisterFunction("raw", Function{
+		Apply: func(value Value, arg string) (Value, error) {
+			value.Raw = true
+			return value, nil
+		},
+	})
+	RegisterFunction("unix_to_rfc3339", text(func(value string, arg string) (string, error) {
+		parsed, err := parseUnix(value, time.Second)
+		return parsed.Format(time.RFC3339), err
+	}, ArgNone, nil))
+	RegisterFunction("unix_ms_to_rfc3339", text(func(value string, arg string) (string, error) {
+		parsed, err := parseUnix(value, time.Millisecond)
+		return parsed.Format(time.RFC3339), err
+	}, ArgNone, nil))
+	RegisterFunction("rfc3339_to_unix", Function{
+		Apply: func(value Value, arg string) (Value, error) {
+			parsed, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(value.Text))
+			if err != nil {
+				return value, err
+			}
+			return Value{Text: strconv.FormatInt(parsed.Unix(), 10), JSON: true}, nil
+		},
+	})
+	RegisterFunction("date", text(func(value string, arg string) (string, error) {
+		parsed, err := parseTime(value)
+		return parsed.Format(arg), err
+	}, ArgRequired, nil))
+	RegisterFunction("number", Function{
+		Apply: func(value Value, arg string) (Value, error) {
+			decimals, err := parseDecimals(arg)
+			if err != nil {
+				return value, err
+			}
+			number, err := strconv.ParseFloat(strings.TrimSpace(value.Text), 64)
+			if err != nil {
+				return value, fmt.Errorf("ожидается число, получено %q", value.Text)
+			}
+			return Value{Text: strconv.FormatFloat(number, 'f', decimals, 64), JSON: true}, nil
+		},
+		Arg: ArgRequired,
+		Check: func(arg string) error {
+			_, err := parseDecimals(arg)
+			return err
+		},
+	})
+	RegisterFunction("lookup", text(func(value string, arg string) (string, error) {
+		table, err := parseLookup(arg)
+		if err != nil {
+			return "", err
+		}
+		if mapped, prs := table[value]; prs {
+			return mapped, nil
+		}
+		if fallback, prs := table["*"]; prs {
+			return fallback, nil
+		}
+		return value, nil
+	}, ArgRequired, func(arg string) error {
+		_, err := parseLookup(arg)
+		return err
+	}))
+}
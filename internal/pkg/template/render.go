@@ -0,0 +1,169 @@
+package template
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Value - значение подстановки
+type Value struct {
+	Text string
+	// JSON сообщает, что Text - готовый JSON-фрагмент (число, объект, массив),
+	// который вставляется в JSON-шаблон без экранирования
+	JSON bool
+	// Raw сообщает, что значение уже экранировано функцией и вставляется как есть
+	Raw bool
+}
+
+// Resolver предоставляет значения подстановок при отрисовке шаблона
+// Возвращает все значения подстановки: первое используется для вывода,
+// все - для циклов %EACH%. Отсутствие значения - пустой список
+type Resolver interface {
+	Resolve(placeholder *Placeholder) ([]Value, error)
+}
+
+// Форматы экранирования подставляемых значений
+const (
+	FormatNone = "none"
+	FormatXML  = "xml"
+	FormatJSON = "json"
+	FormatURL  = "url"
+)
+
+// Formats список поддерживаемых форматов экранирования
+var Formats = []string{"", FormatNone, FormatXML, FormatJSON, FormatURL}
+
+// Escape экранирует значение для вставки в текст указанного формата
+func Escape(value Value, format string) (string, error) {
+	if value.Raw {
+		return value.Text, nil
+	}
+	switch format {
+	case "", FormatNone:
+		return value.Text, nil
+	case FormatXML:
+		var buffer bytes.Buffer
+		xml.EscapeText(&buffer, []byte(value.Text))
+		return buffer.String(), nil
+	case FormatJSON:
+		if value.JSON {
+			return value.Text, nil
+		}
+		var buffer bytes.Buffer
+		encoder := json.NewEncoder(&buffer)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(value.Text)
+		encoded := strings.TrimSuffix(buffer.String(), "\n")
+		return encoded[1 : len(encoded)-1], nil
+	case FormatURL:
+		// Пробел кодируется как %20, а не +, чтобы значение было корректным и в пути, и в параметрах
+		return strings.Replace(url.QueryEscape(value.Text), "+", "%20", -1), nil
+	}
+	return "", fmt.Errorf("неизвестный формат экранирования %q", format)
+}
+
+// scope - значения текущей итерации цикла %EACH%
+type scope struct {
+	item  Value
+	index int
+}
+
+// renderer отрисовывает шаблон за один проход
+type renderer struct {
+	resolver Resolver
+	format   string
+	output   strings.Builder
+}
+
+// Render отрисовывает шаблон, экранируя подставляемые значения в формате format
+// Подставленные значения не разбираются повторно
+func (template *Template) Render(resolver Resolver, format string) (string, error) {
+	r := &renderer{resolver: resolver, format: format}
+	if err := r.render(template.nodes, nil); err != nil {
+		return "", err
+	}
+	return r.output.String(), nil
+}
+
+// resolve возвращает значения подстановки с учётом значения по умолчанию и области цикла
+func (r *renderer) resolve(placeholder *Placeholder, current *scope) ([]Value, error) {
+	var values []Value
+	switch {
+	case placeholder.Name == ItemName && current != nil && len(placeholder.Args) == 0:
+		values = []Value{current.item}
+	case placeholder.Name == IndexName && current != nil && len(placeholder.Args) == 0:
+		values = []Value{{Text: strconv.Itoa(current.index), JSON: true}}
+	default:
+		var err error
+		values, err = r.resolver.Resolve(placeholder)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", placeholder, err)
+		}
+	}
+	if placeholder.HasDefault && (len(values) == 0 || values[0].Text == "") {
+		values = []Value{{Text: placeholder.Default}}
+	}
+	if len(placeholder.Calls) == 0 {
+		return values, nil
+	}
+	transformed := make([]Value, 0, len(values))
+	for _, value := range values {
+		value, err := applyCalls(value, placeholder.Calls)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", placeholder, err)
+		}
+		transformed = append(transformed, value)
+	}
+	return transformed, nil
+}
+
+// render отрисовывает список узлов
+func (r *renderer) render(nodes []node, current *scope) error {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *textNode:
+			r.output.WriteString(n.text)
+		case *placeholderNode:
+			values, err := r.resolve(n.placeholder, current)
+			if err != nil {
+				return err
+			}
+			if len(values) == 0 {
+				continue
+			}
+			escaped, err := Escape(values[0], r.format)
+			if err != nil {
+				return err
+			}
+			r.output.WriteString(escaped)
+		case *ifNode:
+			values, err := r.resolve(n.condition, current)
+			if err != nil {
+				return err
+			}
+			body := n.otherwise
+			if (len(values) > 0 && values[0].Text != "") != n.negate {
+				body = n.then
+			}
+			if err := r.render(body, current); err != nil {
+				return err
+			}
+		case *eachNode:
+			values, err := r.resolve(n.source, current)
+			if err != nil {
+				return err
+			}
+			for i, value := range values {
+				if err := r.render(n.body, &scope{item: value, index: i}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,449 @@
+package template
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Placeholder описывает подстановку вида %NAME[arg1][arg2|default]|function:arg%
+type Placeholder struct {
+	Name string
+	Args []string
+	// Sub - уточнение после точки, например JSON[$.balance] в %UPSTREAM[billing].JSON[$.balance]%
+	Sub *Placeholder
+	// Default подставляется, если значение отсутствует или пустое
+	Default    string
+	HasDefault bool
+	// Calls - функции преобразования значения, применяемые по порядку
+	Calls []Call
+	// source - исходный текст подстановки для сообщений об ошибках
+	source string
+}
+
+// Call описывает вызов функции преобразования: |name или |name:arg
+type Call struct {
+	Name   string
+	Arg    string
+	HasArg bool
+}
+
+// String возвращает исходный текст подстановки
+func (placeholder *Placeholder) String() string {
+	return placeholder.source
+}
+
+// Arg возвращает аргумент с указанным индексом или пустую строку
+func (placeholder *Placeholder) Arg(index int) string {
+	if index < len(placeholder.Args) {
+		return placeholder.Args[index]
+	}
+	return ""
+}
+
+// node - узел разобранного шаблона
+type node interface{}
+
+// textNode - текст шаблона без подстановок
+type textNode struct {
+	text string
+}
+
+// placeholderNode - подстановка значения
+type placeholderNode struct {
+	placeholder *Placeholder
+}
+
+// ifNode - условный блок %IF NAME[...]%...%ELSE%...%END%
+type ifNode struct {
+	condition *Placeholder
+	negate    bool
+	then      []node
+	otherwise []node
+}
+
+// eachNode - цикл %EACH NAME[...]%...%END% по всем значениям подстановки
+type eachNode struct {
+	source *Placeholder
+	body   []node
+}
+
+// Template - разобранный шаблон
+type Template struct {
+	nodes []node
+	// unknown - теги с аргументами и незарегистрированным именем, оставленные в тексте
+	unknown []*Placeholder
+}
+
+// Имена служебных подстановок, доступных внутри %EACH%
+const (
+	ItemName  = "ITEM"
+	IndexName = "INDEX"
+)
+
+// placeholderNames реестр имён подстановок
+// Тег с незарегистрированным именем, например %D0% в URL-кодированном тексте, остаётся текстом
+var placeholderNames = map[string]bool{
+	ItemName:  true,
+	IndexName: true,
+}
+
+// placeholderNamesMutex защищает placeholderNames от одновременного доступа
+var placeholderNamesMutex sync.RWMutex
+
+// RegisterPlaceholder добавляет имена подстановок в реестр
+func RegisterPlaceholder(names ...string) {
+	placeholderNamesMutex.Lock()
+	for _, name := range names {
+		placeholderNames[name] = true
+	}
+	placeholderNamesMutex.Unlock()
+}
+
+// IsPlaceholder сообщает, зарегистрировано ли имя подстановки
+func IsPlaceholder(name string) bool {
+	placeholderNamesMutex.RLock()
+	defer placeholderNamesMutex.RUnlock()
+	return placeholderNames[name]
+}
+
+// Parse разбирает текст шаблона
+// Символ %, не начинающий корректную подстановку с зарегистрированным именем, остаётся в тексте как есть
+func Parse(text string) (*Template, error) {
+	parser := &parser{text: text}
+	nodes, terminator, err := parser.parseNodes()
+	if err != nil {
+		return nil, err
+	}
+	if parser.err != nil {
+		return nil, parser.err
+	}
+	if terminator != "" {
+		return nil, fmt.Errorf("%%%s%% без соответствующего %%IF%% или %%EACH%%", terminator)
+	}
+	return &Template{nodes: nodes, unknown: parser.unknown}, nil
+}
+
+// Unknown возвращает теги вида %NAME[arg]% с незарегистрированным именем
+// При отрисовке они остаются текстом, а проверка конфигурации сообщает о них как об опечатках
+func (template *Template) Unknown() []*Placeholder {
+	return template.unknown
+}
+
+// Placeholders возвращает все подстановки шаблона, включая условия и циклы
+func (template *Template) Placeholders() []*Placeholder {
+	result := []*Placeholder{}
+	var walk func(nodes []node)
+	walk = func(nodes []node) {
+		for _, n := range nodes {
+			switch n := n.(type) {
+			case *placeholderNode:
+				result = append(result, n.placeholder)
+			case *ifNode:
+				result = append(result, n.condition)
+				walk(n.then)
+				walk(n.otherwise)
+			case *eachNode:
+				result = append(result, n.source)
+				walk(n.body)
+			}
+		}
+	}
+	walk(template.nodes)
+	return result
+}
+
+// parser разбирает текст шаблона в дерево узлов
+type parser struct {
+	text string
+	pos  int
+	// err - первая ошибка в вызовах функций, которая делает шаблон некорректным
+	err error
+	// unknown - теги с аргументами и незарегистрированным именем
+	unknown []*Placeholder
+}
+
+// parseNodes разбирает узлы до конца текста или до %ELSE%/%END%
+// Возвращает имя завершившего блок тега или пустую строку в конце текста
+func (parser *parser) parseNodes() ([]node, string, error) {
+	nodes := []node{}
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, &textNode{text.String()})
+			text.Reset()
+		}
+	}
+	for parser.pos < len(parser.text) {
+		start := parser.pos
+		if parser.text[start] != '%' {
+			next := strings.IndexByte(parser.text[start:], '%')
+			if next == -1 {
+				next = len(parser.text) - start
+			}
+			text.WriteString(parser.text[start : start+next])
+			parser.pos = start + next
+			continue
+		}
+		keyword, placeholder, ok := parser.parseTag()
+		if !ok {
+			// Не подстановка - оставляем символ % в тексте
+			parser.pos = start + 1
+			text.WriteByte('%')
+			continue
+		}
+		flush()
+		switch keyword {
+		case "":
+			nodes = append(nodes, &placeholderNode{placeholder})
+		case "ELSE", "END":
+			return nodes, keyword, nil
+		case "IF", "IF !":
+			n := &ifNode{condition: placeholder, negate: keyword == "IF !"}
+			body, terminator, err := parser.parseNodes()
+			if err != nil {
+				return nil, "", err
+			}
+			n.then = body
+			if terminator == "ELSE" {
+				body, terminator, err = parser.parseNodes()
+				if err != nil {
+					return nil, "", err
+				}
+				n.otherwise = body
+			}
+			if terminator != "END" {
+				return nil, "", fmt.Errorf("не закрыт блок %%%s %s", keyword, placeholder.source[1:])
+			}
+			nodes = append(nodes, n)
+		case "EACH":
+			body, terminator, err := parser.parseNodes()
+			if err != nil {
+				return nil, "", err
+			}
+			if terminator != "END" {
+				return nil, "", fmt.Errorf("не закрыт блок %%EACH %s", placeholder.source[1:])
+			}
+			nodes = append(nodes, &eachNode{source: placeholder, body: body})
+		}
+	}
+	flush()
+	return nodes, "", nil
+}
+
+// parseTag разбирает тег, начинающийся с % в текущей позиции
+// Возвращает ключевое слово (IF, IF !, EACH, ELSE, END или пустую строку для подстановки)
+// Если тег некорректен, позиция не имеет значения и ok == false
+func (parser *parser) parseTag() (keyword string, placeholder *Placeholder, ok bool) {
+	parser.pos++
+	name := parser.parseName()
+	switch name {
+	case "":
+		return "", nil, false
+	case "ELSE", "END":
+		if parser.consume('%') {
+			return name, nil, true
+		}
+		return "", nil, false
+	case "IF", "EACH":
+		if !parser.consume(' ') {
+			break
+		}
+		keyword = name
+		if name == "IF" && parser.consume('!') {
+			keyword = "IF !"
+		}
+		start := parser.pos
+		name = parser.parseName()
+		if name == "" {
+			return "", nil, false
+		}
+		placeholder, ok = parser.parsePlaceholder(name, start)
+		return keyword, placeholder, ok
+	}
+	placeholder, ok = parser.parsePlaceholder(name, parser.pos-len(name))
+	return "", placeholder, ok
+}
+
+// known сообщает, зарегистрировано ли имя подстановки
+// Незарегистрированный тег с аргументами запоминается для Template.Unknown
+func (parser *parser) known(placeholder *Placeholder) bool {
+	if IsPlaceholder(placeholder.Name) {
+		return true
+	}
+	if len(placeholder.Args) > 0 {
+		parser.unknown = append(parser.unknown, placeholder)
+	}
+	return false
+}
+
+// parseName разбирает имя подстановки: заглавные латинские буквы, цифры и _
+func (parser *parser) parseName() string {
+	start := parser.pos
+	for parser.pos < len(parser.text) {
+		c := parser.text[parser.pos]
+		if (c >= 'A' && c <= 'Z') || c == '_' || (c >= '0' && c <= '9' && parser.pos > start) {
+			parser.pos++
+			continue
+		}
+		break
+	}
+	return parser.text[start:parser.pos]
+}
+
+// parsePlaceholder разбирает аргументы подстановки и закрывающий %
+// Подстановка с незарегистрированным именем не разбирается, и тег остаётся текстом
+func (parser *parser) parsePlaceholder(name string, start int) (*Placeholder, bool) {
+	placeholder := &Placeholder{Name: name}
+	if !parser.parseArgs(placeholder) {
+		return nil, false
+	}
+	// Значение по умолчанию относится к последнему аргументу всей подстановки, в том числе уточнения
+	last := placeholder
+	if parser.consume('.') {
+		subStart := parser.pos
+		last = &Placeholder{Name: parser.parseName()}
+		if last.Name == "" || !parser.parseArgs(last) {
+			return nil, false
+		}
+		last.source = parser.text[subStart:parser.pos]
+		placeholder.Sub = last
+	}
+	for parser.pos < len(parser.text) && parser.text[parser.pos] == '|' {
+		parser.pos++
+		call, ok := parser.parseCall()
+		if !ok {
+			return nil, false
+		}
+		placeholder.Calls = append(placeholder.Calls, call)
+	}
+	end := parser.pos
+	if !parser.consume('%') {
+		return nil, false
+	}
+	placeholder.source = "%" + parser.text[start:end] + "%"
+	// Значение по умолчанию указывается в последнем аргументе после |
+	if index := len(last.Args) - 1; index >= 0 {
+		last.Args[index], placeholder.Default, placeholder.HasDefault = splitDefault(last.Args[index])
+	}
+	if !parser.known(placeholder) {
+		return nil, false
+	}
+	for _, call := range placeholder.Calls {
+		if err := checkCall(call); err != nil && parser.err == nil {
+			parser.err = fmt.Errorf("подстановка %s: %v", placeholder.source, err)
+		}
+	}
+	return placeholder, true
+}
+
+// parseArgs разбирает аргументы подстановки в квадратных скобках
+func (parser *parser) parseArgs(placeholder *Placeholder) bool {
+	for parser.pos < len(parser.text) && parser.text[parser.pos] == '[' {
+		arg, ok := parser.parseArg()
+		if !ok {
+			return false
+		}
+		placeholder.Args = append(placeholder.Args, arg)
+	}
+	return true
+}
+
+// parseCall разбирает вызов функции name или name:arg до следующего | или закрывающего %
+// Символ \ в аргументе экранирует следующий символ
+func (parser *parser) parseCall() (Call, bool) {
+	start := parser.pos
+	for parser.pos < len(parser.text) {
+		c := parser.text[parser.pos]
+		if (c >= 'a' && c <= 'z') || c == '_' || (c >= '0' && c <= '9' && parser.pos > start) {
+			parser.pos++
+			continue
+		}
+		break
+	}
+	call := Call{Name: parser.text[start:parser.pos]}
+	if call.Name == "" {
+		return call, false
+	}
+	if !parser.consume(':') {
+		return call, true
+	}
+	call.HasArg = true
+	var arg strings.Builder
+	for parser.pos < len(parser.text) {
+		c := parser.text[parser.pos]
+		if c == '|' || c == '%' {
+			break
+		}
+		if c == '\\' && parser.pos+1 < len(parser.text) {
+			parser.pos++
+			c = parser.text[parser.pos]
+		}
+		arg.WriteByte(c)
+		parser.pos++
+	}
+	call.Arg = arg.String()
+	return call, true
+}
+
+// parseArg разбирает аргумент в квадратных скобках с учётом вложенных скобок
+// Символ \ экранирует следующий символ и сохраняется в аргументе
+func (parser *parser) parseArg() (string, bool) {
+	depth := 0
+	start := parser.pos + 1
+	for parser.pos < len(parser.text) {
+		switch parser.text[parser.pos] {
+		case '\\':
+			parser.pos++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				parser.pos++
+				return parser.text[start : parser.pos-1], true
+			}
+		}
+		parser.pos++
+	}
+	return "", false
+}
+
+// consume пропускает ожидаемый символ
+func (parser *parser) consume(c byte) bool {
+	if parser.pos < len(parser.text) && parser.text[parser.pos] == c {
+		parser.pos++
+		return true
+	}
+	return false
+}
+
+// splitDefault отделяет значение по умолчанию после первого неэкранированного |
+// Символы | внутри вложенных подстановок %...% и квадратных скобок не учитываются
+// Экранированный \| заменяется на |
+func splitDefault(arg string) (string, string, bool) {
+	nested := false
+	depth := 0
+	for i := 0; i < len(arg); i++ {
+		switch arg[i] {
+		case '\\':
+			i++
+		case '%':
+			nested = !nested
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '|':
+			if !nested && depth == 0 {
+				return unescapePipe(arg[:i]), unescapePipe(arg[i+1:]), true
+			}
+		}
+	}
+	return unescapePipe(arg), "", false
+}
+
+// unescapePipe заменяет \| на |
+func unescapePipe(text string) string {
+	return strings.Replace(text, `\|`, "|", -1)
+}
@@ -0,0 +1,337 @@
+package template
+
+import (
+	"fmt"
+	"testing"
+)
+
+func init() {
+	RegisterPlaceholder("QUERY", "FORM", "BODY", "JSON", "REGEX", "UPSTREAM", "FAIL")
+}
+
+// mapResolver возвращает значения подстановок из таблицы по имени и первому аргументу
+type mapResolver map[string][]Value
+
+// Resolve возвращает значения подстановки
+func (resolver mapResolver) Resolve(placeholder *Placeholder) ([]Value, error) {
+	if placeholder.Name == "FAIL" {
+		return nil, fmt.Errorf("ошибка источника")
+	}
+	return resolver[placeholder.Name+":"+placeholder.Arg(0)], nil
+}
+
+func TestRender(t *testing.T) {
+	resolver := mapResolver{
+		"QUERY:q1":   []Value{{Text: "value1"}},
+		"QUERY:q2":   []Value{{Text: "value2"}},
+		"QUERY:to":   []Value{{Text: "7900"}, {Text: "7901"}},
+		"QUERY:text": []Value{{Text: `<Tom & "Jerry">`}},
+		"QUERY:body": []Value{{Text: "%QUERY[q1]%"}},
+		"QUERY:url":  []Value{{Text: "a b&c=d"}},
+		"JSON:n":     []Value{{Text: "12", JSON: true}},
+		"JSON:o":     []Value{{Text: `{"a":1}`, JSON: true}},
+		"QUERY:e":    []Value{{Text: ""}},
+		"BODY:":      []Value{{Text: "body"}},
+	}
+	table := []struct {
+		name          string
+		template      string
+		format        string
+		expected      string
+		expectedError bool
+	}{
+		{
+			name:     "Подстановки и текст",
+			template: `{"query": "%QUERY[q1]%%QUERY[q2]%", "body": "%BODY%"}`,
+			expected: `{"query": "value1value2", "body": "body"}`,
+		},
+		{
+			name:     "Подставленные значения не разбираются повторно",
+			template: `%QUERY[body]%`,
+			expected: `%QUERY[q1]%`,
+		},
+		{
+			name:     "Одиночный символ % остаётся в тексте",
+			template: `100% %QUERY[q1]% %20 %lower% %QUERY[q1`,
+			expected: `100% value1 %20 %lower% %QUERY[q1`,
+		},
+		{
+			name:     "URL-кодированный текст остаётся как есть",
+			template: `text=%D0%9F%D1%80%C3%A9&q=%QUERY[q1]% 50%OFF% %NOPE[x]%`,
+			expected: `text=%D0%9F%D1%80%C3%A9&q=value1 50%OFF% %NOPE[x]%`,
+		},
+		{
+			name:     "Отсутствующее значение",
+			template: `[%QUERY[missing]%]`,
+			expected: `[]`,
+		},
+		{
+			name:     "Значение по умолчанию",
+			template: `%QUERY[missing|none]% %QUERY[e|empty]% %QUERY[q1|none]% %QUERY[missing|a\|b]%`,
+			expected: `none empty value1 a|b`,
+		},
+		{
+			name:     "Условие",
+			template: `%IF QUERY[q1]%yes%ELSE%no%END% %IF QUERY[missing]%yes%ELSE%no%END% %IF !QUERY[e]%empty%END%`,
+			expected: `yes no empty`,
+		},
+		{
+			name:     "Цикл по повторяющимся параметрам",
+			template: `%EACH QUERY[to]%<to id="%INDEX%">%ITEM%</to>%END%`,
+			expected: `<to id="0">7900</to><to id="1">7901</to>`,
+		},
+		{
+			name:     "Вложенные блоки",
+			template: `%EACH QUERY[to]%%IF QUERY[q1]%%ITEM%;%END%%END%`,
+			expected: `7900;7901;`,
+		},
+		{
+			name:     "Экранирование XML",
+			template: `<text>%QUERY[text]%</text>`,
+			format:   FormatXML,
+			expected: `<text>&lt;Tom &amp; &#34;Jerry&#34;&gt;</text>`,
+		},
+		{
+			name:     "Экранирование JSON",
+			template: `{"text": "%QUERY[text]%", "n": %JSON[n]%, "o": %JSON[o]%}`,
+			format:   FormatJSON,
+			expected: `{"text": "<Tom & \"Jerry\">", "n": 12, "o": {"a":1}}`,
+		},
+		{
+			name:     "Экранирование URL",
+			template: `https://host/?q=%QUERY[url]%`,
+			format:   FormatURL,
+			expected: `https://host/?q=a%20b%26c%3Dd`,
+		},
+		{
+			name:          "Неизвестный формат",
+			template:      `%QUERY[q1]%`,
+			format:        "yaml",
+			expectedError: true,
+		},
+		{
+			name:          "Ошибка источника",
+			template:      `%FAIL%`,
+			expectedError: true,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			parsed, err := Parse(item.template)
+			if err != nil {
+				t.Fatalf("Ошибка разбора. Expected nil, got %v", err)
+			}
+			got, err := parsed.Render(resolver, item.format)
+			if item.expectedError {
+				if err == nil {
+					t.Errorf("Expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Ошибка отрисовки. Expected nil, got %v", err)
+			}
+			if got != item.expected {
+				t.Errorf("Неверный результат. Expected %q, got %q", item.expected, got)
+			}
+		})
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	resolver := mapResolver{
+		"QUERY:ts":     []Value{{Text: "1577836800"}},
+		"QUERY:ms":     []Value{{Text: "1577836800500"}},
+		"QUERY:date":   []Value{{Text: "2020-01-01T03:00:00+03:00"}},
+		"QUERY:status": []Value{{Text: " delivrd "}},
+		"QUERY:text":   []Value{{Text: `a&b "c"`}},
+		"QUERY:to":     []Value{{Text: "a"}, {Text: "b"}},
+		"QUERY:price":  []Value{{Text: "12.345"}},
+		"QUERY:b64":    []Value{{Text: "aGVsbG8="}},
+	}
+	table := []struct {
+		name          string
+		template      string
+		format        string
+		expected      string
+		expectedError bool
+	}{
+		{
+			name:     "Дата из unix-времени",
+			template: `%QUERY[ts]|unix_to_rfc3339% %QUERY[ms]|unix_ms_to_rfc3339% %QUERY[date]|rfc3339_to_unix%`,
+			expected: `2020-01-01T00:00:00Z 2020-01-01T00:00:00Z 1577836800`,
+		},
+		{
+			name:     "Форматирование даты",
+			template: `%QUERY[ts]|date:02.01.2006 15\:04% %QUERY[date]|date:2006-01-02%`,
+			expected: `01.01.2020 00:00 2020-01-01`,
+		},
+		{
+			name:     "Цепочка функций",
+			template: `%QUERY[status]|trim|upper|lookup:DELIVRD=delivered,*=unknown% %QUERY[missing|x]|upper%`,
+			expected: `delivered X`,
+		},
+		{
+			name:     "Таблица без совпадения возвращает значение",
+			template: `%QUERY[status]|trim|lookup:a=b%`,
+			expected: `delivrd`,
+		},
+		{
+			name:     "Base64 и хэши",
+			template: `%QUERY[b64]|base64_decode% %QUERY[b64]|base64_decode|base64% %QUERY[b64]|base64_decode|md5% %QUERY[b64]|base64_decode|sha256%`,
+			expected: `hello aGVsbG8= 5d41402abc4b2a76b9719d911017c592 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824`,
+		},
+		{
+			name:     "Число в JSON-шаблоне",
+			template: `{"price": %QUERY[price]|number:2%, "text": "%QUERY[price]%"}`,
+			format:   FormatJSON,
+			expected: `{"price": 12.35, "text": "12.345"}`,
+		},
+		{
+			name:     "Экранирование функцией заменяет формат шаблона",
+			template: `<url>https://host/?t=%QUERY[text]|url%</url><text>%QUERY[text]%</text><raw>%QUERY[text]|raw%</raw>`,
+			format:   FormatXML,
+			expected: `<url>https://host/?t=a%26b%20%22c%22</url><text>a&amp;b &#34;c&#34;</text><raw>a&b "c"</raw>`,
+		},
+		{
+			name:     "Функции применяются к каждому значению цикла",
+			template: `%EACH QUERY[to]|upper%%ITEM%%END%`,
+			expected: `AB`,
+		},
+		{
+			name:          "Ошибка преобразования",
+			template:      `%QUERY[status]|unix_to_rfc3339%`,
+			expectedError: true,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			parsed, err := Parse(item.template)
+			if err != nil {
+				t.Fatalf("Ошибка разбора. Expected nil, got %v", err)
+			}
+			got, err := parsed.Render(resolver, item.format)
+			if item.expectedError {
+				if err == nil {
+					t.Errorf("Expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Ошибка отрисовки. Expected nil, got %v", err)
+			}
+			if got != item.expected {
+				t.Errorf("Неверный результат. Expected %q, got %q", item.expected, got)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	table := []struct {
+		name             string
+		template         string
+		expectedNames    []string
+		expectedDefaults []string
+		expectedSub      string
+		expectedError    bool
+	}{
+		{
+			name:          "Вложенные скобки в аргументах",
+			template:      `%REGEX[from>([^<\s]+)][1]%`,
+			expectedNames: []string{"REGEX"},
+		},
+		{
+			name:             "Значение по умолчанию только в последнем аргументе",
+			template:         `%REGEX[a|b][1|none]%`,
+			expectedNames:    []string{"REGEX"},
+			expectedDefaults: []string{"none"},
+		},
+		{
+			name:             "Уточнение после точки",
+			template:         `%UPSTREAM[billing].JSON[$.balance|0]|trim%`,
+			expectedNames:    []string{"UPSTREAM"},
+			expectedDefaults: []string{"0"},
+			expectedSub:      "JSON[$.balance]",
+		},
+		{
+			name:          "Уточнение без имени",
+			template:      `%UPSTREAM[billing].%`,
+			expectedNames: []string{},
+		},
+		{
+			name:          "Подстановки условий и циклов",
+			template:      `%IF QUERY[a]%%EACH FORM[b]%%ITEM%%END%%ELSE%%BODY%%END%`,
+			expectedNames: []string{"QUERY", "FORM", "ITEM", "BODY"},
+		},
+		{
+			name:          "Функции после аргументов",
+			template:      `%QUERY[a|x]|trim|date:15\:04\|05%`,
+			expectedNames: []string{"QUERY"},
+		},
+		{
+			name:          "Незарегистрированные имена не являются подстановками",
+			template:      `%D0%9F%IF D1%%C3%A9|nope% %QUERY[a]%`,
+			expectedNames: []string{"QUERY"},
+		},
+		{
+			name:          "Неизвестная функция",
+			template:      `%QUERY[a]|nope%`,
+			expectedError: true,
+		},
+		{
+			name:          "Функция без обязательного аргумента",
+			template:      `%QUERY[a]|number%`,
+			expectedError: true,
+		},
+		{
+			name:          "Некорректный аргумент функции",
+			template:      `%QUERY[a]|lookup:a=1,b%`,
+			expectedError: true,
+		},
+		{
+			name:          "Незакрытый блок",
+			template:      `%IF QUERY[a]%text`,
+			expectedError: true,
+		},
+		{
+			name:          "Лишний END",
+			template:      `text%END%`,
+			expectedError: true,
+		},
+		{
+			name:          "ELSE в цикле",
+			template:      `%EACH QUERY[a]%%ELSE%%END%`,
+			expectedError: true,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			parsed, err := Parse(item.template)
+			if item.expectedError {
+				if err == nil {
+					t.Errorf("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Ошибка разбора. Expected nil, got %v", err)
+			}
+			placeholders := parsed.Placeholders()
+			if len(placeholders) != len(item.expectedNames) {
+				t.Fatalf("Неверное количество подстановок. Expected %d, got %d", len(item.expectedNames), len(placeholders))
+			}
+			for i, placeholder := range placeholders {
+				if placeholder.Name != item.expectedNames[i] {
+					t.Errorf("Неверное имя подстановки. Expected %v, got %v", item.expectedNames[i], placeholder.Name)
+				}
+				if i < len(item.expectedDefaults) && placeholder.Default != item.expectedDefaults[i] {
+					t.Errorf("Неверное значение по умолчанию. Expected %v, got %v", item.expectedDefaults[i], placeholder.Default)
+				}
+				if placeholder.Sub != nil && fmt.Sprint(placeholder.Sub.Name, placeholder.Sub.Args) != item.expectedSub {
+					t.Errorf("Неверное уточнение. Expected %v, got %v%v", item.expectedSub, placeholder.Sub.Name, placeholder.Sub.Args)
+				}
+			}
+		})
+	}
+}
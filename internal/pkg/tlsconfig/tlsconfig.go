@@ -0,0 +1,238 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Server описывает TLS входящих соединений адаптера
+type Server struct {
+	// CertFile и KeyFile - сертификат и закрытый ключ сервера в формате PEM
+	CertFile string `json:"cert-file"`
+	KeyFile  string `json:"key-file"`
+	// ClientCAFile - сертификаты центров, которыми подписаны сертификаты клиентов
+	// Если указан, клиенты обязаны предъявить сертификат (mTLS)
+	ClientCAFile string `json:"client-ca-file"`
+	// MinVersion - минимальная версия TLS: 1.0, 1.1, 1.2 (по умолчанию) или 1.3
+	MinVersion string `json:"min-version"`
+}
+
+// Client описывает TLS исходящих соединений
+type Client struct {
+	// CAFile - сертификаты центров, которым доверяет клиент, вместо системных
+	CAFile string `json:"ca-file"`
+	// CertFile и KeyFile - сертификат и ключ клиента для mTLS
+	CertFile string `json:"cert-file"`
+	KeyFile  string `json:"key-file"`
+	// ServerName - имя сервера для SNI и проверки сертификата вместо хоста из адреса
+	ServerName string `json:"server-name"`
+}
+
+// versions поддерживаемые версии TLS
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// IsSet сообщает, включён ли TLS для входящих соединений
+func (server Server) IsSet() bool {
+	return server != Server{}
+}
+
+// IsSet сообщает, заданы ли настройки TLS исходящих соединений
+func (client Client) IsSet() bool {
+	return client != Client{}
+}
+
+// Check проверяет, что файлы сертификатов существуют и читаются
+func (server Server) Check() []error {
+	errs := []error{}
+	if !server.IsSet() {
+		return errs
+	}
+	if server.CertFile == "" || server.KeyFile == "" {
+		errs = append(errs, fmt.Errorf("не указаны cert-file и key-file"))
+	} else if _, err := loadKeyPair(server.CertFile, server.KeyFile); err != nil {
+		errs = append(errs, err)
+	}
+	if server.ClientCAFile != "" {
+		if _, err := loadPool(server.ClientCAFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, prs := versions[server.MinVersion]; server.MinVersion != "" && !prs {
+		errs = append(errs, fmt.Errorf("неизвестная версия TLS %q, ожидается 1.0, 1.1, 1.2 или 1.3", server.MinVersion))
+	}
+	return errs
+}
+
+// Check проверяет, что файлы сертификатов существуют и читаются
+func (client Client) Check() []error {
+	errs := []error{}
+	if client.CAFile != "" {
+		if _, err := loadPool(client.CAFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if (client.CertFile == "") != (client.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("cert-file и key-file указываются вместе"))
+	} else if client.CertFile != "" {
+		if _, err := loadKeyPair(client.CertFile, client.KeyFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Config создаёт настройки TLS сервера
+// Сертификат и центры клиентов перечитываются при изменении файлов без перезапуска
+func (server Server) Config() (*tls.Config, error) {
+	if errs := server.Check(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	minVersion, prs := versions[server.MinVersion]
+	if !prs {
+		minVersion = tls.VersionTLS12
+	}
+	certificate := &watched{files: []string{server.CertFile, server.KeyFile}, load: func() (interface{}, error) {
+		return loadKeyPair(server.CertFile, server.KeyFile)
+	}}
+	clientCAs := &watched{files: []string{server.ClientCAFile}, load: func() (interface{}, error) {
+		return loadPool(server.ClientCAFile)
+	}}
+	return &tls.Config{
+		MinVersion: minVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			pair, err := certificate.get()
+			if err != nil {
+				return nil, err
+			}
+			config := &tls.Config{
+				MinVersion:   minVersion,
+				Certificates: []tls.Certificate{*pair.(*tls.Certificate)},
+			}
+			if server.ClientCAFile != "" {
+				pool, err := clientCAs.get()
+				if err != nil {
+					return nil, err
+				}
+				config.ClientCAs = pool.(*x509.CertPool)
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}, nil
+}
+
+// Config создаёт настройки TLS клиента
+// Сертификат клиента перечитывается при изменении файлов
+func (client Client) Config() (*tls.Config, error) {
+	if errs := client.Check(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	config := &tls.Config{ServerName: client.ServerName}
+	if client.CAFile != "" {
+		pool, err := loadPool(client.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if client.CertFile != "" {
+		certificate := &watched{files: []string{client.CertFile, client.KeyFile}, load: func() (interface{}, error) {
+			return loadKeyPair(client.CertFile, client.KeyFile)
+		}}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			pair, err := certificate.get()
+			if err != nil {
+				return nil, err
+			}
+			return pair.(*tls.Certificate), nil
+		}
+	}
+	return config, nil
+}
+
+// loadKeyPair читает сертификат и закрытый ключ
+func loadKeyPair(certFile string, keyFile string) (*tls.Certificate, error) {
+	for _, file := range []string{certFile, keyFile} {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			return nil, fmt.Errorf("файл %s не найден", file)
+		}
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось загрузить сертификат %s: %v", certFile, err)
+	}
+	return &pair, nil
+}
+
+// loadPool читает сертификаты центров в формате PEM
+func loadPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("файл %s не найден", file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("в файле %s нет сертификатов в формате PEM", file)
+	}
+	return pool, nil
+}
+
+// checkInterval - как часто проверяется изменение файлов, подменяется в тестах
+var checkInterval = time.Second
+
+// watched загружает значение из файлов и перезагружает его при изменении файлов
+// Если новые файлы не читаются, используется последнее загруженное значение
+type watched struct {
+	files   []string
+	load    func() (interface{}, error)
+	mutex   sync.Mutex
+	value   interface{}
+	stamp   string
+	checked time.Time
+}
+
+// get возвращает актуальное значение
+func (watched *watched) get() (interface{}, error) {
+	watched.mutex.Lock()
+	defer watched.mutex.Unlock()
+	if watched.value != nil && time.Since(watched.checked) < checkInterval {
+		return watched.value, nil
+	}
+	watched.checked = time.Now()
+	stamp := ""
+	for _, file := range watched.files {
+		if info, err := os.Stat(file); err == nil {
+			stamp += fmt.Sprintf("%s:%d:%d;", file, info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	if watched.value != nil && stamp == watched.stamp {
+		return watched.value, nil
+	}
+	value, err := watched.load()
+	if err != nil {
+		if watched.value != nil {
+			log.Warnf("Не удалось перечитать %v, используется прежний сертификат: %v", watched.files, err)
+			return watched.value, nil
+		}
+		return nil, err
+	}
+	if watched.value != nil {
+		log.Infof("Перечитаны файлы %v", watched.files)
+	}
+	watched.value, watched.stamp = value, stamp
+	return value, nil
+}
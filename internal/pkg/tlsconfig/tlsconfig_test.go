@@ -0,0 +1,183 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issuer - сертификат и ключ, которыми подписываются другие сертификаты
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// writeCert создаёт сертификат, подписанный parent (или самоподписанный), и записывает его в dir
+func writeCert(t *testing.T, dir string, name string, parent *issuer, template *x509.Certificate) *issuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Ошибка генерации ключа: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Ошибка создания сертификата: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return &issuer{cert, key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	checkInterval = 0
+	defer func() { checkInterval = time.Second }()
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	file := func(name string) string { return filepath.Join(dir, name) }
+	ca := writeCert(t, dir, "ca", nil, &x509.Certificate{IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign})
+	writeCert(t, dir, "server", ca, &x509.Certificate{DNSNames: []string{"bus.example.com"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	writeCert(t, dir, "client", ca, &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	other := writeCert(t, dir, "other-ca", nil, &x509.Certificate{IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign})
+	writeCert(t, dir, "stranger", other, &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+
+	serverConfig, err := Server{CertFile: file("server.crt"), KeyFile: file("server.key"), ClientCAFile: file("ca.crt"), MinVersion: "1.2"}.Config()
+	if err != nil {
+		t.Fatalf("Expected nil, got %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = serverConfig
+	server.StartTLS()
+	defer server.Close()
+
+	table := []struct {
+		name          string
+		client        Client
+		rotate        bool
+		expected      string
+		expectedError bool
+	}{
+		{
+			name:     "Сертификат клиента, подписанный доверенным центром",
+			client:   Client{CAFile: file("ca.crt"), CertFile: file("client.crt"), KeyFile: file("client.key")},
+			expected: "client",
+		},
+		{
+			name:     "Имя сервера для SNI",
+			client:   Client{CAFile: file("ca.crt"), CertFile: file("client.crt"), KeyFile: file("client.key"), ServerName: "bus.example.com"},
+			expected: "client",
+		},
+		{
+			name:          "Неверное имя сервера",
+			client:        Client{CAFile: file("ca.crt"), CertFile: file("client.crt"), KeyFile: file("client.key"), ServerName: "other.example.com"},
+			expectedError: true,
+		},
+		{
+			name:          "Клиент без сертификата",
+			client:        Client{CAFile: file("ca.crt")},
+			expectedError: true,
+		},
+		{
+			name:          "Сертификат другого центра",
+			client:        Client{CAFile: file("ca.crt"), CertFile: file("stranger.crt"), KeyFile: file("stranger.key")},
+			expectedError: true,
+		},
+		{
+			name:          "Сервер не из доверенного центра",
+			client:        Client{CAFile: file("other-ca.crt"), CertFile: file("client.crt"), KeyFile: file("client.key")},
+			expectedError: true,
+		},
+		{
+			name:     "Сертификат сервера перечитывается при изменении",
+			client:   Client{CAFile: file("other-ca.crt"), CertFile: file("client.crt"), KeyFile: file("client.key")},
+			rotate:   true,
+			expected: "client",
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			if item.rotate {
+				// Новый сертификат сервера подписан другим центром, клиент ему доверяет
+				writeCert(t, dir, "server", other, &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+				future := time.Now().Add(time.Minute)
+				os.Chtimes(file("server.crt"), future, future)
+			}
+			clientConfig, err := item.client.Config()
+			if err != nil {
+				t.Fatalf("Expected nil, got %v", err)
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+			response, err := client.Get(server.URL)
+			if item.expectedError {
+				if err == nil {
+					response.Body.Close()
+					t.Errorf("Expected an error, got status %d", response.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected nil, got %v", err)
+			}
+			defer response.Body.Close()
+			body, _ := ioutil.ReadAll(response.Body)
+			if string(body) != item.expected {
+				t.Errorf("Expected %q, got %q", item.expected, body)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "empty.pem"), []byte("no certificates"), 0644)
+	table := []struct {
+		name     string
+		errs     []error
+		expected []string
+	}{
+		{name: "TLS не включён", errs: Server{}.Check()},
+		{name: "Нет ключа сервера", errs: Server{CertFile: "server.crt"}.Check(), expected: []string{"не указаны cert-file и key-file"}},
+		{name: "Неизвестная версия", errs: Server{CertFile: "/nonexistent/server.crt", KeyFile: "/nonexistent/server.key", MinVersion: "1.4"}.Check(), expected: []string{
+			"файл /nonexistent/server.crt не найден",
+			`неизвестная версия TLS "1.4", ожидается 1.0, 1.1, 1.2 или 1.3`,
+		}},
+		{name: "Файл без сертификатов", errs: Client{CAFile: filepath.Join(dir, "empty.pem")}.Check(), expected: []string{"в файле " + filepath.Join(dir, "empty.pem") + " нет сертификатов в формате PEM"}},
+		{name: "Сертификат клиента без ключа", errs: Client{CertFile: "client.crt"}.Check(), expected: []string{"cert-file и key-file указываются вместе"}},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			if len(item.errs) != len(item.expected) {
+				t.Fatalf("Expected %v, got %v", item.expected, item.errs)
+			}
+			for i, err := range item.errs {
+				if err.Error() != item.expected[i] {
+					t.Errorf("Expected %q, got %q", item.expected[i], err.Error())
+				}
+			}
+		})
+	}
+}
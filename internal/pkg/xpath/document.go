@@ -0,0 +1,116 @@
+package xpath
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Виды узлов документа
+const (
+	DocumentNode = iota
+	ElementNode
+	TextNode
+	AttributeNode
+)
+
+// Node - узел XML-документа
+type Node struct {
+	Kind int
+	// Space - URI пространства имён элемента или атрибута
+	Space string
+	Local string
+	// Data - текст для текстовых узлов и значение для атрибутов
+	Data       string
+	Attributes []*Node
+	Children   []*Node
+	Parent     *Node
+}
+
+// Parse разбирает XML-документ в дерево узлов
+// Пространства имён раскрываются в URI, секции CDATA становятся текстом
+// Некорректный XML и тело без единственного корневого элемента, например JSON или текст, возвращают ошибку
+func Parse(data []byte) (*Node, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	root := &Node{Kind: DocumentNode}
+	current := root
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			if current == root && len(root.Children) > 0 {
+				return nil, fmt.Errorf("документ содержит больше одного корневого элемента")
+			}
+			element := &Node{
+				Kind:   ElementNode,
+				Space:  token.Name.Space,
+				Local:  token.Name.Local,
+				Parent: current,
+			}
+			for _, attr := range token.Attr {
+				if attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns") {
+					continue
+				}
+				element.Attributes = append(element.Attributes, &Node{
+					Kind:   AttributeNode,
+					Space:  attr.Name.Space,
+					Local:  attr.Name.Local,
+					Data:   attr.Value,
+					Parent: element,
+				})
+			}
+			current.Children = append(current.Children, element)
+			current = element
+		case xml.EndElement:
+			if current.Parent != nil {
+				current = current.Parent
+			}
+		case xml.CharData:
+			if current == root {
+				// Вне корневого элемента допустимы только пробельные символы
+				if strings.TrimSpace(string(token)) != "" {
+					return nil, fmt.Errorf("текст вне корневого элемента")
+				}
+				continue
+			}
+			current.Children = append(current.Children, &Node{
+				Kind:   TextNode,
+				Data:   string(token),
+				Parent: current,
+			})
+		}
+	}
+	if len(root.Children) == 0 {
+		return nil, fmt.Errorf("документ не содержит корневого элемента")
+	}
+	return root, nil
+}
+
+// String возвращает строковое значение узла:
+// текст всех потомков для элемента и документа, значение для атрибута и текста
+func (node *Node) String() string {
+	if node.Kind == TextNode || node.Kind == AttributeNode {
+		return node.Data
+	}
+	var builder strings.Builder
+	var walk func(*Node)
+	walk = func(n *Node) {
+		for _, child := range n.Children {
+			if child.Kind == TextNode {
+				builder.WriteString(child.Data)
+			} else {
+				walk(child)
+			}
+		}
+	}
+	walk(node)
+	return builder.String()
+}
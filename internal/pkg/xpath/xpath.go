@@ -0,0 +1,394 @@
+package xpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Оси шагов выражения
+const (
+	axisChild = iota
+	// axisDescendant - шаг после //: дочерние узлы самого узла и каждого его потомка
+	axisDescendant
+	// axisDescendantOrSelf - выражение //.: узел и все его потомки
+	axisDescendantOrSelf
+	axisAttribute
+	axisSelf
+	axisParent
+)
+
+// nameTest описывает проверку имени узла: prefix:local, prefix:*, * или text()
+type nameTest struct {
+	prefix string
+	local  string
+	text   bool
+	node   bool
+}
+
+// predicate описывает условие в квадратных скобках
+type predicate struct {
+	// position - номер узла с 1, -1 для last(), 0 если условие не позиционное
+	position int
+	// path - относительный путь, значение которого сравнивается или проверяется на наличие
+	path []step
+	// operator - "=", "!=" или пустая строка для проверки наличия
+	operator string
+	value    string
+}
+
+// step описывает шаг выражения
+type step struct {
+	axis       int
+	test       nameTest
+	predicates []predicate
+}
+
+// Expr - разобранное XPath-выражение
+type Expr struct {
+	source   string
+	absolute bool
+	steps    []step
+}
+
+// Compile разбирает XPath-выражение
+// Поддерживаются пути с / и //, ., .., *, @атрибуты, text(), node(),
+// префиксы пространств имён и условия [n], [last()], [@a='v'], [name='v'], [@a], [name]
+func Compile(source string) (*Expr, error) {
+	text := strings.TrimSpace(source)
+	if text == "" {
+		return nil, fmt.Errorf("пустое выражение XPath")
+	}
+	expr := &Expr{source: source}
+	if strings.HasPrefix(text, "/") {
+		expr.absolute = true
+	}
+	steps, rest, err := parsePath(text)
+	if err != nil {
+		return nil, fmt.Errorf("XPath %q: %v", source, err)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("XPath %q: лишние символы %q", source, rest)
+	}
+	expr.steps = steps
+	return expr, nil
+}
+
+// Prefixes возвращает префиксы пространств имён, используемые выражением
+func (expr *Expr) Prefixes() []string {
+	prefixes := []string{}
+	var collect func(steps []step)
+	collect = func(steps []step) {
+		for _, s := range steps {
+			if s.test.prefix != "" {
+				prefixes = append(prefixes, s.test.prefix)
+			}
+			for _, p := range s.predicates {
+				collect(p.path)
+			}
+		}
+	}
+	collect(expr.steps)
+	return prefixes
+}
+
+// parsePath разбирает последовательность шагов до конца выражения, ] или оператора сравнения
+func parsePath(text string) ([]step, string, error) {
+	steps := []step{}
+	first := true
+	for {
+		axis := axisChild
+		switch {
+		case strings.HasPrefix(text, "//"):
+			axis = axisDescendant
+			text = text[2:]
+		case strings.HasPrefix(text, "/"):
+			text = text[1:]
+		case !first:
+			return steps, text, nil
+		}
+		first = false
+		if text == "" {
+			// Выражение "/" выбирает сам документ
+			if len(steps) == 0 && axis == axisChild {
+				return steps, text, nil
+			}
+			return nil, "", fmt.Errorf("выражение не может заканчиваться на /")
+		}
+		parsed, rest, err := parseStep(text, axis)
+		if err != nil {
+			return nil, "", err
+		}
+		steps = append(steps, parsed)
+		text = rest
+	}
+}
+
+// parseStep разбирает один шаг с условиями
+func parseStep(text string, axis int) (step, string, error) {
+	s := step{axis: axis}
+	switch {
+	case strings.HasPrefix(text, ".."):
+		s.axis = axisParent
+		s.test.node = true
+		return s, text[2:], nil
+	case strings.HasPrefix(text, "."):
+		if axis == axisDescendant {
+			s.axis = axisDescendantOrSelf
+			s.test.node = true
+			return s, text[1:], nil
+		}
+		s.axis = axisSelf
+		s.test.node = true
+		return s, text[1:], nil
+	case strings.HasPrefix(text, "@"):
+		if axis == axisDescendant {
+			return s, "", fmt.Errorf("//@ не поддерживается")
+		}
+		s.axis = axisAttribute
+		text = text[1:]
+	}
+	end := 0
+	for end < len(text) && strings.IndexByte("/[]=!| ", text[end]) == -1 {
+		end++
+	}
+	name := text[:end]
+	text = text[end:]
+	switch {
+	case name == "":
+		return s, "", fmt.Errorf("ожидается имя узла")
+	case name == "text()":
+		s.test.text = true
+	case name == "node()":
+		s.test.node = true
+	case strings.Contains(name, "("):
+		return s, "", fmt.Errorf("функция %s не поддерживается", name)
+	default:
+		if colon := strings.IndexByte(name, ':'); colon != -1 {
+			s.test.prefix, s.test.local = name[:colon], name[colon+1:]
+		} else {
+			s.test.local = name
+		}
+	}
+	for strings.HasPrefix(text, "[") {
+		parsed, rest, err := parsePredicate(text[1:])
+		if err != nil {
+			return s, "", err
+		}
+		s.predicates = append(s.predicates, parsed)
+		text = rest
+	}
+	return s, text, nil
+}
+
+// parsePredicate разбирает условие после [ до закрывающей ]
+func parsePredicate(text string) (predicate, string, error) {
+	text = strings.TrimLeft(text, " ")
+	if end := strings.IndexByte(text, ']'); end != -1 {
+		inner := strings.TrimSpace(text[:end])
+		if inner == "last()" {
+			return predicate{position: -1}, text[end+1:], nil
+		}
+		if position, err := strconv.Atoi(inner); err == nil {
+			if position < 1 {
+				return predicate{}, "", fmt.Errorf("номер узла должен быть больше 0")
+			}
+			return predicate{position: position}, text[end+1:], nil
+		}
+	}
+	p := predicate{}
+	var err error
+	var path []step
+	if strings.HasPrefix(text, ".") || strings.HasPrefix(text, "@") || !strings.HasPrefix(text, "/") {
+		var first step
+		first, text, err = parseStep(text, axisChild)
+		if err != nil {
+			return p, "", err
+		}
+		path = append(path, first)
+		if strings.HasPrefix(text, "/") {
+			var more []step
+			more, text, err = parsePath(text)
+			if err != nil {
+				return p, "", err
+			}
+			path = append(path, more...)
+		}
+	}
+	p.path = path
+	text = strings.TrimLeft(text, " ")
+	for _, operator := range []string{"!=", "="} {
+		if strings.HasPrefix(text, operator) {
+			p.operator = operator
+			text = strings.TrimLeft(text[len(operator):], " ")
+			if text == "" || (text[0] != '\'' && text[0] != '"') {
+				return p, "", fmt.Errorf("ожидается строка в кавычках после %s", operator)
+			}
+			end := strings.IndexByte(text[1:], text[0])
+			if end == -1 {
+				return p, "", fmt.Errorf("незакрытая строка в условии")
+			}
+			p.value = text[1 : end+1]
+			text = strings.TrimLeft(text[end+2:], " ")
+			break
+		}
+	}
+	if !strings.HasPrefix(text, "]") {
+		return p, "", fmt.Errorf("ожидается ] в условии")
+	}
+	return p, text[1:], nil
+}
+
+// Select выбирает узлы документа
+// namespaces сопоставляет префиксы выражения с URI пространств имён
+// Имя без префикса совпадает с элементом с таким локальным именем в любом пространстве имён
+func (expr *Expr) Select(document *Node, namespaces map[string]string) ([]*Node, error) {
+	for _, prefix := range expr.Prefixes() {
+		if _, prs := namespaces[prefix]; !prs {
+			return nil, fmt.Errorf("XPath %q: не объявлен префикс %q", expr.source, prefix)
+		}
+	}
+	return evaluate(expr.steps, []*Node{document}, namespaces), nil
+}
+
+// Strings выбирает узлы и возвращает их строковые значения без крайних пробелов
+func (expr *Expr) Strings(document *Node, namespaces map[string]string) ([]string, error) {
+	nodes, err := expr.Select(document, namespaces)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		values = append(values, strings.TrimSpace(node.String()))
+	}
+	return values, nil
+}
+
+// evaluate применяет шаги к набору узлов
+func evaluate(steps []step, context []*Node, namespaces map[string]string) []*Node {
+	current := context
+	for _, s := range steps {
+		next := []*Node{}
+		seen := make(map[*Node]bool)
+		for _, node := range current {
+			for _, candidate := range s.apply(node, namespaces) {
+				if !seen[candidate] {
+					seen[candidate] = true
+					next = append(next, candidate)
+				}
+			}
+		}
+		current = next
+	}
+	return current
+}
+
+// apply выбирает узлы по оси, имени и условиям шага относительно node
+func (s step) apply(node *Node, namespaces map[string]string) []*Node {
+	var candidates []*Node
+	switch s.axis {
+	case axisChild:
+		candidates = node.Children
+	case axisDescendant:
+		return s.applyDescendant(node, namespaces)
+	case axisDescendantOrSelf:
+		candidates = descendants(node, []*Node{node})
+	case axisAttribute:
+		candidates = node.Attributes
+	case axisSelf:
+		candidates = []*Node{node}
+	case axisParent:
+		if node.Parent != nil {
+			candidates = []*Node{node.Parent}
+		}
+	}
+	matched := []*Node{}
+	for _, candidate := range candidates {
+		if s.test.matches(candidate, s.axis, namespaces) {
+			matched = append(matched, candidate)
+		}
+	}
+	for _, p := range s.predicates {
+		matched = p.filter(matched, namespaces)
+	}
+	return matched
+}
+
+// applyDescendant выбирает узлы шага //name относительно node
+// Шаг равен child::name у самого узла и каждого потомка, поэтому условия [n] и [last()]
+// применяются к детям каждого родителя отдельно, а результат возвращается в порядке документа
+func (s step) applyDescendant(node *Node, namespaces map[string]string) []*Node {
+	child := step{axis: axisChild, test: s.test, predicates: s.predicates}
+	selected := make(map[*Node]bool)
+	for _, parent := range descendants(node, []*Node{node}) {
+		for _, matched := range child.apply(parent, namespaces) {
+			selected[matched] = true
+		}
+	}
+	result := []*Node{}
+	for _, candidate := range descendants(node, nil) {
+		if selected[candidate] {
+			result = append(result, candidate)
+		}
+	}
+	return result
+}
+
+// descendants возвращает узел и всех его потомков в порядке документа
+func descendants(node *Node, result []*Node) []*Node {
+	for _, child := range node.Children {
+		result = append(result, child)
+		result = descendants(child, result)
+	}
+	return result
+}
+
+// matches проверяет узел на соответствие имени
+func (test nameTest) matches(node *Node, axis int, namespaces map[string]string) bool {
+	switch {
+	case test.node:
+		return true
+	case test.text:
+		return node.Kind == TextNode
+	}
+	if (axis == axisAttribute) != (node.Kind == AttributeNode) || (node.Kind != ElementNode && node.Kind != AttributeNode) {
+		return false
+	}
+	if test.prefix != "" && namespaces[test.prefix] != node.Space {
+		return false
+	}
+	return test.local == "*" || test.local == node.Local
+}
+
+// filter оставляет узлы, удовлетворяющие условию
+func (p predicate) filter(nodes []*Node, namespaces map[string]string) []*Node {
+	switch {
+	case p.position == -1:
+		if len(nodes) == 0 {
+			return nodes
+		}
+		return nodes[len(nodes)-1:]
+	case p.position > 0:
+		if p.position > len(nodes) {
+			return nil
+		}
+		return nodes[p.position-1 : p.position]
+	}
+	result := []*Node{}
+	for _, node := range nodes {
+		values := evaluate(p.path, []*Node{node}, namespaces)
+		if p.operator == "" {
+			if len(values) > 0 {
+				result = append(result, node)
+			}
+			continue
+		}
+		for _, value := range values {
+			if (strings.TrimSpace(value.String()) == p.value) == (p.operator == "=") {
+				result = append(result, node)
+				break
+			}
+		}
+	}
+	return result
+}
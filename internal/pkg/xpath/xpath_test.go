@@ -0,0 +1,221 @@
+package xpath
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStrings(t *testing.T) {
+	document, err := Parse([]byte(`<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns="urn:sms">
+	<soap:Body>
+		<report id="42" status="DELIVERED">
+			<from>
+				79001234567
+			</from>
+			<text><![CDATA[<hello> & bye]]></text>
+			<to type="main">7900</to>
+			<to type="copy">7901</to>
+		</report>
+	</soap:Body>
+</soap:Envelope>`))
+	if err != nil {
+		t.Fatalf("Ошибка разбора документа: %v", err)
+	}
+	namespaces := map[string]string{
+		"s":   "http://schemas.xmlsoap.org/soap/envelope/",
+		"sms": "urn:sms",
+		"x":   "urn:other",
+	}
+	table := []struct {
+		name          string
+		expression    string
+		expected      []string
+		expectedError bool
+	}{
+		{
+			name:       "Поиск по всему документу с префиксом",
+			expression: "//sms:from",
+			expected:   []string{"79001234567"},
+		},
+		{
+			name:       "Абсолютный путь через пространства имён",
+			expression: "/s:Envelope/s:Body/sms:report/sms:to",
+			expected:   []string{"7900", "7901"},
+		},
+		{
+			name:       "Имя без префикса в любом пространстве имён",
+			expression: "//report/from",
+			expected:   []string{"79001234567"},
+		},
+		{
+			name:       "Префикс чужого пространства имён",
+			expression: "//x:from",
+			expected:   []string{},
+		},
+		{
+			name:       "Секция CDATA",
+			expression: "//sms:text",
+			expected:   []string{"<hello> & bye"},
+		},
+		{
+			name:       "Атрибут",
+			expression: "//sms:report/@status",
+			expected:   []string{"DELIVERED"},
+		},
+		{
+			name:       "Условие по атрибуту",
+			expression: "//sms:to[@type='copy']",
+			expected:   []string{"7901"},
+		},
+		{
+			name:       "Условие по дочернему элементу",
+			expression: "//sms:report[sms:from='79001234567']/@id",
+			expected:   []string{"42"},
+		},
+		{
+			name:       "Позиция и last()",
+			expression: "//sms:report/sms:to[last()]",
+			expected:   []string{"7901"},
+		},
+		{
+			name:       "Номер узла",
+			expression: "//sms:report/*[1]",
+			expected:   []string{"79001234567"},
+		},
+		{
+			name:       "Текстовый узел и родитель",
+			expression: "//sms:to[1]/../sms:to[2]/text()",
+			expected:   []string{"7901"},
+		},
+		{
+			name:          "Необъявленный префикс",
+			expression:    "//unknown:from",
+			expectedError: true,
+		},
+		{
+			name:          "Незакрытое условие",
+			expression:    "//sms:to[@type='copy'",
+			expectedError: true,
+		},
+		{
+			name:          "Неподдерживаемая функция",
+			expression:    "count(//sms:to)",
+			expectedError: true,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			expr, err := Compile(item.expression)
+			var values []string
+			if err == nil {
+				values, err = expr.Strings(document, namespaces)
+			}
+			if (err != nil) != item.expectedError {
+				t.Fatalf("Неверная ошибка. Expected error %v, got %v", item.expectedError, err)
+			}
+			if item.expectedError {
+				return
+			}
+			if strings.Join(values, ",") != strings.Join(item.expected, ",") || len(values) != len(item.expected) {
+				t.Errorf("Неверные значения. Expected %q, got %q", item.expected, values)
+			}
+		})
+	}
+}
+
+func TestPositionPerParent(t *testing.T) {
+	document, err := Parse([]byte(`<root><list><item>a1</item><item>a2</item></list><list><item>b1</item><item>b2</item><item>b3</item></list><item>c1</item></root>`))
+	if err != nil {
+		t.Fatalf("Ошибка разбора документа: %v", err)
+	}
+	table := []struct {
+		name       string
+		expression string
+		expected   []string
+	}{
+		{
+			name:       "Первый узел у каждого родителя",
+			expression: "//item[1]",
+			expected:   []string{"a1", "b1", "c1"},
+		},
+		{
+			name:       "Последний узел у каждого родителя",
+			expression: "//item[last()]",
+			expected:   []string{"a2", "b3", "c1"},
+		},
+		{
+			name:       "Номер узла внутри родителя",
+			expression: "//list/item[2]",
+			expected:   []string{"a2", "b2"},
+		},
+		{
+			name:       "Все узлы в порядке документа",
+			expression: "//item",
+			expected:   []string{"a1", "a2", "b1", "b2", "b3", "c1"},
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			expr, err := Compile(item.expression)
+			if err != nil {
+				t.Fatalf("Ошибка разбора выражения: %v", err)
+			}
+			values, err := expr.Strings(document, nil)
+			if err != nil || strings.Join(values, ",") != strings.Join(item.expected, ",") {
+				t.Errorf("Неверные значения. Expected %q, got %q, err %v", item.expected, values, err)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	table := []struct {
+		name          string
+		input         string
+		expectedError bool
+	}{
+		{
+			name:  "Документ с объявлением и пробелами",
+			input: "<?xml version=\"1.0\"?>\n<a><b/></a>\n",
+		},
+		{
+			name:          "JSON",
+			input:         `{"status": "ok"}`,
+			expectedError: true,
+		},
+		{
+			name:          "Пустое тело",
+			input:         ``,
+			expectedError: true,
+		},
+		{
+			name:          "Незакрытый элемент",
+			input:         `<a><b></a>`,
+			expectedError: true,
+		},
+		{
+			name:          "Незакрытый корневой элемент",
+			input:         `<a><b/>`,
+			expectedError: true,
+		},
+		{
+			name:          "Неизвестная сущность",
+			input:         `<a>&nbsp;</a>`,
+			expectedError: true,
+		},
+		{
+			name:          "Несколько корневых элементов",
+			input:         `<a/><b/>`,
+			expectedError: true,
+		},
+	}
+	for _, item := range table {
+		t.Run(item.name, func(t *testing.T) {
+			_, err := Parse([]byte(item.input))
+			if (err != nil) != item.expectedError {
+				t.Errorf("Неверная ошибка. Expected error %v, got %v", item.expectedError, err)
+			}
+		})
+	}
+}
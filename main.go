@@ -1,19 +1,44 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"os"
+	"os/signal"
 	"platform-service-bus/internal/pkg/config"
+	"platform-service-bus/internal/pkg/secret"
+	"platform-service-bus/internal/pkg/supervisor"
+	"syscall"
+	"time"
 )
 
 func main() {
 	// Аргументы командной строки
 	flagLog := flag.String("log", "platform-service-bus.log", "File to put logs into")
+	flagWatch := flag.Duration("watch", 0, "Interval to check config and template files for changes, 0 to disable")
+	flagShutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "Time to wait for in-flight requests on shutdown and reload")
+	flagConfig := flag.String("config", "config/config.json", "Path to the config file")
+	flag.Usage = usage
 	flag.Parse()
 
-	// Настройка логирования
+	// Подкоманды
+	switch flag.Arg(0) {
+	case "":
+	case "validate":
+		os.Exit(validate(*flagConfig))
+	case "dlq":
+		os.Exit(dlq(*flagConfig, flag.Args()[1:]))
+	default:
+		fmt.Fprintf(flag.CommandLine.Output(), "Unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	// Настройка логирования, секретные значения из конфигурации в логи не попадают
+	log.SetFormatter(&secret.Formatter{Formatter: log.StandardLogger().Formatter})
 	file, err := os.OpenFile(*flagLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err == nil {
 		mw := io.MultiWriter(os.Stdout, file)
@@ -22,18 +47,66 @@ func main() {
 		log.Info("Не удалось открыть файл для логирования")
 	}
 
-	log.Info("Загружаем config.json")
-	// Подгружаем конфигурацию
-	configObject, err := config.Load("config/config.json")
-	if err != nil {
-		panic(err)
+	// Подгружаем конфигурацию и для каждого адаптера поднимаем свой сервер
+	bus := supervisor.New(*flagConfig)
+	if err := bus.Start(context.Background()); err != nil {
+		log.Fatalf("Не удалось запустить адаптеры: %v", err)
+	}
+
+	// Отслеживаем изменения файлов конфигурации и шаблонов
+	stopWatch := make(chan struct{})
+	if *flagWatch > 0 {
+		go bus.Watch(*flagWatch, stopWatch)
+	}
+
+	// По SIGHUP перечитываем конфигурацию, по SIGINT и SIGTERM завершаем работу
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		ctx, cancel := context.WithTimeout(context.Background(), *flagShutdownTimeout)
+		if sig == syscall.SIGHUP {
+			log.Info("Получен SIGHUP, перезагружаем конфигурацию")
+			bus.Reload(ctx)
+			cancel()
+			continue
+		}
+		log.Infof("Получен сигнал %v, завершаем работу", sig)
+		close(stopWatch)
+		if err := bus.Shutdown(ctx); err != nil {
+			log.Errorf("Не все запросы завершились до остановки: %v", err)
+		}
+		cancel()
+		return
 	}
+}
+
+// usage выводит справку по аргументам командной строки
+func usage() {
+	output := flag.CommandLine.Output()
+	fmt.Fprintf(output, "Usage: %s [flags] [command]\n\nCommands:\n", os.Args[0])
+	fmt.Fprintf(output, "  validate\tcheck the config file and exit\n")
+	fmt.Fprintf(output, "  dlq list\tlist undelivered requests\n")
+	fmt.Fprintf(output, "  dlq show <id>\tprint an undelivered request\n")
+	fmt.Fprintf(output, "  dlq replay <id>... | all\tqueue undelivered requests for delivery again\n")
+	fmt.Fprintf(output, "  dlq purge <id>... | all\tdelete undelivered requests\n\nFlags:\n")
+	flag.PrintDefaults()
+}
 
-	// Для каждого адаптера поднимаем свой сервер
-	finish := make(chan bool)
-	for _, adapter := range configObject.Adapters {
-		currentAdapter := adapter
-		go currentAdapter.StartServer()
+// validate проверяет файл конфигурации и выводит все найденные ошибки
+// Возвращает код завершения процесса
+func validate(configPath string) int {
+	_, err := config.Validate(configPath)
+	if validationError, ok := err.(*config.ValidationError); ok {
+		for _, problem := range validationError.Problems {
+			fmt.Println(problem)
+		}
+		fmt.Printf("%s: найдено ошибок: %d\n", configPath, len(validationError.Problems))
+		return 1
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
 	}
-	<-finish
+	fmt.Printf("%s: ошибок не найдено\n", configPath)
+	return 0
 }